@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+
+	"github.com/therealbill/palisade/sentinel"
+)
+
+// The backend chain lives in the sentinel package, shared with the example
+// proxies; palisade adds StoreBackend, which ends a chain in its own pods.
+type (
+	Backend            = sentinel.Backend
+	Origin             = sentinel.Origin
+	ShardingBackend    = sentinel.ShardingBackend
+	PodPasswordBackend = sentinel.PodPasswordBackend
+	ProxyBackend       = sentinel.ProxyBackend
+	EventListener      = sentinel.EventListener
+)
+
+var (
+	BuildBackend          = sentinel.BuildBackend
+	NewPodPasswordBackend = sentinel.NewPodPasswordBackend
+	NewProxyBackend       = sentinel.NewProxyBackend
+)
+
+// stamp records the origin on a mutation.
+func stamp(o Origin, m Mutation) Mutation {
+	m.Actor, m.Command, m.Time = o.Actor, o.Command, o.Time
+	return m
+}
+
+// StoreBackend serves the pods held in the local PodStore, sending changes
+// through a Registry so file, Consul, database, DNS, Redis Cluster and raft
+// sources all look the same from the outside.
+type StoreBackend struct {
+	Registry Registry
+	Store    *PodStore
+}
+
+func (b *StoreBackend) LookupMaster(name string) (RedisPod, bool, error) {
+	if l, ok := b.Registry.(PodLookup); ok {
+		return l.Lookup(name)
+	}
+	if err := b.Registry.ReadBarrier(); err != nil {
+		return RedisPod{}, false, err
+	}
+	pod, exists := b.Store.Get(name)
+	return pod, exists, nil
+}
+
+func (b *StoreBackend) ListMasters() ([]RedisPod, error) {
+	if err := b.Registry.ReadBarrier(); err != nil {
+		return nil, err
+	}
+	return b.Store.List(), nil
+}
+
+func (b *StoreBackend) Replicas(name string) ([]string, error) {
+	pod, exists, err := b.LookupMaster(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, NoSuchPod
+	}
+	return pod.Replicas, nil
+}
+
+func (b *StoreBackend) Sentinels(name string) ([]KnownSentinel, error) {
+	pod, exists, err := b.LookupMaster(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, NoSuchPod
+	}
+	return pod.Sentinels, nil
+}
+
+func (b *StoreBackend) Monitor(o Origin, pod RedisPod) error {
+	return b.Registry.Apply(stamp(o, Mutation{Op: OpMonitor, Pod: pod}))
+}
+
+func (b *StoreBackend) Set(o Origin, name, setting, value string) error {
+	return b.Registry.Apply(stamp(o, Mutation{Op: OpSet, Name: name, Setting: setting, Value: value}))
+}
+
+func (b *StoreBackend) Remove(o Origin, name string) error {
+	return b.Registry.Apply(stamp(o, Mutation{Op: OpRemove, Name: name}))
+}
+
+func (b *StoreBackend) Subscribe(l EventListener) func() {
+	return AddEventListener(l)
+}
+
+// replicaHostPort splits a replica address for replies that report the ip
+// and port separately.
+func replicaHostPort(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+var (
+	ClusterDisabled = errors.New("NOCLUSTER palisade is not running in cluster mode")
+
+	RaftApplyTimeout = 5 * time.Second
+	RaftMaxPool      = 3
+	RaftSnapRetain   = 2
+)
+
+// ClusterConfig describes how a node takes part in a palisade cluster.
+type ClusterConfig struct {
+	// ID uniquely identifies this node in the cluster.
+	ID string
+	// BindAddr is the host:port raft traffic is served on. It must be
+	// reachable by the other nodes.
+	BindAddr string
+	// ClientAddr is the host:port clients reach this node on. Followers
+	// send clients writing to them to the leader's.
+	ClientAddr string
+	// DataDir holds the raft log and snapshots. Both are kept in memory,
+	// and lost on restart, when empty.
+	DataDir string
+	// Bootstrap starts a brand new single node cluster. Further nodes are
+	// added with RAFT JOIN on the leader.
+	Bootstrap bool
+	// ConsistentReads makes reads confirm leadership first. By default any
+	// node, including followers, answers reads from its local copy.
+	ConsistentReads bool
+}
+
+// ClusterNode replicates mutations to a PodStore through a raft log shared
+// by every palisade node in the cluster.
+type ClusterNode struct {
+	Config    ClusterConfig
+	Raft      *raft.Raft
+	store     *PodStore
+	transport *raft.NetworkTransport
+	logs      io.Closer
+	done      chan struct{}
+}
+
+// NotLeaderError sends a write to the leader. Leader is the leader's client
+// address, empty when there is no leader or its address isn't known yet.
+type NotLeaderError struct {
+	ID     string
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	switch {
+	case e.ID == "":
+		return "NOTLEADER no cluster leader elected"
+	case e.Leader == "":
+		return fmt.Sprintf("NOTLEADER writes must go to the leader %s, whose address isn't known yet", e.ID)
+	}
+	return fmt.Sprintf("NOTLEADER writes must go to the leader at %s", e.Leader)
+}
+
+// NewClusterNode starts raft for the given config, applying committed
+// mutations to store.
+func NewClusterNode(cfg ClusterConfig, store *PodStore) (*ClusterNode, error) {
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.ID)
+	leadership := make(chan bool, 1)
+	rc.NotifyCh = leadership
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(cfg.BindAddr, addr, RaftMaxPool, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		snaps  raft.SnapshotStore
+		logs   raft.LogStore
+		stable raft.StableStore
+		closer io.Closer
+	)
+	if cfg.DataDir != "" {
+		snaps, err = raft.NewFileSnapshotStore(cfg.DataDir, RaftSnapRetain, os.Stderr)
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+		bolt, err := raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+		logs, stable, closer = bolt, bolt, bolt
+	} else {
+		snaps = raft.NewInmemSnapshotStore()
+		mem := raft.NewInmemStore()
+		logs, stable = mem, mem
+	}
+
+	// Entries already in the log were announced before the restart, so
+	// they are applied again silently.
+	replayed, err := logs.LastIndex()
+	if err != nil {
+		transport.Close()
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	fsm := &podFSM{store: store, replayed: replayed}
+	r, err := raft.NewRaft(rc, fsm, logs, stable, snaps, transport)
+	if err != nil {
+		transport.Close()
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	fsm.Lock()
+	fsm.raft = r
+	fsm.Unlock()
+	n := &ClusterNode{Config: cfg, Raft: r, store: store, transport: transport, logs: closer, done: make(chan struct{})}
+	go n.advertise(leadership)
+	if cfg.Bootstrap {
+		conf := raft.Configuration{Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}}}
+		if err := r.BootstrapCluster(conf).Error(); err != nil && err != raft.ErrCantBootstrap {
+			n.Shutdown()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Apply commits a mutation through the raft log. Only the leader can accept
+// writes.
+func (n *ClusterNode) Apply(m Mutation) error {
+	if n.Raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f := n.Raft.Apply(data, RaftApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return n.notLeader()
+		}
+		return err
+	}
+	if resp, ok := f.Response().(error); ok {
+		return resp
+	}
+	return nil
+}
+
+// ReadBarrier is called before serving reads. Unless ConsistentReads is set
+// every node serves reads from its own copy of the state.
+func (n *ClusterNode) ReadBarrier() error {
+	if !n.Config.ConsistentReads {
+		return nil
+	}
+	if err := n.Raft.VerifyLeader().Error(); err != nil {
+		return n.notLeader()
+	}
+	return nil
+}
+
+// Join adds a voting member. It must be called on the leader.
+func (n *ClusterNode) Join(id, addr string) error {
+	if n.Raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	return n.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error()
+}
+
+// Leave removes a member. It must be called on the leader.
+func (n *ClusterNode) Leave(id string) error {
+	if n.Raft.State() != raft.Leader {
+		return n.notLeader()
+	}
+	if err := n.Raft.RemoveServer(raft.ServerID(id), 0, 0).Error(); err != nil {
+		return err
+	}
+	return n.Apply(Mutation{Op: OpSetMember, Name: id})
+}
+
+// advertise records this node's client address in the log whenever it
+// becomes the leader, so followers can send clients to it.
+func (n *ClusterNode) advertise(leadership <-chan bool) {
+	for {
+		select {
+		case <-n.done:
+			return
+		case leading := <-leadership:
+			if !leading || n.Config.ClientAddr == "" || n.store.MemberAddr(n.Config.ID) == n.Config.ClientAddr {
+				continue
+			}
+			if err := n.Apply(Mutation{Op: OpSetMember, Name: n.Config.ID, Value: n.Config.ClientAddr}); err != nil {
+				log.Printf("unable to advertise client address %s: %v", n.Config.ClientAddr, err)
+			}
+		}
+	}
+}
+
+// Members lists the cluster configuration as id/address pairs.
+func (n *ClusterNode) Members() ([]raft.Server, error) {
+	f := n.Raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	return f.Configuration().Servers, nil
+}
+
+// Leader is the ID and client address of the leader, either empty when
+// unknown.
+func (n *ClusterNode) Leader() (string, string) {
+	_, id := n.Raft.LeaderWithID()
+	return string(id), n.store.MemberAddr(string(id))
+}
+
+func (n *ClusterNode) Snapshot() error {
+	return n.Raft.Snapshot().Error()
+}
+
+func (n *ClusterNode) Shutdown() error {
+	close(n.done)
+	err := n.Raft.Shutdown().Error()
+	n.transport.Close()
+	if n.logs != nil {
+		n.logs.Close()
+	}
+	return err
+}
+
+func (n *ClusterNode) notLeader() error {
+	id, addr := n.Leader()
+	return &NotLeaderError{ID: id, Leader: addr}
+}
+
+// podFSM adapts a PodStore to raft's state machine interface. Every node
+// applies each committed mutation, but only the leader announces it, so
+// events are sent and scripts run once per change rather than once per node.
+type podFSM struct {
+	sync.Mutex
+	store    *PodStore
+	raft     *raft.Raft
+	replayed uint64
+}
+
+// leading reports whether this node is the leader. It is false until raft
+// has started.
+func (f *podFSM) leading() bool {
+	f.Lock()
+	r := f.raft
+	f.Unlock()
+	return r != nil && r.State() == raft.Leader
+}
+
+func (f *podFSM) Apply(l *raft.Log) interface{} {
+	var m Mutation
+	if err := json.Unmarshal(l.Data, &m); err != nil {
+		return err
+	}
+	if l.Index <= f.replayed || !f.leading() {
+		return f.store.Replay(m)
+	}
+	return f.store.Apply(m)
+}
+
+func (f *podFSM) Snapshot() (raft.FSMSnapshot, error) {
+	data, err := f.store.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &podSnapshot{data}, nil
+}
+
+func (f *podFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return f.store.Restore(data)
+}
+
+type podSnapshot struct {
+	data []byte
+}
+
+func (s *podSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *podSnapshot) Release() {}
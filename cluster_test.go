@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitFor polls cond until it holds or the deadline passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestClusterReplicatesOverLoopback(t *testing.T) {
+	root, err := ioutil.TempDir("", "palisade-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var (
+		mu       sync.Mutex
+		monitors int
+	)
+	defer AddEventListener(func(pod RedisPod, etype, msg string) {
+		if etype == "+monitor" {
+			mu.Lock()
+			monitors++
+			mu.Unlock()
+		}
+	})()
+
+	ids := []string{"n1", "n2", "n3"}
+	cfgs := make([]ClusterConfig, len(ids))
+	nodes := make([]*ClusterNode, len(ids))
+	stores := make([]*PodStore, len(ids))
+	for i, id := range ids {
+		cfgs[i] = ClusterConfig{
+			ID:         id,
+			BindAddr:   freeAddr(t),
+			ClientAddr: fmt.Sprintf("127.0.0.1:%d", 6380+i),
+			DataDir:    filepath.Join(root, id),
+			Bootstrap:  i == 0,
+		}
+		if err := os.Mkdir(cfgs[i].DataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = NewPodStore()
+		if nodes[i], err = NewClusterNode(cfgs[i], stores[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.Shutdown()
+			}
+		}
+	}()
+
+	leader := nodes[0]
+	waitFor(t, "n1 to lead", func() bool { return leader.Raft.State() == raft.Leader })
+	for i := 1; i < len(nodes); i++ {
+		if err := leader.Join(cfgs[i].ID, cfgs[i].BindAddr); err != nil {
+			t.Fatalf("joining %s: %v", cfgs[i].ID, err)
+		}
+	}
+
+	waitFor(t, "n2 to learn the leader's client address", func() bool {
+		return stores[1].MemberAddr("n1") == cfgs[0].ClientAddr
+	})
+	if err := nodes[1].Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err == nil {
+		t.Error("a follower accepted a write")
+	} else if nl, ok := err.(*NotLeaderError); !ok {
+		t.Errorf("follower write failed with %v, want a NotLeaderError", err)
+	} else if nl.Leader != cfgs[0].ClientAddr {
+		t.Errorf("a follower sent a write to %q, want the leader's client address %s", nl.Leader, cfgs[0].ClientAddr)
+	}
+
+	if err := leader.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range stores {
+		waitFor(t, ids[i]+" to hold the pod", func() bool {
+			_, ok := s.Get("cache")
+			return ok
+		})
+	}
+	mu.Lock()
+	if monitors != 1 {
+		t.Errorf("got %d +monitor events from %d nodes, want 1 from the leader", monitors, len(nodes))
+	}
+	monitors = 0
+	mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(cfgs[2].DataDir, "raft.db")); err != nil {
+		t.Errorf("no raft log under --raft-dir: %v", err)
+	}
+
+	// A restarted follower rebuilds its pods from the log on disk without
+	// announcing them again.
+	nodes[2].Shutdown()
+	cfgs[2].Bootstrap = false
+	stores[2] = NewPodStore()
+	if nodes[2], err = NewClusterNode(cfgs[2], stores[2]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "n3 to recover the pod", func() bool {
+		_, ok := stores[2].Get("cache")
+		return ok
+	})
+	mu.Lock()
+	if monitors != 0 {
+		t.Errorf("restarting a node sent %d +monitor events, want none", monitors)
+	}
+	mu.Unlock()
+}
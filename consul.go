@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var (
+	CASConflict = errors.New("CASCONFLICT pod was changed concurrently, retry")
+
+	ConsulCASRetries = 5
+	ConsulWaitTime   = 5 * time.Minute
+	ConsulRetryDelay = time.Second
+	// ConsulMaxTxnOps is the most operations Consul accepts in one
+	// transaction.
+	ConsulMaxTxnOps = 64
+)
+
+// ConsulConfig describes where in Consul a palisade keeps its pods.
+type ConsulConfig struct {
+	Address    string
+	Token      string
+	Datacenter string
+	// Prefix is the KV root shared by all palisade instances.
+	Prefix string
+	// SentinelName identifies this sentinel's pods under Prefix and is
+	// used to name the events it publishes.
+	SentinelName string
+}
+
+// ConsulRegistry keeps pods in Consul's KV store, one JSON encoded RedisPod
+// per key under <prefix>/<sentinel name>/pods/. Writes use check-and-set so
+// concurrent palisades never clobber each other, and a blocking query
+// reloads the local store whenever the keys change. Every sentinel event is
+// also fired as a Consul user event named "<sentinel name>:<event type>".
+type ConsulRegistry struct {
+	Config   ConsulConfig
+	client   *api.Client
+	store    *PodStore
+	done     chan struct{}
+	unlisten func()
+
+	// loadLock orders loads from the watch and from writes, so an older
+	// listing never replaces a newer one. index is the Consul index of the
+	// pods in the store.
+	loadLock sync.Mutex
+	index    uint64
+}
+
+func NewConsulRegistry(cfg ConsulConfig, store *PodStore) (*ConsulRegistry, error) {
+	ccfg := api.DefaultConfig()
+	if cfg.Address != "" {
+		ccfg.Address = cfg.Address
+	}
+	ccfg.Token = cfg.Token
+	ccfg.Datacenter = cfg.Datacenter
+	client, err := api.NewClient(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "palisade"
+	}
+	c := &ConsulRegistry{Config: cfg, client: client, store: store, done: make(chan struct{})}
+	// The pods already in Consul were announced by whoever added them.
+	pods, index, err := c.list(0)
+	if err != nil {
+		return nil, err
+	}
+	store.Seed(pods)
+	c.index = index
+	go c.watch(index)
+	c.unlisten = AddEventListener(c.publishEvent)
+	return c, nil
+}
+
+func (c *ConsulRegistry) podPrefix() string {
+	return path.Join(c.Config.Prefix, c.Config.SentinelName, "pods") + "/"
+}
+
+func (c *ConsulRegistry) podKey(name string) string {
+	return c.podPrefix() + name
+}
+
+// Apply writes pod mutations to Consul with check-and-set, retrying when
+// another writer got there first, then loads the pods back so the store
+// holds what Consul holds rather than a local guess at it. Token changes are
+// not kept in Consul.
+func (c *ConsulRegistry) Apply(m Mutation) error {
+	switch m.Op {
+	case OpMonitor, OpSet, OpRemove:
+		var err error
+		for i := 0; i < ConsulCASRetries; i++ {
+			if err = c.casApply(m); err != CASConflict {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, err = c.reload(Origin{Actor: m.Actor, Command: m.Command, Time: m.Time}, 0)
+		return err
+	case OpRestore:
+		if err := c.restore(m.Pods); err != nil {
+			return err
+		}
+		_, err := c.reload(Origin{Actor: m.Actor, Command: m.Command, Time: m.Time}, 0)
+		return err
+	}
+	return c.store.Apply(m)
+}
+
+// restore writes the pods' states, removing those that are nil, in
+// transactions of at most ConsulMaxTxnOps pods. Each transaction is
+// atomic but a rollback of more pods is not: when one fails, the pods of
+// the transactions before it stay restored.
+func (c *ConsulRegistry) restore(states map[string]*RedisPod) error {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ops api.TxnOps
+	for i, name := range names {
+		op := &api.KVTxnOp{Verb: api.KVDelete, Key: c.podKey(name)}
+		if pod := states[name]; pod != nil {
+			value, err := json.Marshal(pod)
+			if err != nil {
+				return err
+			}
+			op = &api.KVTxnOp{Verb: api.KVSet, Key: c.podKey(name), Value: value}
+		}
+		ops = append(ops, &api.TxnOp{KV: op})
+		if len(ops) < ConsulMaxTxnOps && i < len(names)-1 {
+			continue
+		}
+		ok, resp, _, err := c.client.Txn().Txn(ops, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("%v", resp.Errors)
+		}
+		if err != nil {
+			return fmt.Errorf("ERR consul refused the rollback after %d of %d pods: %v", i+1-len(ops), len(names), err)
+		}
+		ops = nil
+	}
+	return nil
+}
+
+func (c *ConsulRegistry) casApply(m Mutation) error {
+	kv := c.client.KV()
+	name := m.Name
+	if m.Op == OpMonitor {
+		name = m.Pod.Name
+	}
+	pair, _, err := kv.Get(c.podKey(name), nil)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	switch m.Op {
+	case OpMonitor:
+		p := &api.KVPair{Key: c.podKey(name)}
+		pod := m.Pod
+		if pair != nil {
+			p.ModifyIndex = pair.ModifyIndex
+			var prev RedisPod
+			if err = json.Unmarshal(pair.Value, &prev); err != nil {
+				return err
+			}
+			prev.Name = name
+			pod = remonitor(prev, pod)
+		}
+		if p.Value, err = json.Marshal(pod); err != nil {
+			return err
+		}
+		ok, _, err = kv.CAS(p, nil)
+	case OpSet:
+		if pair == nil {
+			return NoSuchPod
+		}
+		var pod RedisPod
+		if err = json.Unmarshal(pair.Value, &pod); err != nil {
+			return err
+		}
+		if err = applySetting(&pod, m.Setting, m.Value); err != nil {
+			return err
+		}
+		if pair.Value, err = json.Marshal(pod); err != nil {
+			return err
+		}
+		ok, _, err = kv.CAS(pair, nil)
+	case OpRemove:
+		if pair == nil {
+			return NoSuchPod
+		}
+		ok, _, err = kv.DeleteCAS(pair, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return CASConflict
+	}
+	return nil
+}
+
+func (c *ConsulRegistry) ReadBarrier() error {
+	return nil
+}
+
+// reload fetches every pod, waiting for a change past index first when it is
+// non-zero, and loads them into the store as changed by o unless the store
+// already holds the same or a newer listing. It returns the new index.
+func (c *ConsulRegistry) reload(o Origin, index uint64) (uint64, error) {
+	pods, next, err := c.list(index)
+	if err != nil {
+		return index, err
+	}
+	c.loadLock.Lock()
+	defer c.loadLock.Unlock()
+	// Consul can reset its index, e.g. after a restore; start over.
+	if next < index {
+		c.index = 0
+	}
+	if next > c.index {
+		c.store.Load(o, pods)
+		c.index = next
+	}
+	return next, nil
+}
+
+// list fetches every pod, waiting for a change past index first when it is
+// non-zero.
+func (c *ConsulRegistry) list(index uint64) (map[string]RedisPod, uint64, error) {
+	opts := &api.QueryOptions{WaitIndex: index, WaitTime: ConsulWaitTime}
+	pairs, meta, err := c.client.KV().List(c.podPrefix(), opts)
+	if err != nil {
+		return nil, index, err
+	}
+	pods := make(map[string]RedisPod)
+	for _, pair := range pairs {
+		var pod RedisPod
+		if err := json.Unmarshal(pair.Value, &pod); err != nil {
+			log.Printf("consul: skipping undecodable pod at '%s': %v", pair.Key, err)
+			continue
+		}
+		pod.Name = strings.TrimPrefix(pair.Key, c.podPrefix())
+		pods[pod.Name] = pod
+	}
+	return pods, meta.LastIndex, nil
+}
+
+func (c *ConsulRegistry) watch(index uint64) {
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		next, err := c.reload(Origin{Actor: "consul", Command: "watch"}, index)
+		if err != nil {
+			log.Printf("consul: watch failed: %v", err)
+			time.Sleep(ConsulRetryDelay)
+			continue
+		}
+		// Consul can reset its index, e.g. after a restore; start over.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+func (c *ConsulRegistry) publishEvent(pod RedisPod, etype, msg string) {
+	ev := &api.UserEvent{Name: c.Config.SentinelName + ":" + etype, Payload: []byte(msg)}
+	go func() {
+		if _, _, err := c.client.Event().Fire(ev, nil); err != nil {
+			log.Printf("consul: unable to publish %s: %v", etype, err)
+		}
+	}()
+}
+
+// Close stops watching Consul for changes and publishing events.
+func (c *ConsulRegistry) Close() {
+	c.unlisten()
+	close(c.done)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves just enough of Consul's KV and event API for
+// ConsulRegistry: recursive and single key reads, blocking on ?index=,
+// check-and-set writes and deletes, and firing user events.
+type fakeConsul struct {
+	sync.Mutex
+	index   uint64
+	kv      map[string]fakePair
+	events  []string
+	txns    int
+	changed chan struct{}
+}
+
+type fakePair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, kv: make(map[string]fakePair), changed: make(chan struct{})}
+}
+
+// put stores a key directly, as another palisade writing to Consul would.
+func (f *fakeConsul) put(key string, value []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	f.kv[key] = fakePair{Key: key, Value: value, ModifyIndex: f.index}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	if strings.HasPrefix(r.URL.Path, "/v1/event/fire/") {
+		f.Lock()
+		f.events = append(f.events, strings.TrimPrefix(r.URL.Path, "/v1/event/fire/"))
+		f.Unlock()
+		w.Write([]byte(`{"ID":"1"}`))
+		return
+	}
+	if r.URL.Path == "/v1/txn" {
+		f.txn(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		if wait, _ := strconv.ParseUint(q.Get("index"), 10, 64); wait > 0 {
+			f.Lock()
+			ch, stale := f.changed, f.index > wait
+			f.Unlock()
+			if !stale {
+				select {
+				case <-ch:
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		f.Lock()
+		defer f.Unlock()
+		var pairs []fakePair
+		for k, p := range f.kv {
+			if k == key || (q.Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, p)
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case "PUT", "DELETE":
+		body, _ := ioutil.ReadAll(r.Body)
+		cas, _ := strconv.ParseUint(q.Get("cas"), 10, 64)
+		f.Lock()
+		cur, exists := f.kv[key]
+		ok := q.Get("cas") == "" || (cas == 0 && !exists) || (exists && cur.ModifyIndex == cas)
+		f.Unlock()
+		if ok {
+			if r.Method == "PUT" {
+				f.put(key, body)
+			} else {
+				f.Lock()
+				f.index++
+				delete(f.kv, key)
+				close(f.changed)
+				f.changed = make(chan struct{})
+				f.Unlock()
+			}
+		}
+		w.Write([]byte(strconv.FormatBool(ok)))
+	}
+}
+
+// txn applies set and delete operations, refusing more than Consul's
+// limit of 64 in one transaction.
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []struct {
+		KV struct {
+			Verb  string
+			Key   string
+			Value []byte
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ops) > 64 {
+		http.Error(w, "Transaction contains too many operations", http.StatusRequestEntityTooLarge)
+		return
+	}
+	f.Lock()
+	f.txns++
+	f.Unlock()
+	for _, op := range ops {
+		if op.KV.Verb == "set" {
+			f.put(op.KV.Key, op.KV.Value)
+			continue
+		}
+		f.Lock()
+		f.index++
+		delete(f.kv, op.KV.Key)
+		close(f.changed)
+		f.changed = make(chan struct{})
+		f.Unlock()
+	}
+	w.Write([]byte(`{"Results":[],"Errors":null}`))
+}
+
+func (f *fakeConsul) firedEvents() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+func TestConsulRegistry(t *testing.T) {
+	fake := newFakeConsul()
+	existing, _ := json.Marshal(RedisPod{Name: "old", IP: "10.0.0.9", Port: "6379", Quorum: "2"})
+	fake.put("palisade/test/pods/old", existing)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := NewPodStore()
+	c, err := NewConsulRegistry(ConsulConfig{Address: strings.TrimPrefix(srv.URL, "http://"), SentinelName: "test"}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, ok := store.Get("old"); !ok {
+		t.Fatal("pod already in Consul was not loaded")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ev := fake.firedEvents(); len(ev) != 0 {
+		t.Errorf("first load fired %v, want no events", ev)
+	}
+
+	if err := c.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(Mutation{Op: OpSet, Name: "cache", Setting: "parallel-syncs", Value: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	pod, ok := store.Get("cache")
+	if !ok || pod.ParallelSyncs != 3 {
+		t.Errorf("store holds %+v after SET, want parallel-syncs 3", pod)
+	}
+	if err := c.Apply(Mutation{Op: OpSet, Name: "missing", Setting: "quorum", Value: "2"}); err != NoSuchPod {
+		t.Errorf("SET on a missing pod returned %v, want %v", err, NoSuchPod)
+	}
+
+	// Another palisade moves the master; the watch picks it up.
+	moved, _ := json.Marshal(RedisPod{Name: "cache", IP: "10.0.0.2", Port: "6379", Quorum: "2", ParallelSyncs: 3})
+	fake.put("palisade/test/pods/cache", moved)
+	waitFor(t, "the watch to load the moved master", func() bool {
+		pod, _ := store.Get("cache")
+		return pod.IP == "10.0.0.2"
+	})
+
+	if err := c.Apply(Mutation{Op: OpRemove, Name: "cache"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("cache"); ok {
+		t.Error("removed pod is still in the store")
+	}
+
+	want := []string{"test:+monitor", "test:+switch-master", "test:-monitor"}
+	waitFor(t, "the events to be fired", func() bool { return len(fake.firedEvents()) >= len(want) })
+	got := fake.firedEvents()
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("fired %v, want each of %v once", got, want)
+	}
+}
+
+func TestConsulRemonitorAndRestore(t *testing.T) {
+	fake := newFakeConsul()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	store := NewPodStore()
+	c, err := NewConsulRegistry(ConsulConfig{Address: strings.TrimPrefix(srv.URL, "http://"), SentinelName: "test"}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, setting := range [][]string{{"auth-pass", "hunter2"}, {"parallel-syncs", "3"}, {"notification-script", "/bin/notify"}} {
+		if err := c.Apply(Mutation{Op: OpSet, Name: "cache", Setting: setting[0], Value: setting[1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.2", Port: "6380", Quorum: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	pod, _ := store.Get("cache")
+	if pod.IP != "10.0.0.2" || pod.Port != "6380" || pod.Quorum != "3" {
+		t.Errorf("monitoring cache again left it at %s:%s quorum %s", pod.IP, pod.Port, pod.Quorum)
+	}
+	if pod.AuthPass != "hunter2" || pod.ParallelSyncs != 3 || pod.NotificationScript != "/bin/notify" {
+		t.Errorf("monitoring cache again lost its settings: %+v", pod)
+	}
+
+	states := make(map[string]*RedisPod)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("pod%d", i)
+		states[name] = &RedisPod{Name: name, IP: "10.1.0.1", Port: strconv.Itoa(7000 + i), Quorum: "2"}
+	}
+	states["cache"] = nil
+	if err := c.Apply(Mutation{Op: OpRestore, Pods: states}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(store.List()); got != 100 {
+		t.Errorf("restoring 100 pods and removing one left %d pods", got)
+	}
+	fake.Lock()
+	txns := fake.txns
+	fake.Unlock()
+	if txns != 2 {
+		t.Errorf("restoring 101 pods took %d transactions, want 2", txns)
+	}
+}
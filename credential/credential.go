@@ -0,0 +1,127 @@
+// Package credential keeps secrets as salted bcrypt hashes that can expire,
+// for palisade's auth tokens and the auth proxy's users.
+package credential
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	InvalidHash = errors.New("the password hash must be a bcrypt hash or, from older ACL files, 64 lowercase hexadecimal characters")
+
+	// BcryptCost is the work factor of new credentials.
+	BcryptCost = bcrypt.DefaultCost
+)
+
+// Credential is one secret. Only a salted bcrypt hash is kept; unsalted
+// SHA-256 hashes are still accepted from files and logs written before, so
+// they can be rotated out.
+type Credential struct {
+	Hash string
+	// Expires is when the credential stops working; zero for never.
+	Expires time.Time
+}
+
+// New hashes a secret.
+func New(secret string, expires time.Time) (Credential, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), BcryptCost)
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{Hash: string(hash), Expires: expires}, nil
+}
+
+// Parse reads a credential as String writes it: the hash, then @ and the
+// unix time it expires at, if it does.
+func Parse(s string) (Credential, error) {
+	var cred Credential
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		unix, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return cred, fmt.Errorf("'%s' is not a valid expiry time", s[i+1:])
+		}
+		cred.Expires = time.Unix(unix, 0)
+		s = s[:i]
+	}
+	cred.Hash = s
+	if cred.Legacy() {
+		if _, err := hex.DecodeString(s); err != nil || s != strings.ToLower(s) {
+			return cred, InvalidHash
+		}
+		return cred, nil
+	}
+	if _, err := bcrypt.Cost([]byte(s)); err != nil {
+		return cred, InvalidHash
+	}
+	return cred, nil
+}
+
+// Legacy reports whether the credential is an unsalted SHA-256 hash.
+func (c Credential) Legacy() bool {
+	return len(c.Hash) == sha256.Size*2 && !strings.HasPrefix(c.Hash, "$")
+}
+
+func (c Credential) String() string {
+	if c.Expires.IsZero() {
+		return c.Hash
+	}
+	return fmt.Sprintf("%s@%d", c.Hash, c.Expires.Unix())
+}
+
+// ID names the credential without showing its hash.
+func (c Credential) ID() string {
+	sum := sha256.Sum256([]byte(c.Hash))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (c Credential) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// Matches compares a secret with the credential in constant time.
+func (c Credential) Matches(secret string) bool {
+	if c.Legacy() {
+		sum := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(c.Hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(secret)) == nil
+}
+
+// Check reports whether secret is one of the unexpired credentials. Every
+// credential is checked, so the time taken doesn't tell which one matched
+// or whether an expired one did.
+func Check(creds []Credential, secret string) bool {
+	now := time.Now()
+	valid := 0
+	for _, cred := range creds {
+		if cred.Matches(secret) && !cred.Expired(now) {
+			valid = 1
+		}
+	}
+	return valid == 1
+}
+
+// ParseTTL reads an optional "TTL <seconds>" from args, returning the
+// expiry time it gives.
+func ParseTTL(args []string) (time.Time, error) {
+	if len(args) == 0 {
+		return time.Time{}, nil
+	}
+	if len(args) != 2 || strings.ToUpper(args[0]) != "TTL" {
+		return time.Time{}, errors.New("ERR syntax error")
+	}
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, errors.New("ERR TTL must be a positive number of seconds")
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second), nil
+}
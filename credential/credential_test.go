@@ -0,0 +1,41 @@
+package credential
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	BcryptCost = bcrypt.MinCost
+}
+
+func TestParseReadsString(t *testing.T) {
+	cred, err := New("s3cret", time.Unix(2000000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(cred.String())
+	if err != nil || parsed.Hash != cred.Hash || !parsed.Expires.Equal(cred.Expires) {
+		t.Errorf("Parse(%q) = %+v, %v", cred.String(), parsed, err)
+	}
+	if _, err := Parse("s3cret"); err != InvalidHash {
+		t.Errorf("a secret parsed as a hash: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	current, _ := New("current", time.Time{})
+	old, _ := New("old", time.Now().Add(-time.Second))
+	creds := []Credential{old, current}
+	if !Check(creds, "current") {
+		t.Error("the current secret was refused")
+	}
+	if Check(creds, "old") {
+		t.Error("an expired secret was accepted")
+	}
+	if Check(creds, current.Hash) {
+		t.Error("a hash was accepted as its secret")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	DNSReadOnly = errors.New("READONLY pods are published in DNS")
+
+	DefaultDNSInterval = 10 * time.Second
+	DNSQueryTimeout    = 2 * time.Second
+	DNSMinTTL          = time.Second
+	DNSNegativeTTL     = 5 * time.Second
+
+	// DNSCacheSize bounds the pods cached, and DNSMissingCacheSize the names
+	// found not to exist, so lookups of made up names can't grow the cache
+	// without limit or push out real pods.
+	DNSCacheSize        = 10000
+	DNSMissingCacheSize = 1000
+)
+
+// DNSConfig describes where pods are published in DNS.
+type DNSConfig struct {
+	// Domain is appended to pod names: pod "cache" is looked up as
+	// cache.<Domain>.
+	Domain string
+	// Server is the resolver's host:port. The first nameserver in
+	// /etc/resolv.conf is used when empty.
+	Server string
+	// Interval is how often expired answers are refreshed in the
+	// background.
+	Interval time.Duration
+	// DefaultPort is used when a pod only has an A record.
+	DefaultPort string
+}
+
+type dnsCacheEntry struct {
+	pod     RedisPod
+	exists  bool
+	expires time.Time
+}
+
+// DNSRegistry resolves pods from DNS. <pod>.<domain> is looked up as an SRV
+// record, the lowest priority (then highest weight) target being the master
+// and any other targets its replicas; a plain A record with DefaultPort is
+// used when there is no SRV record. Answers are cached for their TTL and
+// refreshed in the background, and answers that change are announced as
+// +monitor, -monitor and +switch-master events. Names that don't exist are
+// remembered for DNSNegativeTTL and then forgotten rather than refreshed.
+type DNSRegistry struct {
+	Config DNSConfig
+	client *dns.Client
+	store  *PodStore
+
+	// updateLock orders updates of the store, so an older answer never
+	// replaces a newer one.
+	updateLock sync.Mutex
+
+	sync.Mutex
+	cache   map[string]dnsCacheEntry
+	missing map[string]time.Time
+	// evicted holds the last answers of pods pushed out of the full cache,
+	// so resolving one again only announces what changed meanwhile.
+	evicted map[string]RedisPod
+	done    chan struct{}
+}
+
+func NewDNSRegistry(cfg DNSConfig, store *PodStore) (*DNSRegistry, error) {
+	if cfg.Domain == "" {
+		return nil, errors.New("a DNS domain is required")
+	}
+	if cfg.Server == "" {
+		rc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		if len(rc.Servers) == 0 {
+			return nil, errors.New("no nameservers in /etc/resolv.conf")
+		}
+		cfg.Server = net.JoinHostPort(rc.Servers[0], rc.Port)
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultDNSInterval
+	}
+	if cfg.DefaultPort == "" {
+		cfg.DefaultPort = "6379"
+	}
+	r := &DNSRegistry{
+		Config:  cfg,
+		client:  &dns.Client{Timeout: DNSQueryTimeout},
+		store:   store,
+		cache:   make(map[string]dnsCacheEntry),
+		missing: make(map[string]time.Time),
+		evicted: make(map[string]RedisPod),
+		done:    make(chan struct{}),
+	}
+	go r.refreshLoop()
+	return r, nil
+}
+
+func (r *DNSRegistry) Apply(m Mutation) error {
+	switch m.Op {
+	case OpMonitor, OpSet, OpRemove, OpRestore:
+		return DNSReadOnly
+	}
+	return r.store.Apply(m)
+}
+
+func (r *DNSRegistry) ReadBarrier() error {
+	return nil
+}
+
+// Lookup answers from the cache while the record's TTL lasts and resolves
+// the pod otherwise.
+func (r *DNSRegistry) Lookup(name string) (RedisPod, bool, error) {
+	now := time.Now()
+	r.Lock()
+	entry, cached := r.cache[name]
+	missingUntil, missing := r.missing[name]
+	r.Unlock()
+	if cached && now.Before(entry.expires) {
+		return entry.pod, true, nil
+	}
+	if missing && now.Before(missingUntil) {
+		return RedisPod{}, false, nil
+	}
+	fresh, err := r.resolve(name)
+	if err != nil {
+		log.Printf("dns: lookup for '%s' failed: %v", name, err)
+		if cached {
+			// Serving a stale answer beats failing the client.
+			return entry.pod, true, nil
+		}
+		return RedisPod{}, false, err
+	}
+	r.update(map[string]dnsCacheEntry{name: fresh})
+	return fresh.pod, fresh.exists, nil
+}
+
+// update stores fresh answers and updates their pods in the store, which
+// announces the answers that changed.
+func (r *DNSRegistry) update(entries map[string]dnsCacheEntry) {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	// Pods that were evicted go back into the store quietly as they were,
+	// and so do the ones evicted now leave it, before the fresh answers are
+	// compared with what the store holds.
+	quiet := make(map[string]*RedisPod)
+	pods := make(map[string]*RedisPod, len(entries))
+	r.Lock()
+	for name, entry := range entries {
+		if prev, ok := r.evicted[name]; ok {
+			delete(r.evicted, name)
+			quiet[name] = &prev
+		}
+		if entry.exists {
+			delete(r.missing, name)
+			if _, ok := r.cache[name]; !ok && len(r.cache) >= DNSCacheSize {
+				if evicted := r.evict(entries); evicted != "" {
+					quiet[evicted] = nil
+				}
+			}
+			r.cache[name] = entry
+			pod := entry.pod
+			pods[name] = &pod
+			continue
+		}
+		delete(r.cache, name)
+		if _, ok := r.missing[name]; !ok && len(r.missing) >= DNSMissingCacheSize {
+			r.evictMissing()
+		}
+		r.missing[name] = entry.expires
+		pods[name] = nil
+	}
+	r.Unlock()
+	r.store.SeedPods(quiet)
+	r.store.Update(Origin{Actor: "dns", Command: "resolve"}, pods)
+}
+
+// evict makes room in the full pod cache by dropping the pod whose answer
+// expired longest ago, or an arbitrary one when none have expired, other
+// than those being updated, and returns its name. Its answer is kept in evicted, itself bounded by
+// DNSCacheSize, and it is resolved again when next asked for. The lock must
+// be held.
+func (r *DNSRegistry) evict(updating map[string]dnsCacheEntry) string {
+	var oldest string
+	for name, entry := range r.cache {
+		if _, ok := updating[name]; ok {
+			continue
+		}
+		if oldest == "" || entry.expires.Before(r.cache[oldest].expires) {
+			oldest = name
+		}
+	}
+	if oldest == "" {
+		return ""
+	}
+	if len(r.evicted) >= DNSCacheSize {
+		for name := range r.evicted {
+			delete(r.evicted, name)
+			break
+		}
+	}
+	r.evicted[oldest] = r.cache[oldest].pod
+	delete(r.cache, oldest)
+	return oldest
+}
+
+// evictMissing drops expired "no such pod" answers, or an arbitrary one
+// when none have expired.
+func (r *DNSRegistry) evictMissing() {
+	now := time.Now()
+	for name, expires := range r.missing {
+		if now.After(expires) {
+			delete(r.missing, name)
+		}
+	}
+	for name := range r.missing {
+		if len(r.missing) < DNSMissingCacheSize {
+			return
+		}
+		delete(r.missing, name)
+	}
+}
+
+func (r *DNSRegistry) refreshLoop() {
+	ticker := time.NewTicker(r.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.refresh()
+		}
+	}
+}
+
+// refresh re-resolves every cached pod whose answer has expired and forgets
+// the expired "no such pod" answers.
+func (r *DNSRegistry) refresh() {
+	now := time.Now()
+	var stale []string
+	r.Lock()
+	for name, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			stale = append(stale, name)
+		}
+	}
+	for name, expires := range r.missing {
+		if !now.Before(expires) {
+			delete(r.missing, name)
+		}
+	}
+	r.Unlock()
+	fresh := make(map[string]dnsCacheEntry)
+	for _, name := range stale {
+		entry, err := r.resolve(name)
+		if err != nil {
+			log.Printf("dns: refresh of '%s' failed: %v", name, err)
+			continue
+		}
+		fresh[name] = entry
+	}
+	if len(fresh) > 0 {
+		r.update(fresh)
+	}
+}
+
+// Close stops the background refresh.
+func (r *DNSRegistry) Close() {
+	close(r.done)
+}
+
+func (r *DNSRegistry) fqdn(name string) string {
+	return dns.Fqdn(name + "." + strings.Trim(r.Config.Domain, "."))
+}
+
+func (r *DNSRegistry) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = true
+	in, _, err := r.client.Exchange(m, r.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s query for %s returned %s", dns.TypeToString[qtype], name, dns.RcodeToString[in.Rcode])
+	}
+	return in, nil
+}
+
+func (r *DNSRegistry) resolve(name string) (dnsCacheEntry, error) {
+	fqdn := r.fqdn(name)
+	missing := dnsCacheEntry{expires: time.Now().Add(DNSNegativeTTL)}
+	in, err := r.query(fqdn, dns.TypeSRV)
+	if err != nil {
+		return missing, err
+	}
+	var srvs []*dns.SRV
+	ttl := uint32(0)
+	for _, rr := range in.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, srv)
+			ttl = minTTL(ttl, rr.Header().Ttl)
+		}
+	}
+	if len(srvs) == 0 {
+		return r.resolveA(name, fqdn, missing)
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	pod := RedisPod{Name: name, Quorum: "1"}
+	for _, srv := range srvs {
+		ip, attl, err := r.targetIP(srv.Target, in)
+		if err != nil {
+			return missing, err
+		}
+		if ip == "" {
+			continue
+		}
+		ttl = minTTL(ttl, attl)
+		port := strconv.Itoa(int(srv.Port))
+		if pod.IP == "" {
+			pod.IP, pod.Port = ip, port
+		} else {
+			pod.Replicas = append(pod.Replicas, net.JoinHostPort(ip, port))
+		}
+	}
+	if pod.IP == "" {
+		return missing, nil
+	}
+	return dnsCacheEntry{pod: pod, exists: true, expires: expiry(ttl)}, nil
+}
+
+func (r *DNSRegistry) resolveA(name, fqdn string, missing dnsCacheEntry) (dnsCacheEntry, error) {
+	in, err := r.query(fqdn, dns.TypeA)
+	if err != nil {
+		return missing, err
+	}
+	for _, rr := range in.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			pod := RedisPod{Name: name, IP: a.A.String(), Port: r.Config.DefaultPort, Quorum: "1"}
+			return dnsCacheEntry{pod: pod, exists: true, expires: expiry(rr.Header().Ttl)}, nil
+		}
+	}
+	return missing, nil
+}
+
+// targetIP finds the address of an SRV target, preferring the additional
+// section of the SRV answer over a separate query.
+func (r *DNSRegistry) targetIP(target string, srvAnswer *dns.Msg) (string, uint32, error) {
+	for _, rr := range srvAnswer.Extra {
+		if a, ok := rr.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, target) {
+			return a.A.String(), a.Hdr.Ttl, nil
+		}
+	}
+	in, err := r.query(target, dns.TypeA)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, rr := range in.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), a.Hdr.Ttl, nil
+		}
+	}
+	return "", 0, nil
+}
+
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
+
+func expiry(ttl uint32) time.Time {
+	d := time.Duration(ttl) * time.Second
+	if d < DNSMinTTL {
+		d = DNSMinTTL
+	}
+	return time.Now().Add(d)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsStub is an in-process DNS server holding a small zone.
+type dnsStub struct {
+	sync.Mutex
+	records map[string][]dns.RR
+	queries map[string]int
+}
+
+func (s *dnsStub) set(name string, rrs ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.records[name] = nil
+	for _, text := range rrs {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			panic(err)
+		}
+		s.records[name] = append(s.records[name], rr)
+	}
+}
+
+func (s *dnsStub) count(name string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries[name]
+}
+
+func (s *dnsStub) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	q := req.Question[0]
+	s.queries[q.Name]++
+	m := new(dns.Msg)
+	m.SetReply(req)
+	found := false
+	for name, rrs := range s.records {
+		for _, rr := range rrs {
+			if name != q.Name {
+				continue
+			}
+			found = true
+			if rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+func startDNSStub(t *testing.T) (*dnsStub, string) {
+	t.Helper()
+	stub := &dnsStub{records: make(map[string][]dns.RR), queries: make(map[string]int)}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: stub, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return stub, pc.LocalAddr().String()
+}
+
+func TestDNSRegistry(t *testing.T) {
+	savedMin, savedNeg, savedSize := DNSMinTTL, DNSNegativeTTL, DNSMissingCacheSize
+	DNSMinTTL, DNSNegativeTTL, DNSMissingCacheSize = 10*time.Millisecond, 50*time.Millisecond, 2
+	defer func() { DNSMinTTL, DNSNegativeTTL, DNSMissingCacheSize = savedMin, savedNeg, savedSize }()
+
+	stub, addr := startDNSStub(t)
+	stub.set("cache.example.com.",
+		"cache.example.com. 0 IN SRV 10 0 6379 m1.example.com.",
+		"cache.example.com. 0 IN SRV 20 0 6380 r1.example.com.")
+	stub.set("m1.example.com.", "m1.example.com. 0 IN A 10.0.0.1")
+	stub.set("m2.example.com.", "m2.example.com. 0 IN A 10.0.0.2")
+	stub.set("r1.example.com.", "r1.example.com. 0 IN A 10.0.1.1")
+	stub.set("plain.example.com.", "plain.example.com. 300 IN A 10.0.0.9")
+
+	var (
+		mu       sync.Mutex
+		switches []string
+	)
+	defer AddEventListener(func(pod RedisPod, etype, msg string) {
+		if etype == "+switch-master" {
+			mu.Lock()
+			switches = append(switches, msg)
+			mu.Unlock()
+		}
+	})()
+
+	store := NewPodStore()
+	r, err := NewDNSRegistry(DNSConfig{Domain: "example.com", Server: addr, Interval: time.Hour}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	pod, ok, err := r.Lookup("cache")
+	if err != nil || !ok || pod.IP != "10.0.0.1" || pod.Port != "6379" || len(pod.Replicas) != 1 || pod.Replicas[0] != "10.0.1.1:6380" {
+		t.Fatalf("Lookup(cache) = %+v, %v, %v", pod, ok, err)
+	}
+	pod, ok, _ = r.Lookup("plain")
+	if !ok || pod.IP != "10.0.0.9" || pod.Port != "6379" {
+		t.Errorf("Lookup(plain) = %+v, %v", pod, ok)
+	}
+
+	// Unknown names are cached for a while, but only so many of them.
+	queried := 0
+	for _, name := range []string{"nope-1", "nope-1", "nope-2", "nope-3", "nope-4"} {
+		if _, ok, err := r.Lookup(name); ok || err != nil {
+			t.Errorf("Lookup(%s) = %v, %v", name, ok, err)
+		}
+		if queried == 0 {
+			queried = stub.count("nope-1.example.com.")
+		}
+	}
+	if n := stub.count("nope-1.example.com."); n != queried {
+		t.Errorf("nope-1 was queried again, want the answer cached")
+	}
+	r.Lock()
+	missing, cached := len(r.missing), len(r.cache)
+	r.Unlock()
+	if missing > DNSMissingCacheSize || cached != 2 {
+		t.Errorf("%d unknown names and %d pods cached, want at most %d and 2", missing, cached, DNSMissingCacheSize)
+	}
+
+	// Expired unknown names are forgotten, not queried again, while expired
+	// pods are re-resolved.
+	stub.set("cache.example.com.", "cache.example.com. 0 IN SRV 10 0 6379 m2.example.com.")
+	time.Sleep(2 * DNSNegativeTTL)
+	before := stub.count("nope-4.example.com.")
+	r.refresh()
+	if n := stub.count("nope-4.example.com."); n != before {
+		t.Errorf("expired unknown name was queried again")
+	}
+	r.Lock()
+	missing = len(r.missing)
+	r.Unlock()
+	if missing != 0 {
+		t.Errorf("%d expired unknown names still cached", missing)
+	}
+	if pod, _ := store.Get("cache"); pod.IP != "10.0.0.2" {
+		t.Errorf("cache master %s after refresh, want 10.0.0.2", pod.IP)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(switches) != 1 || switches[0] != "cache 10.0.0.1 6379 10.0.0.2 6379" {
+		t.Errorf("got +switch-master %q", switches)
+	}
+}
+
+func TestDNSRegistryEviction(t *testing.T) {
+	savedMin, savedSize := DNSMinTTL, DNSCacheSize
+	DNSMinTTL, DNSCacheSize = 10*time.Millisecond, 2
+	defer func() { DNSMinTTL, DNSCacheSize = savedMin, savedSize }()
+
+	stub, addr := startDNSStub(t)
+	stub.set("a.example.com.", "a.example.com. 0 IN A 10.0.0.1")
+	stub.set("b.example.com.", "b.example.com. 0 IN A 10.0.0.2")
+	stub.set("c.example.com.", "c.example.com. 0 IN A 10.0.0.3")
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	defer AddEventListener(func(pod RedisPod, etype, msg string) {
+		mu.Lock()
+		events = append(events, etype+" "+pod.Name)
+		mu.Unlock()
+	})()
+	takeEvents := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := events
+		events = nil
+		return got
+	}
+
+	store := NewPodStore()
+	r, err := NewDNSRegistry(DNSConfig{Domain: "example.com", Server: addr, Interval: time.Hour}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if _, ok, err := r.Lookup(name); !ok || err != nil {
+			t.Fatalf("Lookup(%s) = %v, %v", name, ok, err)
+		}
+	}
+	// c pushed a out of the full cache without announcing it gone.
+	if got := takeEvents(); len(got) != 3 || got[0] != "+monitor a" || got[1] != "+monitor b" || got[2] != "+monitor c" {
+		t.Errorf("events %q, want a +monitor for each pod", got)
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Errorf("evicted pod a is still in the store")
+	}
+	if v := store.History().Version(); v != 3 {
+		t.Errorf("%d versions recorded, want 3", v)
+	}
+
+	// Resolving the same answers again announces nothing, whether a was
+	// evicted or b and c are refreshed.
+	time.Sleep(2 * DNSMinTTL)
+	if _, ok, _ := r.Lookup("a"); !ok {
+		t.Fatalf("a not found after eviction")
+	}
+	r.refresh()
+	if got := takeEvents(); len(got) != 0 {
+		t.Errorf("unchanged answers announced %q", got)
+	}
+
+	// An evicted pod whose master moved meanwhile is a switch.
+	stub.set("b.example.com.", "b.example.com. 0 IN A 10.0.0.4")
+	time.Sleep(2 * DNSMinTTL)
+	for _, name := range []string{"a", "c", "b"} {
+		r.Lookup(name)
+	}
+	if got := takeEvents(); len(got) != 1 || got[0] != "+switch-master b" {
+		t.Errorf("events %q, want just +switch-master b", got)
+	}
+}
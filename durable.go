@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	PersistFailed = errors.New("ERR unable to persist change")
+	CorruptRecord = errors.New("record checksum mismatch")
+
+	DefaultSnapshotInterval = 5 * time.Minute
+	// MaxRecordSize bounds a single log record so a corrupt length can't
+	// make recovery allocate the whole disk.
+	MaxRecordSize = 16 << 20
+)
+
+// Fsync policies, matching Redis' appendfsync.
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+const (
+	walFile      = "palisade.wal"
+	snapshotFile = "palisade.snapshot"
+)
+
+// DurableConfig describes where and how state is persisted.
+type DurableConfig struct {
+	Dir string
+	// Fsync is one of FsyncAlways, FsyncEverySec or FsyncNo.
+	Fsync string
+	// SnapshotInterval is how often the log is compacted into a snapshot.
+	SnapshotInterval time.Duration
+}
+
+type walRecord struct {
+	Seq      uint64
+	Mutation Mutation
+}
+
+type snapshotRecord struct {
+	Seq   uint64
+	State json.RawMessage
+}
+
+// DurableRegistry keeps the local PodStore on disk. Every mutation is
+// appended to a write-ahead log before it is applied, and the log is
+// periodically compacted into a snapshot. Records are framed with their
+// length and a CRC32, so a tail torn by a crash is detected and cut off on
+// startup. A failed write leaves the log in doubt, so the store, which
+// holds every change applied so far, is written out as a snapshot and a new
+// log started before anything else is appended.
+type DurableRegistry struct {
+	Config DurableConfig
+	store  *PodStore
+
+	sync.Mutex
+	wal     *os.File
+	w       *bufio.Writer
+	seq     uint64
+	snapSeq uint64
+	dirty   bool
+	// failed is set while the log can't be trusted after a write error.
+	failed bool
+	done   chan struct{}
+}
+
+func NewDurableRegistry(cfg DurableConfig, store *PodStore) (*DurableRegistry, error) {
+	switch cfg.Fsync {
+	case "":
+		cfg.Fsync = FsyncEverySec
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy '%s'", cfg.Fsync)
+	}
+	if cfg.SnapshotInterval == 0 {
+		cfg.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	r := &DurableRegistry{Config: cfg, store: store, done: make(chan struct{})}
+	if err := r.recover(); err != nil {
+		return nil, err
+	}
+	go r.loop()
+	return r, nil
+}
+
+// Apply checks that a mutation applies, appends it to the log, syncing as
+// the fsync policy says, and only then applies it, so nothing is served that
+// a crash could lose under the "always" policy.
+func (r *DurableRegistry) Apply(m Mutation) error {
+	r.Lock()
+	defer r.Unlock()
+	if err := r.store.Check(m); err != nil {
+		return err
+	}
+	if r.failed {
+		if err := r.rewrite(); err != nil {
+			log.Printf("wal: unable to start a new log: %v", err)
+			return PersistFailed
+		}
+	}
+	if err := r.append(walRecord{Seq: r.seq + 1, Mutation: m}); err != nil {
+		log.Printf("wal: unable to append: %v", err)
+		if err := r.rewrite(); err != nil {
+			log.Printf("wal: unable to start a new log: %v", err)
+		}
+		return PersistFailed
+	}
+	r.seq++
+	return r.store.Apply(m)
+}
+
+func (r *DurableRegistry) ReadBarrier() error {
+	return nil
+}
+
+func (r *DurableRegistry) append(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(r.w, data); err != nil {
+		return err
+	}
+	if r.Config.Fsync == FsyncNo {
+		return r.w.Flush()
+	}
+	if r.Config.Fsync == FsyncAlways {
+		if err := r.w.Flush(); err != nil {
+			return err
+		}
+		return r.wal.Sync()
+	}
+	r.dirty = true
+	return nil
+}
+
+func (r *DurableRegistry) loop() {
+	flush := time.NewTicker(time.Second)
+	snap := time.NewTicker(r.Config.SnapshotInterval)
+	defer flush.Stop()
+	defer snap.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-flush.C:
+			if err := r.Sync(); err != nil {
+				log.Printf("wal: unable to start a new log: %v", err)
+			}
+		case <-snap.C:
+			if err := r.Snapshot(); err != nil {
+				log.Printf("wal: snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// Sync flushes buffered records and fsyncs the log if anything was written
+// since the last call. When that fails the records in doubt are kept by
+// starting over with a snapshot, and only if that fails too is an error
+// returned.
+func (r *DurableRegistry) Sync() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.failed {
+		return r.rewrite()
+	}
+	err := r.w.Flush()
+	if err == nil && r.dirty {
+		r.dirty = false
+		err = r.wal.Sync()
+	}
+	if err != nil {
+		log.Printf("wal: sync failed: %v", err)
+		return r.rewrite()
+	}
+	return nil
+}
+
+// Snapshot writes the full store to the snapshot file and starts an empty
+// log. Mutations wait while it runs so nothing falls between the two.
+func (r *DurableRegistry) Snapshot() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.seq == r.snapSeq && !r.failed {
+		return nil
+	}
+	return r.rewrite()
+}
+
+// rewrite replaces the snapshot with the store and starts an empty log,
+// dropping whatever a failed writer still held. The store has every change
+// the log acknowledged, so nothing is lost. Until it succeeds the log is
+// marked failed. The lock must be held.
+func (r *DurableRegistry) rewrite() error {
+	r.failed = true
+	state, err := r.store.Marshal()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshotRecord{Seq: r.seq, State: state})
+	if err != nil {
+		return err
+	}
+	if err := r.replaceFile(snapshotFile, data); err != nil {
+		return err
+	}
+	// A crash from here on leaves records the snapshot already covers in
+	// the old log; recovery skips them by sequence number.
+	if err := r.replaceFile(walFile, nil); err != nil {
+		return err
+	}
+	if err := r.openLog(); err != nil {
+		return err
+	}
+	r.snapSeq = r.seq
+	r.dirty = false
+	r.failed = false
+	return nil
+}
+
+// Close flushes the log and stops background syncing and snapshots.
+func (r *DurableRegistry) Close() error {
+	close(r.done)
+	if err := r.Sync(); err != nil {
+		return err
+	}
+	return r.wal.Close()
+}
+
+func (r *DurableRegistry) path(name string) string {
+	return filepath.Join(r.Config.Dir, name)
+}
+
+// replaceFile atomically replaces name with a file holding data as a single
+// record, or an empty file when data is nil.
+func (r *DurableRegistry) replaceFile(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(r.Config.Dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if data != nil {
+		w := bufio.NewWriter(tmp)
+		if err := writeRecord(w, data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path(name)); err != nil {
+		return err
+	}
+	return syncDir(r.Config.Dir)
+}
+
+func (r *DurableRegistry) openLog() error {
+	if r.wal != nil {
+		r.wal.Close()
+	}
+	f, err := os.OpenFile(r.path(walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	r.wal = f
+	r.w = bufio.NewWriter(f)
+	return nil
+}
+
+// recover loads the snapshot and replays the log over it. A log that ends
+// in a torn or corrupt record is truncated after the last good one; a
+// corrupt record followed by good ones fails recovery.
+func (r *DurableRegistry) recover() error {
+	if f, err := os.Open(r.path(snapshotFile)); err == nil {
+		data, err := readRecord(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot is unreadable: %v", err)
+		}
+		var snap snapshotRecord
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("snapshot is unreadable: %v", err)
+		}
+		if err := r.store.Restore(snap.State); err != nil {
+			return fmt.Errorf("snapshot is unreadable: %v", err)
+		}
+		r.seq = snap.Seq
+		r.snapSeq = snap.Seq
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	replayed := 0
+	wal, err := ioutil.ReadFile(r.path(walFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for good := 0; good < len(wal); {
+		rec, n, err := decodeWalRecord(wal[good:])
+		if err != nil {
+			// A crash only tears the end of the log. Damage with good
+			// records after it is something else, and cutting it off
+			// would throw those records away.
+			if at := nextWalRecord(wal[good+1:]); at >= 0 {
+				return fmt.Errorf("wal: corrupt record at offset %d (%v) is followed by a good one at offset %d", good, err, good+1+at)
+			}
+			log.Printf("wal: torn record at offset %d (%v), truncating", good, err)
+			if err := os.Truncate(r.path(walFile), int64(good)); err != nil {
+				return err
+			}
+			break
+		}
+		good += n
+		if rec.Seq <= r.seq {
+			continue
+		}
+		if err := r.store.Replay(rec.Mutation); err != nil {
+			log.Printf("wal: record %d no longer applies: %v", rec.Seq, err)
+		}
+		r.seq = rec.Seq
+		replayed++
+	}
+	log.Printf("wal: recovered state at sequence %d, %d records replayed", r.seq, replayed)
+	return r.openLog()
+}
+
+const recordHeaderSize = 8
+
+// writeRecord frames data with its length and CRC32.
+func writeRecord(w io.Writer, data []byte) error {
+	var hdr [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(data))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRecord reads one framed record. io.EOF means the input ended cleanly
+// between records; anything partial or mismatched is an error.
+func readRecord(r io.Reader) ([]byte, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("torn record header")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if int64(size) > int64(MaxRecordSize) {
+		return nil, fmt.Errorf("record of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.New("torn record")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, CorruptRecord
+	}
+	return data, nil
+}
+
+// decodeWalRecord decodes the log record at the start of buf, returning it
+// and its size.
+func decodeWalRecord(buf []byte) (walRecord, int, error) {
+	var rec walRecord
+	data, err := readRecord(bytes.NewReader(buf))
+	if err == io.EOF {
+		err = errors.New("torn record header")
+	}
+	if err != nil {
+		return rec, 0, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, recordHeaderSize + len(data), nil
+}
+
+// nextWalRecord returns the offset of the first good log record in buf, or
+// -1 when there is none.
+func nextWalRecord(buf []byte) int {
+	for i := 0; i+recordHeaderSize <= len(buf); i++ {
+		size := binary.BigEndian.Uint32(buf[i : i+4])
+		if int64(size) > int64(len(buf)-i-recordHeaderSize) {
+			continue
+		}
+		if _, _, err := decodeWalRecord(buf[i:]); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
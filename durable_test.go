@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// durableChildEnv makes the test binary act as a palisade writing pods to a
+// durable registry until it is killed.
+const durableChildEnv = "PALISADE_DURABLE_CHILD_DIR"
+
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(durableChildEnv); dir != "" {
+		durableChild(dir)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// durableChild monitors pod-1, pod-2, ... printing each number once its
+// MONITOR has been acknowledged.
+func durableChild(dir string) {
+	r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: 50 * time.Millisecond}, NewPodStore())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for i := 1; ; i++ {
+		pod := RedisPod{Name: "pod-" + strconv.Itoa(i), IP: "10.0.0.1", Port: "6379", Quorum: "2"}
+		if err := r.Apply(Mutation{Op: OpMonitor, Pod: pod}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(i)
+	}
+}
+
+func TestDurableKillMidWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for round := 0; round < 3; round++ {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), durableChildEnv+"="+dir)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		acked := 0
+		lines := bufio.NewScanner(out)
+		for lines.Scan() {
+			if acked, err = strconv.Atoi(lines.Text()); err != nil {
+				t.Fatal(err)
+			}
+			if acked >= 200*(round+1) {
+				break
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		if acked == 0 {
+			t.Fatalf("round %d: writer acknowledged nothing", round)
+		}
+
+		store := NewPodStore()
+		r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways}, store)
+		if err != nil {
+			t.Fatalf("round %d: recovery failed: %v", round, err)
+		}
+		for i := 1; i <= acked; i++ {
+			if _, ok := store.Get("pod-" + strconv.Itoa(i)); !ok {
+				t.Fatalf("round %d: acknowledged pod-%d was lost", round, i)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDurableTornAndCorruptTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// damage changes the log holding three records, each len bytes.
+		damage func(wal []byte, len int) []byte
+	}{
+		{"torn header", func(wal []byte, n int) []byte { return append(wal, 0, 0, 0) }},
+		{"torn record", func(wal []byte, n int) []byte { return wal[:len(wal)-n/2] }},
+		{"bad checksum", func(wal []byte, n int) []byte {
+			wal[len(wal)-1] ^= 0xff
+			return wal
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "palisade-durable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, NewPodStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"pod-a", "pod-b", "pod-c"} {
+				if err := r.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: name, IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r.Close()
+
+			path := filepath.Join(dir, walFile)
+			wal, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tc.damage(wal, len(wal)/3)
+			if err := ioutil.WriteFile(path, damaged, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			store := NewPodStore()
+			r, err = NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, a := store.Get("pod-a")
+			_, b := store.Get("pod-b")
+			_, c := store.Get("pod-c")
+			if !a || !b {
+				t.Errorf("records before the damage were lost")
+			}
+			if c != (tc.name == "torn header") {
+				t.Errorf("pod-c recovered = %v", c)
+			}
+			// New records follow the last good one.
+			if err := r.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: "pod-d", IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+			store = NewPodStore()
+			if r, err = NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, store); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := store.Get("pod-d"); !ok {
+				t.Error("record written after recovery was lost")
+			}
+			r.Close()
+		})
+	}
+}
+
+func TestDurableRejectsBeforeLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways}, NewPodStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Apply(Mutation{Op: OpSet, Name: "missing", Setting: "quorum", Value: "2"}); err != NoSuchPod {
+		t.Errorf("SET on a missing pod returned %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFile)); err != nil || info.Size() != 0 {
+		t.Errorf("a rejected mutation reached the log")
+	}
+}
+
+func TestDurableCorruptBeforeGoodRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, NewPodStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pod-a", "pod-b", "pod-c"} {
+		if err := r.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: name, IP: "10.0.0.1", Port: "6379", Quorum: "2"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	path := filepath.Join(dir, walFile)
+	wal, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal[len(wal)/3+recordHeaderSize+1] ^= 0xff
+	if err := ioutil.WriteFile(path, wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, NewPodStore()); err == nil {
+		r.Close()
+		t.Fatal("recovery accepted a damaged record followed by good ones")
+	}
+	if after, err := ioutil.ReadFile(path); err != nil || len(after) != len(wal) {
+		t.Errorf("the log was changed: %d bytes, was %d (%v)", len(after), len(wal), err)
+	}
+}
+
+func TestDurableWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, NewPodStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor := func(name string) error {
+		return r.Apply(Mutation{Op: OpMonitor, Pod: RedisPod{Name: name, IP: "10.0.0.1", Port: "6379", Quorum: "2"}})
+	}
+	if err := monitor("pod-a"); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the log underneath makes the next write fail.
+	r.Lock()
+	r.wal.Close()
+	r.Unlock()
+	if err := monitor("pod-b"); err != PersistFailed {
+		t.Fatalf("write to a closed log returned %v", err)
+	}
+	if err := monitor("pod-c"); err != nil {
+		t.Fatalf("the log wasn't started over: %v", err)
+	}
+	r.Close()
+
+	store := NewPodStore()
+	if r, err = NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways, SnapshotInterval: time.Hour}, store); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, a := store.Get("pod-a")
+	_, b := store.Get("pod-b")
+	_, c := store.Get("pod-c")
+	if !a || b || !c {
+		t.Errorf("recovered pod-a %v, pod-b %v, pod-c %v; want only the acknowledged ones", a, b, c)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+var (
+	eventLock      sync.RWMutex
+	eventListeners = make(map[int]EventListener)
+	nextListenerID int
+)
+
+// AddEventListener registers l to be called for each event palisade emits,
+// after it has been logged and any notification script has been scheduled.
+// The returned function removes it again.
+func AddEventListener(l EventListener) func() {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	id := nextListenerID
+	nextListenerID++
+	eventListeners[id] = l
+	return func() {
+		eventLock.Lock()
+		delete(eventListeners, id)
+		eventLock.Unlock()
+	}
+}
+
+func emitEvent(pod RedisPod, etype, msg string) {
+	log.Printf("%s %s", etype, msg)
+	scripts.Schedule(pod.NotificationScript, etype, msg)
+	eventLock.RLock()
+	defer eventLock.RUnlock()
+	for _, l := range eventListeners {
+		l(pod, etype, msg)
+	}
+}
+
+// sentinelEvent records an event about a pod. As with Sentinel, the
+// description starts with the instance details and any extra information is
+// appended after them. If the pod has a notification script it is run with
+// the event type and description as its arguments.
+func sentinelEvent(pod RedisPod, etype, extra string) {
+	msg := fmt.Sprintf("master %s %s %s", pod.Name, pod.IP, pod.Port)
+	if extra != "" {
+		msg += " " + extra
+	}
+	emitEvent(pod, etype, msg)
+}
+
+// switchMaster announces that a pod's master moved from old to the address
+// in pod, and runs the pod's client reconfig script using the upstream
+// argument order: <master-name> <role> <state> <from-ip> <from-port>
+// <to-ip> <to-port>.
+func switchMaster(old, pod RedisPod) {
+	msg := fmt.Sprintf("%s %s %s %s %s", pod.Name, old.IP, old.Port, pod.IP, pod.Port)
+	emitEvent(pod, "+switch-master", msg)
+	scripts.Schedule(pod.ClientReconfigScript, pod.Name, "leader", "failover", old.IP, old.Port, pod.IP, pod.Port)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/credential"
+)
+
+var (
+	NoSuchUser      = errors.New("ERR User does not exist")
+	NoACLFile       = errors.New("ERR This proxy is not configured to use an ACL file, see --aclfile")
+	DefaultUserKept = errors.New("ERR The 'default' user cannot be removed")
+
+	// DefaultUser is who clients sending AUTH with only a password are.
+	DefaultUser = "default"
+	// aclFile holds the users in Redis ACL file syntax when set.
+	aclFile string
+	acl     = &ACL{users: make(map[string]*User)}
+
+	// commandCategories groups commands for +@category and -@category
+	// rules. Commands with subcommands are written command|subcommand.
+	commandCategories = map[string][]string{
+		"read": {
+			"sentinel|master", "sentinel|masters", "sentinel|get-master-addr-by-name",
+			"sentinel|replicas", "sentinel|slaves", "sentinel|sentinels",
+			"sentinel|ckquorum", "info", "ping", "knownsentinels", "poolstats",
+			"acl|whoami",
+		},
+		"pubsub": {"subscribe", "psubscribe", "unsubscribe", "punsubscribe"},
+		"admin": {
+			"addsentinel", "sentinel|monitor", "sentinel|set", "sentinel|remove",
+			"sentinel|reset", "sentinel|failover", "sentinel|config",
+			"sentinel|flushconfig", "sentinel|debug", "sentinel|simulate-failure",
+			"acl|setuser", "acl|getuser", "acl|deluser", "acl|list", "acl|users",
+			"acl|load", "acl|save", "credential",
+		},
+	}
+	// podSubcommands are the SENTINEL subcommands whose first argument is a
+	// pod name, checked against the user's pod patterns.
+	podSubcommands = map[string]bool{
+		"master": true, "get-master-addr-by-name": true, "replicas": true,
+		"slaves": true, "sentinels": true, "ckquorum": true, "monitor": true,
+		"set": true, "remove": true, "reset": true, "failover": true,
+	}
+)
+
+// User is an ACL user. Users are never changed in place: changes are made
+// to a copy that is then swapped in, so a *User can be read without
+// locking.
+type User struct {
+	Name    string
+	Enabled bool
+	NoPass  bool
+	// Credentials are the secrets the user can log in with.
+	Credentials []credential.Credential
+	// Commands are the +/- command rules in the order given; the last one
+	// matching a command decides.
+	Commands []string
+	// Pods are the glob patterns of the pods the user may use.
+	Pods []string
+	// Namespace is the tenant whose pods the user sees, empty to see every
+	// pod.
+	Namespace string
+}
+
+// NewUser is a user as ACL SETUSER creates it: off, without passwords,
+// commands or pods.
+func NewUser(name string) *User {
+	return &User{Name: name}
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.Credentials = append([]credential.Credential(nil), u.Credentials...)
+	c.Commands = append([]string(nil), u.Commands...)
+	c.Pods = append([]string(nil), u.Pods...)
+	return &c
+}
+
+// Apply changes the user by one rule in Redis ACL syntax, such as on, off,
+// >password, <password, #hash, !hash, nopass, resetpass, ~pattern,
+// allkeys, resetkeys, +command, -command|subcommand, +@category,
+// allcommands, nocommands or reset. namespace:<name> and nonamespace set
+// the user's tenant, and #hash@<unix time> gives a credential an expiry.
+// The channel and payload rules Redis writes (&pattern, allchannels,
+// resetchannels, sanitize-payload and skip-sanitize-payload) are accepted
+// and ignored.
+func (u *User) Apply(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.Enabled = true
+	case lower == "off":
+		u.Enabled = false
+	case lower == "nopass":
+		u.NoPass, u.Credentials = true, nil
+	case lower == "resetpass":
+		u.NoPass, u.Credentials = false, nil
+	case strings.HasPrefix(rule, ">"):
+		cred, err := credential.New(rule[1:], time.Time{})
+		if err != nil {
+			return err
+		}
+		u.addCredential(cred)
+	case strings.HasPrefix(rule, "<"):
+		return u.delCredential(func(c credential.Credential) bool { return c.Matches(rule[1:]) })
+	case strings.HasPrefix(rule, "#"):
+		cred, err := credential.Parse(rule[1:])
+		if err != nil {
+			return err
+		}
+		u.addCredential(cred)
+	case strings.HasPrefix(rule, "!"):
+		return u.delCredential(func(c credential.Credential) bool { return c.Hash == rule[1:] || c.ID() == rule[1:] })
+	case lower == "allkeys":
+		u.Pods = []string{"*"}
+	case lower == "resetkeys":
+		u.Pods = nil
+	case strings.HasPrefix(rule, "~"):
+		if _, err := path.Match(rule[1:], ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid pattern", rule[1:])
+		}
+		u.Pods = append(u.Pods, rule[1:])
+	case lower == "allcommands":
+		u.Commands = []string{"+@all"}
+	case lower == "nocommands":
+		u.Commands = nil
+	case strings.HasPrefix(lower, "+") || strings.HasPrefix(lower, "-"):
+		body := lower[1:]
+		if body == "" {
+			return errors.New("Syntax error")
+		}
+		if strings.HasPrefix(body, "@") && body != "@all" {
+			if _, known := commandCategories[body[1:]]; !known {
+				return errors.New("Unknown command or category name in ACL")
+			}
+		}
+		if body == "@all" {
+			// Everything before is overridden.
+			u.Commands = nil
+			if lower[0] == '-' {
+				return nil
+			}
+		}
+		u.Commands = append(u.Commands, lower)
+	case strings.HasPrefix(lower, "namespace:"):
+		// A namespace holding the separator would see the pods of the
+		// namespace it is a prefix of.
+		namespace := rule[len("namespace:"):]
+		if strings.Contains(namespace, NamespaceSeparator) {
+			return fmt.Errorf("namespace '%s' contains the namespace separator '%s'", namespace, NamespaceSeparator)
+		}
+		u.Namespace = namespace
+	case lower == "nonamespace":
+		u.Namespace = ""
+	case lower == "reset":
+		*u = User{Name: u.Name}
+	case strings.HasPrefix(rule, "&"), lower == "allchannels", lower == "resetchannels",
+		lower == "sanitize-payload", lower == "skip-sanitize-payload":
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+// CanRun reports whether the user may run cmd, sub being its subcommand
+// for commands that have them. Commands are lower case.
+func (u *User) CanRun(cmd, sub string) bool {
+	full := cmd
+	if sub != "" {
+		full = cmd + "|" + sub
+	}
+	allowed := false
+	for _, rule := range u.Commands {
+		body := rule[1:]
+		match := body == "@all" || body == cmd || body == full
+		if strings.HasPrefix(body, "@") {
+			for _, name := range commandCategories[body[1:]] {
+				if name == cmd || name == full {
+					match = true
+				}
+			}
+		}
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// CanAccess reports whether one of the user's pod patterns matches pod.
+func (u *User) CanAccess(pod string) bool {
+	for _, pattern := range u.Pods {
+		if matched, _ := path.Match(pattern, pod); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules describes the user in ACL file syntax, without the leading
+// "user <name>".
+func (u *User) Rules() string {
+	rules := []string{"off"}
+	if u.Enabled {
+		rules[0] = "on"
+	}
+	if u.NoPass {
+		rules = append(rules, "nopass")
+	}
+	for _, c := range u.Credentials {
+		rules = append(rules, "#"+c.String())
+	}
+	if len(u.Pods) == 0 {
+		rules = append(rules, "resetkeys")
+	}
+	for _, pattern := range u.Pods {
+		rules = append(rules, "~"+pattern)
+	}
+	if u.Namespace != "" {
+		rules = append(rules, "namespace:"+u.Namespace)
+	}
+	if len(u.Commands) == 0 {
+		rules = append(rules, "-@all")
+	}
+	rules = append(rules, u.Commands...)
+	return strings.Join(rules, " ")
+}
+
+// ACL holds the users.
+type ACL struct {
+	sync.RWMutex
+	users map[string]*User
+}
+
+// Get returns the named user, or nil.
+func (a *ACL) Get(name string) *User {
+	a.RLock()
+	defer a.RUnlock()
+	return a.users[name]
+}
+
+// SetUser creates or changes a user. Either every rule applies or none
+// does.
+func (a *ACL) SetUser(name string, rules []string) error {
+	return a.update(name, true, func(user *User) error {
+		for _, rule := range rules {
+			if err := user.Apply(rule); err != nil {
+				return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Update changes an existing user with fn. Either all of fn's changes
+// apply or none do.
+func (a *ACL) Update(name string, fn func(*User) error) error {
+	return a.update(name, false, fn)
+}
+
+// update runs fn on a copy of the user without holding the lock, since
+// hashing secrets is slow, and swaps the copy in unless the user changed
+// meanwhile, in which case it starts over.
+func (a *ACL) update(name string, create bool, fn func(*User) error) error {
+	for {
+		old := a.Get(name)
+		var user *User
+		switch {
+		case old != nil:
+			user = old.clone()
+		case create:
+			user = NewUser(name)
+		default:
+			return NoSuchUser
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+		a.Lock()
+		if a.users[name] == old {
+			a.users[name] = user
+			a.Unlock()
+			return nil
+		}
+		a.Unlock()
+	}
+}
+
+// DelUser removes users, returning how many existed.
+func (a *ACL) DelUser(names []string) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+	deleted := 0
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, DefaultUserKept
+		}
+	}
+	for _, name := range names {
+		if _, exists := a.users[name]; exists {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// List returns the users sorted by name.
+func (a *ACL) List() []*User {
+	a.RLock()
+	defer a.RUnlock()
+	users := make([]*User, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Replace swaps in a new set of users.
+func (a *ACL) Replace(users map[string]*User) {
+	a.Lock()
+	a.users = users
+	a.Unlock()
+}
+
+// parseACL reads users written in Redis ACL file syntax, one
+// "user <name> [rule ...]" per line. Blank lines and lines starting with #
+// are skipped.
+func parseACL(data string) (map[string]*User, error) {
+	users := make(map[string]*User)
+	for n, line := range strings.Split(data, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		if words[0] != "user" || len(words) < 2 {
+			return nil, fmt.Errorf("line %d should start with 'user <name>'", n+1)
+		}
+		if _, exists := users[words[1]]; exists {
+			return nil, fmt.Errorf("line %d: duplicate user '%s'", n+1, words[1])
+		}
+		user := NewUser(words[1])
+		for _, rule := range words[2:] {
+			if err := user.Apply(rule); err != nil {
+				return nil, fmt.Errorf("line %d: '%s': %v", n+1, rule, err)
+			}
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
+
+// loadACLFile replaces the users with those in aclFile. The default user
+// and the users of --tenant are kept when the file doesn't define them.
+func loadACLFile() error {
+	if aclFile == "" {
+		return NoACLFile
+	}
+	data, err := ioutil.ReadFile(aclFile)
+	if err != nil {
+		return err
+	}
+	users, err := parseACL(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", aclFile, err)
+	}
+	kept := []string{DefaultUser}
+	for _, tenant := range tenants {
+		kept = append(kept, tenant)
+	}
+	for _, name := range kept {
+		if _, exists := users[name]; !exists {
+			if user := acl.Get(name); user != nil {
+				users[name] = user
+			}
+		}
+	}
+	acl.Replace(users)
+	return nil
+}
+
+// saveACLFile writes the users to aclFile.
+func saveACLFile() error {
+	if aclFile == "" {
+		return NoACLFile
+	}
+	var lines []string
+	for _, u := range acl.List() {
+		lines = append(lines, fmt.Sprintf("user %s %s", u.Name, u.Rules()))
+	}
+	tmp := aclFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, aclFile)
+}
+
+// checkPermission decides whether the session's user may run a command,
+// returning a NOPERM error when it may not.
+func checkPermission(s *Session, c *Command) error {
+	cmd := strings.ToLower(string(c.Get(0)))
+	sub := ""
+	if cmd == "sentinel" || cmd == "acl" {
+		sub = strings.ToLower(string(c.Get(1)))
+	}
+	if !s.User.CanRun(cmd, sub) {
+		name := cmd
+		if sub != "" {
+			name += "|" + sub
+		}
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", s.User.Name, name)
+	}
+	if cmd == "sentinel" && podSubcommands[sub] && c.ArgCount() > 2 && !s.User.CanAccess(string(c.Get(2))) {
+		return fmt.Errorf("NOPERM No permissions to access the '%s' pod", string(c.Get(2)))
+	}
+	return nil
+}
+
+// aclCommand manages the users:
+//
+//	ACL SETUSER <name> [rule ...]
+//	ACL GETUSER <name>
+//	ACL DELUSER <name> [name ...]
+//	ACL LIST
+//	ACL USERS
+//	ACL WHOAMI
+//	ACL LOAD
+//	ACL SAVE
+func aclCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var args []string
+	for i := 2; i < c.ArgCount(); i++ {
+		args = append(args, string(c.Get(i)))
+	}
+	var err error
+	switch subcomm {
+	case "SETUSER":
+		if len(args) < 1 {
+			return SendError(w, "ERR wrong number of arguments for 'acl setuser' command")
+		}
+		err = acl.SetUser(args[0], args[1:])
+	case "GETUSER":
+		if len(args) != 1 {
+			return SendError(w, "ERR wrong number of arguments for 'acl getuser' command")
+		}
+		user := acl.Get(args[0])
+		if user == nil {
+			return SendBulkStrings(w, nil)
+		}
+		flags := []string{"off"}
+		if user.Enabled {
+			flags[0] = "on"
+		}
+		if user.NoPass {
+			flags = append(flags, "nopass")
+		}
+		commands := "-@all"
+		if len(user.Commands) > 0 {
+			commands = strings.Join(user.Commands, " ")
+		}
+		var pods, creds []string
+		for _, pattern := range user.Pods {
+			pods = append(pods, "~"+pattern)
+		}
+		for _, cred := range user.Credentials {
+			creds = append(creds, cred.String())
+		}
+		return SendBulkStrings(w, []string{
+			"flags", strings.Join(flags, " "),
+			"passwords", strings.Join(creds, " "),
+			"commands", commands,
+			"pods", strings.Join(pods, " "),
+			"namespace", user.Namespace,
+		})
+	case "DELUSER":
+		if len(args) < 1 {
+			return SendError(w, "ERR wrong number of arguments for 'acl deluser' command")
+		}
+		deleted, derr := acl.DelUser(args)
+		if derr != nil {
+			return SendError(w, derr.Error())
+		}
+		return SendInt(w, int64(deleted))
+	case "LIST":
+		var lines []string
+		for _, u := range acl.List() {
+			lines = append(lines, fmt.Sprintf("user %s %s", u.Name, u.Rules()))
+		}
+		return SendBulkStrings(w, lines)
+	case "USERS":
+		var names []string
+		for _, u := range acl.List() {
+			names = append(names, u.Name)
+		}
+		return SendBulkStrings(w, names)
+	case "WHOAMI":
+		return SendBulkString(w, c.Session.User.Name)
+	case "LOAD":
+		err = loadACLFile()
+	case "SAVE":
+		err = saveACLFile()
+	default:
+		return SendError(w, fmt.Sprintf("Command 'ACL %s' not supported", subcomm))
+	}
+	if err != nil {
+		if !strings.HasPrefix(err.Error(), "ERR ") {
+			err = errors.New("ERR " + err.Error())
+		}
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/resp"
+)
+
+func TestParseACLIgnoresChannelRules(t *testing.T) {
+	users, err := parseACL("user alice on nopass sanitize-payload ~cache* resetchannels &* allchannels +@read\n" +
+		"user bob off skip-sanitize-payload &events:* -@all\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := users["alice"]
+	if alice == nil || !alice.Enabled || !alice.CanRun("info", "") || !alice.CanAccess("cache1") {
+		t.Errorf("alice was read as %+v", alice)
+	}
+	if users["bob"] == nil {
+		t.Error("bob was not read")
+	}
+}
+
+func TestLoadKeepsTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { aclFile = file }(aclFile)
+	aclFile = filepath.Join(dir, "users.acl")
+	if err := ioutil.WriteFile(aclFile, []byte("user reader on nopass +@read\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old map[string]string) { tenants = old }(tenants)
+	tenants = make(map[string]string)
+	if err := parseTenants([]string{"payments=paytoken"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.DelUser([]string{"payments", "reader"})
+
+	if err := loadACLFile(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Get("reader") == nil {
+		t.Error("the file's user was not loaded")
+	}
+	if user, ok := authenticate(tenants[tenantIndex("paytoken")], "paytoken"); !ok || user.Namespace != "payments" {
+		t.Error("the tenant can't log in after ACL LOAD")
+	}
+}
+
+func TestNoPassthroughInNamespace(t *testing.T) {
+	defer func(on bool) { sentinelproxy.Passthrough = on }(sentinelproxy.Passthrough)
+	sentinelproxy.Passthrough = true
+	if err := acl.SetUser("scoped", []string{"reset", "on", "nopass", "allkeys", "allcommands", "namespace:team"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.DelUser([]string{"scoped"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server)
+	r, w := bufio.NewReader(client), bufio.NewWriter(client)
+	if err := resp.WriteCommand(w, []string{"AUTH", "scoped", "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := resp.ReadReply(r); err != nil || reply != "OK" {
+		t.Fatalf("AUTH replied %v, %v", reply, err)
+	}
+	if err := resp.WriteCommand(w, []string{"ROLE"}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := resp.ReadReply(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := reply.(resp.Error); !ok || !strings.HasPrefix(string(e), "NOPERM") {
+		t.Errorf("ROLE was passed through for a user with a namespace: %v", reply)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/therealbill/palisade/credential"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	NoSuchCredential = errors.New("ERR no such credential")
+
+	// GeneratedSecretBytes is how much randomness CREDENTIAL GENERATE puts
+	// in a secret.
+	GeneratedSecretBytes = 24
+
+	// unknownUserHash is checked against when AUTH names a user that doesn't
+	// exist, so that takes as long as a wrong password for a user with one
+	// bcrypt credential.
+	unknownUserHash []byte
+	// tenantKey keys the index of tenant tokens, which are never kept.
+	tenantKey = make([]byte, 32)
+)
+
+func init() {
+	if _, err := rand.Read(tenantKey); err != nil {
+		panic(err)
+	}
+	unknownUserHash, _ = bcrypt.GenerateFromPassword(tenantKey, credential.BcryptCost)
+}
+
+// CheckPassword reports whether pass is one of the user's unexpired
+// credentials. Every credential is checked, so the time taken doesn't tell
+// which one matched or whether an expired one did.
+func (u *User) CheckPassword(pass string) bool {
+	if u.NoPass {
+		return true
+	}
+	return credential.Check(u.Credentials, pass)
+}
+
+// authenticate returns the named user when pass is one of its credentials
+// and it is enabled. Unknown users take as long to refuse as users with one
+// bcrypt credential; nopass users and users with only legacy SHA-256
+// hashes are answered faster, so the time taken can tell those apart.
+func authenticate(name, pass string) (*User, bool) {
+	user := acl.Get(name)
+	if user == nil {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(pass))
+		return nil, false
+	}
+	ok := user.CheckPassword(pass)
+	return user, ok && user.Enabled
+}
+
+func (u *User) addCredential(cred credential.Credential) {
+	for i, c := range u.Credentials {
+		if c.Hash == cred.Hash {
+			u.Credentials[i] = cred
+			return
+		}
+	}
+	u.Credentials = append(u.Credentials, cred)
+	u.NoPass = false
+}
+
+// delCredential removes the credentials matching a secret, a hash or an
+// ID, whichever match is given.
+func (u *User) delCredential(match func(credential.Credential) bool) error {
+	kept := u.Credentials[:0]
+	for _, c := range u.Credentials {
+		if !match(c) {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(u.Credentials) {
+		return NoSuchCredential
+	}
+	u.Credentials = kept
+	return nil
+}
+
+// tenantIndex is the key tenants are found by from their token alone. It
+// is keyed with a random per-process secret, so the index can't be used to
+// guess tokens.
+func tenantIndex(token string) string {
+	mac := hmac.New(sha256.New, tenantKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// credentialCommand manages users' credentials:
+//
+//	CREDENTIAL ADD <user> <secret> [TTL <seconds>]
+//	CREDENTIAL GENERATE <user> [TTL <seconds>]
+//	CREDENTIAL LIST <user>
+//	CREDENTIAL EXPIRE <user> <id> <seconds>
+//	CREDENTIAL PERSIST <user> <id>
+//	CREDENTIAL DEL <user> <id>
+//	CREDENTIAL PURGE
+//
+// To rotate a secret without downtime, add the new one, move clients over
+// and EXPIRE the old one.
+func credentialCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var args []string
+	for i := 2; i < c.ArgCount(); i++ {
+		args = append(args, string(c.Get(i)))
+	}
+	arity := map[string]int{"ADD": 2, "GENERATE": 1, "LIST": 1, "EXPIRE": 3, "PERSIST": 2, "DEL": 2, "PURGE": 0}
+	n, known := arity[subcomm]
+	if !known {
+		return SendError(w, fmt.Sprintf("Command 'CREDENTIAL %s' not supported", subcomm))
+	}
+	if len(args) < n {
+		return SendError(w, fmt.Sprintf("ERR wrong number of arguments for 'credential %s' command", strings.ToLower(subcomm)))
+	}
+	switch subcomm {
+	case "ADD", "GENERATE":
+		secret, rest := "", args[1:]
+		if subcomm == "ADD" {
+			secret, rest = args[1], args[2:]
+		} else {
+			buf := make([]byte, GeneratedSecretBytes)
+			if _, err := rand.Read(buf); err != nil {
+				return SendError(w, "ERR "+err.Error())
+			}
+			secret = hex.EncodeToString(buf)
+		}
+		expires, err := credential.ParseTTL(rest)
+		if err != nil {
+			return SendError(w, err.Error())
+		}
+		cred, err := credential.New(secret, expires)
+		if err != nil {
+			return SendError(w, "ERR "+err.Error())
+		}
+		if err := acl.Update(args[0], func(u *User) error {
+			u.addCredential(cred)
+			return nil
+		}); err != nil {
+			return SendError(w, err.Error())
+		}
+		if subcomm == "GENERATE" {
+			return SendBulkStrings(w, []string{cred.ID(), secret})
+		}
+		return SendBulkString(w, cred.ID())
+	case "LIST":
+		user := acl.Get(args[0])
+		if user == nil {
+			return SendError(w, NoSuchUser.Error())
+		}
+		now := time.Now()
+		var list [][]string
+		for _, cred := range user.Credentials {
+			kind, expires, state := "bcrypt", "", "active"
+			if cred.Legacy() {
+				kind = "sha256"
+			}
+			if !cred.Expires.IsZero() {
+				expires = cred.Expires.UTC().Format(time.RFC3339)
+			}
+			if cred.Expired(now) {
+				state = "expired"
+			}
+			list = append(list, []string{"id", cred.ID(), "kind", kind, "expires", expires, "state", state})
+		}
+		return SendBulkStringArrays(w, list)
+	case "EXPIRE", "PERSIST":
+		var expires time.Time
+		if subcomm == "EXPIRE" {
+			seconds, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil || seconds < 0 {
+				return SendError(w, "ERR expiry must be a number of seconds, 0 for now")
+			}
+			expires = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		err := acl.Update(args[0], func(u *User) error {
+			for i, cred := range u.Credentials {
+				if cred.ID() == args[1] {
+					u.Credentials[i].Expires = expires
+					return nil
+				}
+			}
+			return NoSuchCredential
+		})
+		if err != nil {
+			return SendError(w, err.Error())
+		}
+	case "DEL":
+		err := acl.Update(args[0], func(u *User) error {
+			return u.delCredential(func(cred credential.Credential) bool { return cred.ID() == args[1] })
+		})
+		if err != nil {
+			return SendError(w, err.Error())
+		}
+	case "PURGE":
+		now := time.Now()
+		purged := 0
+		for _, user := range acl.List() {
+			removed := 0
+			acl.Update(user.Name, func(u *User) error {
+				before := len(u.Credentials)
+				u.delCredential(func(cred credential.Credential) bool { return cred.Expired(now) })
+				removed = before - len(u.Credentials)
+				return nil
+			})
+			purged += removed
+		}
+		return SendInt(w, int64(purged))
+	}
+	return SendOk(w)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/resp"
+)
+
+// subscribe relays a managing sentinel's events to the client, renamed and
+// filtered for the client's tenant:
+//
+//	SUBSCRIBE <channel> [channel ...]
+//	PSUBSCRIBE <pattern> [pattern ...]
+//
+// The connection stays subscribed until either side closes it. Meanwhile
+// the client may only send the commands in subscribedCommands, and QUIT.
+func subscribe(c *Command, w *bufio.Writer) error {
+	if c.ArgCount() < 2 {
+		return SendError(w, "ERR wrong number of arguments for '"+strings.ToLower(string(c.Get(0)))+"' command")
+	}
+	args := sentinelproxy.Args(c)
+	for _, sa := range sentinelproxy.Usable() {
+		conn, err := resp.Dial(sa, sentinelproxy.DialTimeout)
+		if err != nil {
+			log.Printf("[%s] error: %s", sa, err.Error())
+			continue
+		}
+		defer conn.Close()
+		conn.WriteTimeout = sentinelproxy.WriteTimeout
+		if err := conn.Send(args...); err != nil {
+			log.Printf("[%s] error: %s", sa, err.Error())
+			continue
+		}
+		conn.SetReadDeadline(time.Time{})
+		log.Printf("%s subscribed to %v through %s", c.Session.Addr, args[1:], sa)
+		var wl sync.Mutex
+		// The client is followed with its own copy of the session, as
+		// relayEvents refreshes the user of this one.
+		client := *c.Session
+		go followClient(&client, conn, w, &wl)
+		return relayEvents(c.Session, conn.R, w, &wl)
+	}
+	return SendError(w, "ERR no managing sentinel could be reached")
+}
+
+// subscribedCommands are what a subscribed client may still send, relayed
+// to the sentinel it is subscribed through.
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "PING": true,
+}
+
+// followClient reads the commands of a subscribed client, relaying those it
+// may send to the sentinel and refusing the rest. Once the client quits or
+// goes away it closes the sentinel connection, which ends relayEvents.
+// Writes to the client are made holding wl.
+func followClient(s *Session, conn *resp.Conn, w *bufio.Writer, wl *sync.Mutex) {
+	defer conn.Close()
+	for {
+		command, err := s.Reader.ReadCommand()
+		if err != nil {
+			return
+		}
+		command.Session = s
+		cmd := strings.ToUpper(string(command.Get(0)))
+		if cmd == "QUIT" {
+			return
+		}
+		if err = s.Refresh(); err != nil {
+			return
+		}
+		if err = checkPermission(s, command); err == nil && !subscribedCommands[cmd] {
+			err = fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(cmd))
+		}
+		if err != nil {
+			wl.Lock()
+			err = SendError(w, err.Error())
+			wl.Unlock()
+		} else {
+			err = conn.Send(sentinelproxy.Args(command)...)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relayEvents copies replies from a subscribed sentinel connection to the
+// client until either goes away. Messages go through the session's Event
+// rewriting, made with the user as it is at the time; everything else,
+// such as subscribe confirmations, is copied unchanged. Writes to the
+// client are made holding wl.
+func relayEvents(s *Session, r *bufio.Reader, w *bufio.Writer, wl *sync.Mutex) error {
+	var raw bytes.Buffer
+	for {
+		raw.Reset()
+		if err := resp.ReadRaw(r, &raw); err != nil {
+			return err
+		}
+		reply, err := resp.ReadReply(bufio.NewReader(bytes.NewReader(raw.Bytes())))
+		if err != nil {
+			return err
+		}
+		msg, _ := resp.Strings(reply)
+		wl.Lock()
+		if err := s.Refresh(); err != nil {
+			SendError(w, err.Error())
+			wl.Unlock()
+			return err
+		}
+		switch {
+		case len(msg) == 3 && msg[0] == "message":
+			if payload, visible := s.Event(msg[1], msg[2]); visible {
+				err = SendBulkStrings(w, []string{msg[0], msg[1], payload})
+			}
+		case len(msg) == 4 && msg[0] == "pmessage":
+			if payload, visible := s.Event(msg[2], msg[3]); visible {
+				err = SendBulkStrings(w, []string{msg[0], msg[1], msg[2], payload})
+			}
+		default:
+			if _, err = w.Write(raw.Bytes()); err == nil {
+				err = w.Flush()
+			}
+		}
+		wl.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
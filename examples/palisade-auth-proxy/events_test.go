@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/resp"
+)
+
+// fakeSentinel answers SUBSCRIBE and PING as a subscribed sentinel does and
+// reports when the proxy closes its connection.
+func fakeSentinel(t *testing.T) (string, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	closed := make(chan struct{}, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+		for {
+			reply, err := resp.ReadReply(r)
+			if err != nil {
+				closed <- struct{}{}
+				return
+			}
+			args, _ := resp.Strings(reply)
+			switch strings.ToLower(args[0]) {
+			case "subscribe":
+				for i, ch := range args[1:] {
+					fmt.Fprintf(w, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, i+1)
+				}
+			case "ping":
+				fmt.Fprint(w, "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+			}
+			w.Flush()
+		}
+	}()
+	return l.Addr().String(), closed
+}
+
+func TestSubscribeEndsWithClient(t *testing.T) {
+	addr, closed := fakeSentinel(t)
+	sentinelproxy.Sentinels.Add(addr)
+	defer sentinelproxy.Sentinels.Remove(addr)
+	if err := acl.SetUser("subscriber", []string{"reset", "on", "nopass", "allkeys", "allcommands"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.DelUser([]string{"subscriber"})
+
+	client, server := net.Pipe()
+	defer server.Close()
+	session := &Session{Addr: "test", User: acl.Get("subscriber"), Reader: NewParser(server)}
+	c := &Command{argv: [][]byte{[]byte("SUBSCRIBE"), []byte("+switch-master")}, Session: session}
+	done := make(chan error, 1)
+	go func() { done <- subscribe(c, bufio.NewWriter(server)) }()
+
+	r := bufio.NewReader(client)
+	if reply, err := resp.ReadReply(r); err != nil {
+		t.Fatal(err)
+	} else if msg, _ := resp.Strings(reply); len(msg) != 3 || msg[0] != "subscribe" {
+		t.Fatalf("subscribing replied %v", msg)
+	}
+	fmt.Fprint(client, "*2\r\n$3\r\nGET\r\n$1\r\nx\r\n")
+	if reply, err := resp.ReadReply(r); err != nil {
+		t.Fatal(err)
+	} else if e, ok := reply.(resp.Error); !ok || !strings.HasPrefix(string(e), "ERR Can't execute 'get'") {
+		t.Errorf("GET while subscribed replied %v", reply)
+	}
+	fmt.Fprint(client, "*1\r\n$4\r\nPING\r\n")
+	if reply, err := resp.ReadReply(r); err != nil {
+		t.Fatal(err)
+	} else if msg, _ := resp.Strings(reply); len(msg) != 2 || msg[0] != "pong" {
+		t.Errorf("PING while subscribed replied %v", msg)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription outlived its client")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sentinel connection was left open")
+	}
+}
@@ -6,7 +6,6 @@ commands being proxied to the managing sentinel server(s).
 # Ways to improve this example
  * Subscribe to the Sentinel event channels to catch sdown events on
    sentinels, using these to update the constellation in real time.
- * Use discovery to populate Constellation information from a single sentinel
  * Config backing store such as Consul
 */
 
@@ -20,6 +19,9 @@ import (
 	"os"
 
 	"github.com/codegangsta/cli"
+	"github.com/therealbill/palisade/credential"
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type CommandHandler func(*Command, *bufio.Writer) error
@@ -33,12 +35,10 @@ type RedisPod struct {
 }
 
 var (
-	stockData         map[string][]byte
-	commandHandlers   map[string]CommandHandler
-	pods              map[string]RedisPod
-	tokens            map[string]bool
-	managingSentinels SentinelSet
-	app               *cli.App
+	stockData       map[string][]byte
+	commandHandlers map[string]CommandHandler
+	pods            map[string]RedisPod
+	app             *cli.App
 )
 
 func init() {
@@ -47,9 +47,12 @@ func init() {
 	commandHandlers["AUTH"] = authConnection
 	commandHandlers["ADDSENTINEL"] = addSentinel
 	commandHandlers["KNOWNSENTINELS"] = knownSentinels
-	tokens = make(map[string]bool)
-	//tokens["secretpass1"] = true
-	managingSentinels = NewConstellation()
+	commandHandlers["POOLSTATS"] = poolStats
+	commandHandlers["INFO"] = info
+	commandHandlers["SUBSCRIBE"] = subscribe
+	commandHandlers["PSUBSCRIBE"] = subscribe
+	commandHandlers["ACL"] = aclCommand
+	commandHandlers["CREDENTIAL"] = credentialCommand
 }
 
 func main() {
@@ -62,10 +65,36 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "authtoken, a",
-			Value:  "secretpass1",
 			Usage:  "The auth token to use for palisade",
 			EnvVar: "PALISADE_AUTH",
 		},
+		cli.StringFlag{
+			Name:   "authtoken-hash",
+			Usage:  "A bcrypt hash of the auth token, to keep the token itself out of the command line",
+			EnvVar: "PALISADE_AUTH_HASH",
+		},
+		cli.IntFlag{
+			Name:   "bcrypt-cost",
+			Value:  credential.BcryptCost,
+			Usage:  "The bcrypt work factor of new credentials",
+			EnvVar: "PALISADE_BCRYPT_COST",
+		},
+		cli.StringFlag{
+			Name:   "aclfile",
+			Usage:  "File of users in Redis ACL syntax, reloaded with ACL LOAD and written with ACL SAVE",
+			EnvVar: "PALISADE_ACLFILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "tenant",
+			Usage:  "A tenant's auth token, written namespace=token; the tenant only sees pods named <namespace>-<name>, as <name>",
+			EnvVar: "PALISADE_TENANTS",
+		},
+		cli.StringFlag{
+			Name:   "namespace-separator",
+			Value:  NamespaceSeparator,
+			Usage:  "What joins a tenant's namespace and its pod names",
+			EnvVar: "PALISADE_NAMESPACE_SEPARATOR",
+		},
 		cli.IntFlag{
 			Name:   "port, p",
 			Value:  26380,
@@ -76,6 +105,80 @@ func main() {
 			Name:   "sentineladdr,s",
 			EnvVar: "PALISADE_MANAGINGSENTINELS",
 		},
+		cli.DurationFlag{
+			Name:   "probe-interval",
+			Value:  sentinelproxy.ProbeInterval,
+			Usage:  "How often sentinels are health checked and asked for their peers; 0 disables this",
+			EnvVar: "PALISADE_PROBE_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "forget-after",
+			Value:  sentinelproxy.ForgetAfter,
+			Usage:  "Drop discovered sentinels unhealthy for this long; 0 keeps them",
+			EnvVar: "PALISADE_FORGET_AFTER",
+		},
+		cli.DurationFlag{
+			Name:   "cache-ttl",
+			Value:  sentinelproxy.CacheTTL,
+			Usage:  "How long master addresses are cached between sentinel events; 0 disables the cache",
+			EnvVar: "PALISADE_CACHE_TTL",
+		},
+		cli.BoolFlag{
+			Name:   "passthrough",
+			Usage:  "Relay commands the proxy doesn't handle to a managing sentinel",
+			EnvVar: "PALISADE_PASSTHROUGH",
+		},
+		cli.StringSliceFlag{
+			Name:   "passthrough-allow",
+			Usage:  "Command to relay, e.g. INFO or 'SENTINEL CKQUORUM' or 'SENTINEL *'; all when none given",
+			EnvVar: "PALISADE_PASSTHROUGH_ALLOW",
+		},
+		cli.StringSliceFlag{
+			Name:   "passthrough-deny",
+			Usage:  "Command never to relay, in addition to the built in list of commands that change sentinels or the connection",
+			EnvVar: "PALISADE_PASSTHROUGH_DENY",
+		},
+		cli.DurationFlag{
+			Name:   "dial-timeout",
+			Value:  sentinelproxy.DialTimeout,
+			Usage:  "Timeout for connecting to a sentinel",
+			EnvVar: "PALISADE_DIAL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "read-timeout",
+			Value:  sentinelproxy.ReadTimeout,
+			Usage:  "Timeout for reading a sentinel's reply",
+			EnvVar: "PALISADE_READ_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "write-timeout",
+			Value:  sentinelproxy.WriteTimeout,
+			Usage:  "Timeout for sending a command to a sentinel",
+			EnvVar: "PALISADE_WRITE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "idle-timeout",
+			Value:  sentinelproxy.IdleTimeout,
+			Usage:  "Close sentinel connections idle for this long",
+			EnvVar: "PALISADE_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "max-conns",
+			Value:  sentinelproxy.MaxConns,
+			Usage:  "Most connections open to each sentinel",
+			EnvVar: "PALISADE_MAX_CONNS",
+		},
+		cli.IntFlag{
+			Name:   "quorum, q",
+			Usage:  "How many sentinels must agree on a master; 0 for a majority",
+			EnvVar: "PALISADE_QUORUM",
+		},
+		cli.DurationFlag{
+			Name:   "query-timeout",
+			Value:  queryTimeout,
+			Usage:  "How long to wait for the sentinels to answer",
+			EnvVar: "PALISADE_QUERY_TIMEOUT",
+		},
 	}
 
 	app.Action = serve
@@ -84,12 +187,67 @@ func main() {
 
 func serve(c *cli.Context) {
 	port := c.Int("port")
-	auth := c.String("authtoken")
 
-	tokens[auth] = true
+	credential.BcryptCost = c.Int("bcrypt-cost")
+	if credential.BcryptCost < bcrypt.MinCost || credential.BcryptCost > bcrypt.MaxCost {
+		log.Fatalf("--bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	// Namespaces are checked against the separator as users are made.
+	if NamespaceSeparator = c.String("namespace-separator"); NamespaceSeparator == "" {
+		log.Fatal("--namespace-separator can't be empty")
+	}
+	defaultRules := []string{"reset", "on", "allkeys", "allcommands"}
+	if auth := c.String("authtoken"); auth != "" {
+		defaultRules = append(defaultRules, ">"+auth)
+	}
+	if hash := c.String("authtoken-hash"); hash != "" {
+		defaultRules = append(defaultRules, "#"+hash)
+	}
+	if err := acl.SetUser(DefaultUser, defaultRules); err != nil {
+		log.Fatalf("invalid auth token: %v", err)
+	}
+	if aclFile = c.String("aclfile"); aclFile != "" {
+		if err := loadACLFile(); err != nil {
+			log.Fatalf("unable to load users: %v", err)
+		}
+	}
+	if user := acl.Get(DefaultUser); len(user.Credentials) == 0 && !user.NoPass {
+		log.Print("the default user has no credentials, give --authtoken or --authtoken-hash to use AUTH <token>")
+	}
+	if err := parseTenants(c.StringSlice("tenant")); err != nil {
+		log.Fatalf("invalid --tenant: %v", err)
+	}
+	quorum = c.Int("quorum")
+	queryTimeout = c.Duration("query-timeout")
+	sentinelproxy.Passthrough = c.Bool("passthrough")
+	sentinelproxy.PassthroughAllow = c.StringSlice("passthrough-allow")
+	sentinelproxy.PassthroughDeny = append(sentinelproxy.PassthroughDeny, c.StringSlice("passthrough-deny")...)
+	if sentinelproxy.Passthrough {
+		log.Print(sentinelproxy.PassthroughInfo())
+	}
+	sentinelproxy.DialTimeout = c.Duration("dial-timeout")
+	sentinelproxy.ReadTimeout = c.Duration("read-timeout")
+	sentinelproxy.WriteTimeout = c.Duration("write-timeout")
+	sentinelproxy.IdleTimeout = c.Duration("idle-timeout")
+	sentinelproxy.MaxConns = c.Int("max-conns")
+	if sentinelproxy.MaxConns < 1 {
+		log.Fatal("--max-conns must be at least 1")
+	}
+	if sentinelproxy.IdleTimeout > 0 {
+		go sentinelproxy.ReapIdle()
+	}
 	for _, sa := range c.StringSlice("sentineladdr") {
 		log.Printf("adding managing sentinel %s", sa)
-		managingSentinels.Add(sa)
+		sentinelproxy.Sentinels.Add(sa)
+	}
+	sentinelproxy.CacheTTL = c.Duration("cache-ttl")
+	for _, sa := range sentinelproxy.Sentinels.List() {
+		sentinelproxy.Cache.Watch(sa)
+	}
+	sentinelproxy.ProbeInterval = c.Duration("probe-interval")
+	sentinelproxy.ForgetAfter = c.Duration("forget-after")
+	if sentinelproxy.ProbeInterval > 0 {
+		go sentinelproxy.Discover()
 	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/therealbill/palisade/sentinel"
+)
+
+var (
+	// tenants maps the tenantIndex of a tenant's token to the tenant's
+	// user, so AUTH with just the token logs the tenant in.
+	tenants = make(map[string]string)
+	// NamespaceSeparator joins a tenant's namespace and its pod names, so
+	// tenant "payments" asking for "cache" gets backend pod "payments-cache".
+	// Namespaces may not contain it.
+	NamespaceSeparator = "-"
+
+	// tenantRules are the ACL rules of users made with --tenant: the
+	// commands that neither change the managing sentinels nor show pods of
+	// every tenant.
+	tenantRules = []string{
+		"+sentinel|master", "+sentinel|masters", "+sentinel|get-master-addr-by-name",
+		"+subscribe", "+psubscribe", "+unsubscribe", "+punsubscribe",
+		"+ping", "+acl|whoami",
+	}
+)
+
+// parseTenants reads --tenant values written as namespace=token, making a
+// user named after each namespace.
+func parseTenants(specs []string) error {
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("'%s' is not written as namespace=token", spec)
+		}
+		index := tenantIndex(parts[1])
+		if _, taken := tenants[index]; taken {
+			return fmt.Errorf("the token for tenant %s is already in use", parts[0])
+		}
+		rules := append([]string{"reset", "on", ">" + parts[1], "allkeys", "namespace:" + parts[0]}, tenantRules...)
+		if err := acl.SetUser(parts[0], rules); err != nil {
+			return err
+		}
+		tenants[index] = parts[0]
+	}
+	return nil
+}
+
+// Pod is the backend pod a client's pod name refers to.
+func (s *Session) Pod(name string) string {
+	if s == nil || s.User == nil || s.User.Namespace == "" {
+		return name
+	}
+	return s.User.Namespace + NamespaceSeparator + name
+}
+
+// Visible is the name the client knows a backend pod by, and false when
+// the pod belongs to another tenant or none of the user's pod patterns
+// match it.
+func (s *Session) Visible(pod string) (string, bool) {
+	if s == nil || s.User == nil {
+		return pod, true
+	}
+	name := pod
+	if s.User.Namespace != "" {
+		prefix := s.User.Namespace + NamespaceSeparator
+		if !strings.HasPrefix(pod, prefix) || len(pod) == len(prefix) {
+			return "", false
+		}
+		name = pod[len(prefix):]
+	}
+	return name, s.User.CanAccess(name)
+}
+
+// eventPod finds which word of a sentinel event's payload names the pod,
+// or -1 when it names none. Events are either about a pod itself
+// ("master <name> <ip> <port> ..." or "<name> <old ip> ..." for
+// +switch-master) or about an instance of one ("... @ <name> <ip> <port>").
+func eventPod(channel string, words []string) int {
+	for i, word := range words {
+		if word == "@" && i+1 < len(words) {
+			return i + 1
+		}
+	}
+	switch {
+	case channel == "+switch-master" && len(words) > 0:
+		return 0
+	case len(words) > 1 && words[0] == "master":
+		return 1
+	}
+	return -1
+}
+
+// Event rewrites a sentinel event for the session, returning false when
+// the event is about a pod the session can't see, or about no pod at all
+// and the session belongs to a tenant.
+func (s *Session) Event(channel, payload string) (string, bool) {
+	if s == nil || s.User == nil {
+		return payload, true
+	}
+	words := strings.Fields(payload)
+	i := eventPod(channel, words)
+	if i < 0 {
+		return payload, s.User.Namespace == ""
+	}
+	name, visible := s.Visible(words[i])
+	if !visible {
+		return "", false
+	}
+	words[i] = name
+	return strings.Join(words, " "), true
+}
+
+// namespaceBackend is the front of a session's backend chain. It turns the
+// pod names the client uses into backend pod names and back, and leaves out
+// the pods and events of other tenants and those the user can't access.
+type namespaceBackend struct {
+	Next    sentinel.Backend
+	Session *Session
+}
+
+func (b *namespaceBackend) LookupMaster(name string) (sentinel.RedisPod, bool, error) {
+	pod, found, err := b.Next.LookupMaster(b.Session.Pod(name))
+	if found {
+		pod.Name = name
+	}
+	return pod, found, err
+}
+
+func (b *namespaceBackend) ListMasters() ([]sentinel.RedisPod, error) {
+	pods, err := b.Next.ListMasters()
+	visible := pods[:0]
+	for _, pod := range pods {
+		if name, ok := b.Session.Visible(pod.Name); ok {
+			pod.Name = name
+			visible = append(visible, pod)
+		}
+	}
+	return visible, err
+}
+
+func (b *namespaceBackend) Replicas(name string) ([]string, error) {
+	return b.Next.Replicas(b.Session.Pod(name))
+}
+
+func (b *namespaceBackend) Sentinels(name string) ([]sentinel.KnownSentinel, error) {
+	return b.Next.Sentinels(b.Session.Pod(name))
+}
+
+func (b *namespaceBackend) Monitor(o sentinel.Origin, pod sentinel.RedisPod) error {
+	pod.Name = b.Session.Pod(pod.Name)
+	return b.Next.Monitor(o, pod)
+}
+
+func (b *namespaceBackend) Set(o sentinel.Origin, name, setting, value string) error {
+	return b.Next.Set(o, b.Session.Pod(name), setting, value)
+}
+
+func (b *namespaceBackend) Remove(o sentinel.Origin, name string) error {
+	return b.Next.Remove(o, b.Session.Pod(name))
+}
+
+func (b *namespaceBackend) Subscribe(l sentinel.EventListener) func() {
+	return b.Next.Subscribe(func(pod sentinel.RedisPod, etype, msg string) {
+		payload, visible := b.Session.Event(etype, msg)
+		if !visible {
+			return
+		}
+		if name, ok := b.Session.Visible(pod.Name); ok {
+			pod.Name = name
+		}
+		l(pod, etype, payload)
+	})
+}
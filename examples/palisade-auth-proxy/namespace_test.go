@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/therealbill/palisade/sentinel"
+)
+
+func TestNamespaceCannotHoldSeparator(t *testing.T) {
+	u := NewUser("eu")
+	if err := u.Apply("namespace:payments" + NamespaceSeparator + "eu"); err == nil {
+		t.Error("a namespace holding the separator was accepted")
+	}
+	if err := u.Apply("namespace:paymentseu"); err != nil || u.Namespace != "paymentseu" {
+		t.Errorf("namespace paymentseu gave %q, %v", u.Namespace, err)
+	}
+}
+
+func TestVisible(t *testing.T) {
+	u := NewUser("payments")
+	for _, rule := range []string{"allkeys", "namespace:payments"} {
+		if err := u.Apply(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Session{User: u}
+	if pod := s.Pod("cache"); pod != "payments-cache" {
+		t.Errorf("cache is backend pod %s", pod)
+	}
+	for _, tc := range []struct {
+		pod, name string
+		visible   bool
+	}{
+		{"payments-cache", "cache", true},
+		{"payments-eu-cache", "eu-cache", true},
+		{"payments-", "", false},
+		{"paymentscache", "", false},
+		{"billing-cache", "", false},
+	} {
+		if name, visible := s.Visible(tc.pod); name != tc.name || visible != tc.visible {
+			t.Errorf("%s is seen as %q, %t; want %q, %t", tc.pod, name, visible, tc.name, tc.visible)
+		}
+	}
+}
+
+// stubBackend serves a fixed list of pods and hands out its listener.
+type stubBackend struct {
+	sentinel.Backend
+	pods     []sentinel.RedisPod
+	listener sentinel.EventListener
+}
+
+func (b *stubBackend) LookupMaster(name string) (sentinel.RedisPod, bool, error) {
+	for _, pod := range b.pods {
+		if pod.Name == name {
+			return pod, true, nil
+		}
+	}
+	return sentinel.RedisPod{}, false, nil
+}
+
+func (b *stubBackend) ListMasters() ([]sentinel.RedisPod, error) {
+	return append([]sentinel.RedisPod(nil), b.pods...), nil
+}
+
+func (b *stubBackend) Subscribe(l sentinel.EventListener) func() {
+	b.listener = l
+	return func() {}
+}
+
+func TestNamespaceBackend(t *testing.T) {
+	u := NewUser("payments")
+	for _, rule := range []string{"allkeys", "namespace:payments"} {
+		if err := u.Apply(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := &stubBackend{pods: []sentinel.RedisPod{{Name: "payments-cache", IP: "10.0.0.1"}, {Name: "billing-cache", IP: "10.0.0.2"}}}
+	b := &namespaceBackend{Next: next, Session: &Session{User: u}}
+
+	if pod, found, _ := b.LookupMaster("cache"); !found || pod.Name != "cache" || pod.IP != "10.0.0.1" {
+		t.Errorf("LookupMaster(cache) = %+v, %v", pod, found)
+	}
+	if pods, _ := b.ListMasters(); len(pods) != 1 || pods[0].Name != "cache" {
+		t.Errorf("ListMasters() = %+v, want only the tenant's cache", pods)
+	}
+
+	var events []string
+	b.Subscribe(func(pod sentinel.RedisPod, etype, msg string) {
+		events = append(events, pod.Name+": "+msg)
+	})
+	next.listener(sentinel.RedisPod{Name: "billing-cache"}, "+sdown", "master billing-cache 10.0.0.2 6379")
+	next.listener(sentinel.RedisPod{Name: "payments-cache"}, "+sdown", "master payments-cache 10.0.0.1 6379")
+	if len(events) != 1 || events[0] != "cache: master cache 10.0.0.1 6379" {
+		t.Errorf("events %q, want only the tenant's, renamed", events)
+	}
+}
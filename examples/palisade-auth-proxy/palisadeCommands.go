@@ -13,35 +13,93 @@ import (
 	"log"
 	"net"
 	"strings"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+)
+
+var (
+	InvalidAuth = errors.New("Invalid auth")
+	UserDeleted = errors.New("GOAWAY the user was deleted")
 )
 
+// Session is a client connection and who it authenticated as.
+type Session struct {
+	Addr string
+	User *User
+	// Reader is where the session's commands come from, for handlers that
+	// keep reading them such as SUBSCRIBE.
+	Reader *RedisParser
+}
+
+// Refresh picks up changes made to the session's user since the last
+// command, failing once the user is deleted.
+func (s *Session) Refresh() error {
+	if s.User = acl.Get(s.User.Name); s.User == nil {
+		return UserDeleted
+	}
+	return nil
+}
+
+// authConnection logs the session in: AUTH <user> <password>, or
+// AUTH <password> for the default user or a tenant's token.
 func authConnection(c *Command, w *bufio.Writer) error {
-	token := string(c.Get(1))
-	valid, exists := tokens[token]
-	if exists && valid {
-		return nil
+	name, pass := DefaultUser, string(c.Get(1))
+	if c.ArgCount() > 2 {
+		name, pass = string(c.Get(1)), string(c.Get(2))
+	} else if tenant, exists := tenants[tenantIndex(pass)]; exists {
+		name = tenant
+	}
+	user, ok := authenticate(name, pass)
+	if !ok {
+		return InvalidAuth
 	}
-	return errors.New("Invalid auth")
+	c.Session.User = user
+	return nil
 }
 
 func addSentinel(c *Command, w *bufio.Writer) error {
 	sa := string(c.Get(1))
-	managingSentinels.Add(sa)
+	sentinelproxy.Sentinels.Add(sa)
+	sentinelproxy.Cache.Watch(sa)
 	return SendOk(w)
 }
 
+// knownSentinels reports every managing sentinel and its health:
+// KNOWNSENTINELS
 func knownSentinels(c *Command, w *bufio.Writer) error {
-	var sentinels []string
-	for s, _ := range managingSentinels {
-		sentinels = append(sentinels, s)
+	return SendBulkStringArrays(w, sentinelproxy.KnownSentinels())
+}
+
+// poolStats reports the connection pool of every managing sentinel:
+// POOLSTATS
+func poolStats(c *Command, w *bufio.Writer) error {
+	return SendBulkStringArrays(w, sentinelproxy.PoolStats())
+}
+
+// info reports the proxy's state: INFO
+func info(c *Command, w *bufio.Writer) error {
+	lines := append([]string{"# Cache"}, sentinelproxy.Cache.Info()...)
+	return SendBulkString(w, strings.Join(lines, "\r\n")+"\r\n")
+}
+
+// passthroughCommand relays a command to a managing sentinel and sends its
+// reply back to the client byte for byte.
+func passthroughCommand(c *Command, w *bufio.Writer) error {
+	raw, err := sentinelproxy.Relay(c)
+	if err != nil {
+		return SendError(w, err.Error())
 	}
-	return SendBulkStrings(w, sentinels)
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	return w.Flush()
 }
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	parser := NewParser(conn)
 	w := bufio.NewWriter(conn)
+	session := &Session{Addr: conn.RemoteAddr().String(), Reader: parser}
 	authorized := false
 	authfails := 0
 	maxauths := 3
@@ -59,6 +117,7 @@ func handleConnection(conn net.Conn) {
 				break
 			}
 		} else {
+			command.Session = session
 			cmd := strings.ToUpper(string(command.Get(0)))
 			if cmd == "QUIT" {
 				conn.Close()
@@ -83,7 +142,7 @@ func handleConnection(conn net.Conn) {
 						continue
 					}
 					authorized = true
-					log.Printf("Client %s authorized successfully", conn.RemoteAddr())
+					log.Printf("Client %s authorized successfully as %s", conn.RemoteAddr(), session.User.Name)
 					ew = SendOk(w)
 					if ew != nil {
 						log.Printf("Error on send: %v", ew)
@@ -104,9 +163,37 @@ func handleConnection(conn net.Conn) {
 					continue
 				}
 			}
+			if err := session.Refresh(); err != nil {
+				SendError(w, err.Error())
+				log.Printf("Connection terminated for %s: %v", conn.RemoteAddr(), err)
+				break
+			}
 			handler, exists := commandHandlers[cmd]
-			if exists {
+			if cmd == "AUTH" {
+				// Failures after logging in count towards maxauths too,
+				// so a session can't be used to guess passwords.
+				if err := authConnection(command, w); err == nil {
+					ew = SendOk(w)
+				} else {
+					authfails++
+					if authfails >= maxauths {
+						SendError(w, "GOAWAY Too many failed auth attempts")
+						log.Printf("Connection terminated for %s due to too many failed auth attempts", conn.RemoteAddr())
+						break
+					}
+					ew = SendError(w, "WRONGPASS invalid username-password pair or user is disabled")
+				}
+			} else if err := checkPermission(session, command); err != nil {
+				ew = SendError(w, err.Error())
+			} else if exists {
 				ew = handler(command, w)
+			} else if sentinelproxy.PassthroughAllowed(command) {
+				if session.User.Namespace != "" {
+					// Relayed commands would name pods outside the namespace.
+					ew = SendError(w, fmt.Sprintf("NOPERM Command '%s' can't be passed through for a user with a namespace", cmd))
+				} else {
+					ew = passthroughCommand(command, w)
+				}
 			} else {
 				log.Printf("unsupported command: %s", cmd)
 				var args []string
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+func TestFailedReauthsCount(t *testing.T) {
+	if err := acl.SetUser("guesser", []string{"reset", "on", ">right", "allkeys", "allcommands"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.DelUser([]string{"guesser"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleConnection(server)
+	r, w := bufio.NewReader(client), bufio.NewWriter(client)
+	send := func(args ...string) interface{} {
+		t.Helper()
+		if err := resp.WriteCommand(w, args); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := resp.ReadReply(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if reply := send("AUTH", "guesser", "wrong"); !strings.HasPrefix(fmt.Sprint(reply), "INVALIDAUTH") {
+		t.Fatalf("a wrong password before logging in replied %v", reply)
+	}
+	if reply := send("AUTH", "guesser", "right"); reply != "OK" {
+		t.Fatalf("logging in replied %v", reply)
+	}
+	if reply := send("AUTH", "guesser", "wrong"); !strings.HasPrefix(fmt.Sprint(reply), "WRONGPASS") {
+		t.Fatalf("a wrong password after logging in replied %v", reply)
+	}
+	if reply := send("AUTH", "guesser", "wrong"); !strings.HasPrefix(fmt.Sprint(reply), "GOAWAY") {
+		t.Fatalf("the third wrong password replied %v", reply)
+	}
+	if _, err := resp.ReadReply(r); err == nil {
+		t.Error("the connection stayed open after three failed AUTHs")
+	}
+}
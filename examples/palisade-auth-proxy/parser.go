@@ -37,6 +37,8 @@ func (p *ProtocolError) Error() string {
 
 type Command struct {
 	argv [][]byte
+	// Session is the connection the command arrived on.
+	Session *Session
 }
 
 func (c *Command) Get(index int) []byte {
@@ -204,7 +206,7 @@ func (r *RedisParser) parseBinary() (*Command, error) {
 			return nil, e
 		}
 	}
-	return &Command{argv}, nil
+	return &Command{argv: argv}, nil
 }
 func (r *RedisParser) parseTelnet() (*Command, error) {
 	nlPos := -1
@@ -222,7 +224,7 @@ func (r *RedisParser) parseTelnet() (*Command, error) {
 		}
 	}
 	r.reset()
-	return &Command{bytes.Split(r.buffer[:nlPos-1], spaceSlice)}, nil
+	return &Command{argv: bytes.Split(r.buffer[:nlPos-1], spaceSlice)}, nil
 }
 
 func (r *RedisParser) reset() {
@@ -357,3 +359,20 @@ func SendBulkStrings(w *bufio.Writer, strs []string) error {
 	}
 	return SendBulks(w, t)
 }
+func SendBulkStringArrays(w *bufio.Writer, arrs [][]string) error {
+	pre := "*" + intToString(int64(len(arrs))) + "\r\n"
+	_, e := w.Write([]byte(pre))
+	if e != nil {
+		return e
+	}
+	for _, strs := range arrs {
+		t := make([][]byte, 0, len(strs))
+		for i := 0; i < len(strs); i++ {
+			t = append(t, []byte(strs[i]))
+		}
+		if e = sendBulks(w, t); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
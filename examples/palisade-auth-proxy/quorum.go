@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+)
+
+var (
+	// quorum is how many managing sentinels must report the same master
+	// address; 0 means a majority of those watching the pod.
+	quorum       int
+	queryTimeout = 2 * time.Second
+)
+
+// NoQuorumError is returned when the managing sentinels don't agree on a
+// master, or too few of them answered in time.
+type NoQuorumError struct {
+	Pod     string
+	Needed  int
+	Answers map[string][]string
+}
+
+func (e *NoQuorumError) Error() string {
+	var parts []string
+	for addr, sentinels := range e.Answers {
+		parts = append(parts, fmt.Sprintf("%s from %d", addr, len(sentinels)))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("NOQUORUM %d sentinels must agree on the master of '%s', got %s", e.Needed, e.Pod, strings.Join(parts, ", "))
+}
+
+type sentinelAnswer struct {
+	sentinel string
+	addr     string
+	err      error
+}
+
+// neededVotes is how many of the watching sentinels have to agree on an
+// address.
+func neededVotes(watching int) int {
+	if quorum > 0 {
+		return quorum
+	}
+	return watching/2 + 1
+}
+
+// askSentinels picks the sentinels to ask about a pod: the usable ones
+// among those watching it, or all of those watching it when none is
+// usable.
+func askSentinels(watching []string) []string {
+	usable := make(map[string]bool)
+	for _, sa := range sentinelproxy.Usable() {
+		usable[sa] = true
+	}
+	var ask []string
+	for _, sa := range watching {
+		if usable[sa] {
+			ask = append(ask, sa)
+		}
+	}
+	if len(ask) == 0 {
+		return watching
+	}
+	return ask
+}
+
+// quorumMaster asks the managing sentinels watching the pod for its master
+// in parallel and returns the address once enough of them agree, along
+// with the sentinels that agreed. Sentinels that haven't answered by
+// queryTimeout don't get a vote. found is false only when a sentinel
+// answered that it doesn't know the pod and none reported an address; when
+// no sentinel answered at all the error is sentinelproxy.NoSentinel.
+func quorumMaster(name string) (addr string, agreeing []string, found bool, err error) {
+	watching := sentinelproxy.Watching(name)
+	sentinels := askSentinels(watching)
+	answers := make(chan sentinelAnswer, len(sentinels))
+	for _, sa := range sentinels {
+		go func(sa string) {
+			host, port, err := sentinelproxy.GetMasterAddr(sa, name)
+			if err != nil || host == "" {
+				answers <- sentinelAnswer{sentinel: sa, err: err}
+				return
+			}
+			answers <- sentinelAnswer{sentinel: sa, addr: net.JoinHostPort(host, port)}
+		}(sa)
+	}
+	votes := make(map[string][]string)
+	unknown := 0
+	deadline := time.After(queryTimeout)
+	needed := neededVotes(len(watching))
+collect:
+	for i := 0; i < len(sentinels); i++ {
+		select {
+		case a := <-answers:
+			if a.err != nil {
+				log.Printf("[%s] error: %s", a.sentinel, a.err.Error())
+				continue
+			}
+			if a.addr == "" {
+				log.Printf("[%s] no such pod", a.sentinel)
+				unknown++
+				continue
+			}
+			votes[a.addr] = append(votes[a.addr], a.sentinel)
+		case <-deadline:
+			log.Printf("only %d of %d sentinels answered for '%s' in %s", i, len(sentinels), name, queryTimeout)
+			break collect
+		}
+	}
+	if len(votes) == 0 {
+		if unknown == 0 {
+			return "", nil, false, sentinelproxy.NoSentinel
+		}
+		return "", nil, false, nil
+	}
+	var best string
+	for a, sentinels := range votes {
+		if len(sentinels) > len(votes[best]) {
+			best = a
+		}
+	}
+	contested := false
+	for a, sentinels := range votes {
+		if a != best && len(sentinels) >= needed {
+			contested = true
+		}
+	}
+	if len(votes[best]) >= needed && !contested {
+		if len(votes) > 1 {
+			logDissent(name, best, votes)
+		}
+		return best, votes[best], true, nil
+	}
+	logDissent(name, best, votes)
+	return "", nil, true, &NoQuorumError{Pod: name, Needed: needed, Answers: votes}
+}
+
+func logDissent(name, best string, votes map[string][]string) {
+	for a, sentinels := range votes {
+		if a != best {
+			log.Printf("sentinels %s disagree on '%s': they report %s, %d others report %s", strings.Join(sentinels, ","), name, a, len(votes[best]), best)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/resp"
+)
+
+// nullSentinel answers every command with a null, as a sentinel asked for
+// the master of a pod it doesn't know does.
+func nullSentinel(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := resp.ReadReply(r); err != nil {
+						return
+					}
+					conn.Write([]byte("*-1\r\n"))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// deadSentinel returns an address nothing listens on.
+func deadSentinel(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestQuorumMasterNeedsAnAnswer(t *testing.T) {
+	dead := deadSentinel(t)
+	sentinelproxy.Sentinels.Add(dead)
+	defer sentinelproxy.Sentinels.Remove(dead)
+	if _, _, found, err := quorumMaster("cache"); err != sentinelproxy.NoSentinel || found {
+		t.Errorf("with no sentinel answering got found %v, err %v", found, err)
+	}
+
+	null := nullSentinel(t)
+	sentinelproxy.Sentinels.Add(null)
+	defer sentinelproxy.Sentinels.Remove(null)
+	if _, _, found, err := quorumMaster("cache"); err != nil || found {
+		t.Errorf("with a sentinel not knowing the pod got found %v, err %v", found, err)
+	}
+}
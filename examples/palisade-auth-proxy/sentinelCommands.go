@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"log"
+	"net"
 	"strings"
 
-	"github.com/fatih/structs"
-	"github.com/therealbill/libredis/client"
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/sentinel"
 )
 
 var (
@@ -17,6 +18,7 @@ var (
 func init() {
 	sentinelSubcommands = make(map[string]CommandHandler)
 	sentinelSubcommands["MASTER"] = sentinelGetMasterByName
+	sentinelSubcommands["MASTERS"] = sentinelMasters
 	sentinelSubcommands["GET-MASTER-ADDR-BY-NAME"] = sentinelGetMasterAddressByName
 }
 
@@ -25,51 +27,88 @@ func Sentinel(c *Command, w *bufio.Writer) error {
 	handler, exists := sentinelSubcommands[subcomm]
 	if exists {
 		return handler(c, w)
+	} else if sentinelproxy.PassthroughAllowed(c) {
+		return passthroughCommand(c, w)
 	} else {
 		return SendError(w, fmt.Sprintf("Command '%s' not supported", subcomm))
 	}
 
 }
 
+// proxy asks the managing sentinels about pods, trusting a master address
+// once a quorum of them agree on it.
+var proxy = sentinelproxy.NewBackend()
+
+func init() {
+	proxy.FetchMaster = fetchMaster
+}
+
+// backendFor is the backend chain answering a session: its namespace in
+// front of the managing sentinels.
+func backendFor(s *Session) sentinel.Backend {
+	return &namespaceBackend{Next: proxy, Session: s}
+}
+
 func sentinelGetMasterAddressByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	var minfo []string
-	for sa, _ := range managingSentinels {
-		sc, err := client.DialAddress(sa)
+	pod, found, err := backendFor(c.Session).LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if !found {
+		log.Printf("Pod '%s' not found anywhere, return error", name)
+		return SendError(w, fmt.Sprintf("-ERR No such pod '%s'", name))
+	}
+	return SendBulkStrings(w, []string{pod.IP, pod.Port})
+}
+
+// fetchMaster asks the managing sentinels for the address a quorum of them
+// agree on, and one of those that agreed for the rest of the pod. When none
+// of them describes it the pod only has its address.
+func fetchMaster(name string) (sentinel.RedisPod, bool, error) {
+	addr, agreeing, found, err := quorumMaster(name)
+	if err != nil || !found {
+		return sentinel.RedisPod{}, found, err
+	}
+	var pod sentinel.RedisPod
+	for _, sa := range agreeing {
+		reply, err := sentinelproxy.PoolFor(sa).Do("SENTINEL", "MASTER", name)
 		if err == nil {
-			res, _ := sc.SentinelGetMaster(name)
-			if res.Host > "" {
-				minfo = append(minfo, res.Host)
-				minfo = append(minfo, fmt.Sprintf("%d", res.Port))
-				return SendBulkStrings(w, minfo)
+			if pod, err = sentinel.ParseMaster(reply); err == nil {
+				break
 			}
-			log.Printf("[%s] no such pod", sa)
-			continue
 		}
 		log.Printf("[%s] error: %s", sa, err.Error())
 	}
-	log.Printf("Pod '%s' not found anywhere, return error", name)
-	return SendError(w, fmt.Sprintf("-ERR No such pod '%s'", name))
+	pod.Name = name
+	pod.IP, pod.Port, _ = net.SplitHostPort(addr)
+	return pod, true, nil
 }
 
+// sentinelGetMasterByName returns the pod as a quorum of the managing
+// sentinels see it.
 func sentinelGetMasterByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	var minfo []string
-	for sa, _ := range managingSentinels {
-		sc, err := client.DialAddress(sa)
-		if err == nil {
-			res, err := sc.SentinelMaster(name)
-			if res.Name > "" {
-				m := structs.Fields(res)
-				for _, v := range m {
-					minfo = append(minfo, v.Tag("redis"))
-					minfo = append(minfo, fmt.Sprintf("%v", v.Value()))
-				}
-			}
-			if err != nil {
-				log.Printf("[%s] error: %s", sc, err.Error())
-			}
-		}
+	pod, found, err := backendFor(c.Session).LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if !found {
+		return SendBulkStrings(w, nil)
+	}
+	return SendBulkStrings(w, sentinel.PodInfo(pod))
+}
+
+// sentinelMasters lists the pods of the first managing sentinel that
+// answers, leaving out those of other tenants.
+func sentinelMasters(c *Command, w *bufio.Writer) error {
+	pods, err := backendFor(c.Session).ListMasters()
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	masters := make([][]string, 0, len(pods))
+	for _, pod := range pods {
+		masters = append(masters, sentinel.PodInfo(pod))
 	}
-	return SendBulkStrings(w, minfo)
+	return SendBulkStringArrays(w, masters)
 }
@@ -6,7 +6,6 @@ commands being proxied to the managing sentinel server(s).
 # Ways to improve this example
  * Subscribe to the Sentinel event channels to catch sdown events on
    sentinels, using these to update the constellation in real time.
- * Use discovery to populate Constellation information from a single sentinel
  * Config backing store such as Consul
 */
 
@@ -18,8 +17,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 
 	"github.com/codegangsta/cli"
+	"github.com/therealbill/palisade/examples/sentinelproxy"
 )
 
 type CommandHandler func(*Command, *bufio.Writer) error
@@ -33,12 +34,12 @@ type RedisPod struct {
 }
 
 var (
-	stockData         map[string][]byte
-	commandHandlers   map[string]CommandHandler
-	pods              map[string]RedisPod
-	tokens            map[string]bool
-	managingSentinels SentinelSet
-	app               *cli.App
+	stockData       map[string][]byte
+	commandHandlers map[string]CommandHandler
+	pods            map[string]RedisPod
+	// tokens holds the tokenHash of each token clients may AUTH with.
+	tokens map[string]bool
+	app    *cli.App
 )
 
 func init() {
@@ -47,9 +48,14 @@ func init() {
 	commandHandlers["AUTH"] = authConnection
 	commandHandlers["ADDSENTINEL"] = addSentinel
 	commandHandlers["KNOWNSENTINELS"] = knownSentinels
+	commandHandlers["POOLSTATS"] = poolStats
+	commandHandlers["INFO"] = info
+	commandHandlers["RESHARD"] = reshardCommand
+	commandHandlers["SHARDMAP"] = shardMapCommand
+	commandHandlers["SHARDOF"] = shardOf
+	commandHandlers["SHARDS"] = shards
+	commandHandlers["DISTRIBUTION"] = distribution
 	tokens = make(map[string]bool)
-	//tokens["secretpass1"] = true
-	managingSentinels = NewConstellation()
 }
 
 func main() {
@@ -62,8 +68,7 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "authtoken, a",
-			Value:  "secretpass1",
-			Usage:  "The auth token to use for palisade",
+			Usage:  "The auth token clients must AUTH with (required)",
 			EnvVar: "PALISADE_AUTH",
 		},
 		cli.IntFlag{
@@ -76,6 +81,118 @@ func main() {
 			Name:   "sentineladdr,s",
 			EnvVar: "PALISADE_MANAGINGSENTINELS",
 		},
+		cli.StringFlag{
+			Name:   "placement",
+			Value:  "modulo",
+			Usage:  "How targets are placed on shards: modulo, ketama, jump or rendezvous",
+			EnvVar: "PALISADE_PLACEMENT",
+		},
+		cli.IntFlag{
+			Name:   "shards",
+			Value:  shardCount,
+			Usage:  "The number of shards",
+			EnvVar: "PALISADE_SHARDS",
+		},
+		cli.StringFlag{
+			Name:   "shard-name",
+			Value:  shardName,
+			Usage:  "Pod name of each shard, {index} being the shard number",
+			EnvVar: "PALISADE_SHARD_NAME",
+		},
+		cli.StringFlag{
+			Name:   "shard-weights",
+			Usage:  "Comma separated weight of each shard, starting with shard 0; shards not listed weigh 1",
+			EnvVar: "PALISADE_SHARD_WEIGHTS",
+		},
+		cli.StringFlag{
+			Name:   "replica-strategy",
+			Value:  ReplicaStrategy,
+			Usage:  "How GET-REPLICA-ADDR-BY-NAME picks a replica when not told: random, least-lag or zone",
+			EnvVar: "PALISADE_REPLICA_STRATEGY",
+		},
+		cli.StringFlag{
+			Name:   "zone",
+			Usage:  "The zone the zone replica strategy prefers",
+			EnvVar: "PALISADE_ZONE",
+		},
+		cli.StringSliceFlag{
+			Name:   "zone-subnet",
+			Usage:  "A subnet in a zone, written zone=cidr, e.g. us-east-1a=10.1.0.0/16",
+			EnvVar: "PALISADE_ZONE_SUBNETS",
+		},
+		cli.StringFlag{
+			Name:   "shardmap-file",
+			Usage:  "File keeping the target overrides set with SHARDMAP",
+			EnvVar: "PALISADE_SHARDMAP_FILE",
+		},
+		cli.StringFlag{
+			Name:   "migration-file",
+			Usage:  "File keeping the resharding state across restarts",
+			EnvVar: "PALISADE_MIGRATION_FILE",
+		},
+		cli.DurationFlag{
+			Name:   "probe-interval",
+			Value:  sentinelproxy.ProbeInterval,
+			Usage:  "How often sentinels are health checked and asked for their peers; 0 disables this",
+			EnvVar: "PALISADE_PROBE_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "forget-after",
+			Value:  sentinelproxy.ForgetAfter,
+			Usage:  "Drop discovered sentinels unhealthy for this long; 0 keeps them",
+			EnvVar: "PALISADE_FORGET_AFTER",
+		},
+		cli.DurationFlag{
+			Name:   "cache-ttl",
+			Value:  sentinelproxy.CacheTTL,
+			Usage:  "How long master addresses are cached between sentinel events; 0 disables the cache",
+			EnvVar: "PALISADE_CACHE_TTL",
+		},
+		cli.BoolFlag{
+			Name:   "passthrough",
+			Usage:  "Relay commands the proxy doesn't handle to a managing sentinel",
+			EnvVar: "PALISADE_PASSTHROUGH",
+		},
+		cli.StringSliceFlag{
+			Name:   "passthrough-allow",
+			Usage:  "Command to relay, e.g. INFO or 'SENTINEL CKQUORUM' or 'SENTINEL *'; all when none given",
+			EnvVar: "PALISADE_PASSTHROUGH_ALLOW",
+		},
+		cli.StringSliceFlag{
+			Name:   "passthrough-deny",
+			Usage:  "Command never to relay, in addition to the built in list of commands that change sentinels or the connection",
+			EnvVar: "PALISADE_PASSTHROUGH_DENY",
+		},
+		cli.DurationFlag{
+			Name:   "dial-timeout",
+			Value:  sentinelproxy.DialTimeout,
+			Usage:  "Timeout for connecting to a sentinel",
+			EnvVar: "PALISADE_DIAL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "read-timeout",
+			Value:  sentinelproxy.ReadTimeout,
+			Usage:  "Timeout for reading a sentinel's reply",
+			EnvVar: "PALISADE_READ_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "write-timeout",
+			Value:  sentinelproxy.WriteTimeout,
+			Usage:  "Timeout for sending a command to a sentinel",
+			EnvVar: "PALISADE_WRITE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "idle-timeout",
+			Value:  sentinelproxy.IdleTimeout,
+			Usage:  "Close sentinel connections idle for this long",
+			EnvVar: "PALISADE_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "max-conns",
+			Value:  sentinelproxy.MaxConns,
+			Usage:  "Most connections open to each sentinel",
+			EnvVar: "PALISADE_MAX_CONNS",
+		},
 	}
 
 	app.Action = serve
@@ -85,11 +202,67 @@ func main() {
 func serve(c *cli.Context) {
 	port := c.Int("port")
 	auth := c.String("authtoken")
-
-	tokens[auth] = true
+	if auth == "" {
+		log.Fatal("--authtoken is required")
+	}
+	tokens[tokenHash(auth)] = true
+	shardCount = c.Int("shards")
+	shardName = c.String("shard-name")
+	placementAlgo = c.String("placement")
+	var err error
+	if shardWeights, err = parseWeights(c.String("shard-weights")); err != nil {
+		log.Fatal(err)
+	}
+	placement, err = NewPlacer(placementAlgo, weightsFor(shardCount))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("placing targets on %d shards with %s, weighted %v", shardCount, placementAlgo, weightsFor(shardCount))
+	shardMapFile = c.String("shardmap-file")
+	if err := loadShardMap(); err != nil {
+		log.Fatalf("unable to load target overrides: %v", err)
+	}
+	ReplicaStrategy = strings.ToLower(c.String("replica-strategy"))
+	if !validReplicaStrategy(ReplicaStrategy) {
+		log.Fatalf("unknown replica strategy '%s'", ReplicaStrategy)
+	}
+	localZone = c.String("zone")
+	if err := parseZoneSubnets(c.StringSlice("zone-subnet")); err != nil {
+		log.Fatalf("invalid --zone-subnet: %v", err)
+	}
+	migrationFile = c.String("migration-file")
+	if err := loadMigration(); err != nil {
+		log.Fatalf("unable to resume resharding: %v", err)
+	}
+	sentinelproxy.Passthrough = c.Bool("passthrough")
+	sentinelproxy.PassthroughAllow = c.StringSlice("passthrough-allow")
+	sentinelproxy.PassthroughDeny = append(sentinelproxy.PassthroughDeny, c.StringSlice("passthrough-deny")...)
+	if sentinelproxy.Passthrough {
+		log.Print(sentinelproxy.PassthroughInfo())
+	}
+	sentinelproxy.DialTimeout = c.Duration("dial-timeout")
+	sentinelproxy.ReadTimeout = c.Duration("read-timeout")
+	sentinelproxy.WriteTimeout = c.Duration("write-timeout")
+	sentinelproxy.IdleTimeout = c.Duration("idle-timeout")
+	sentinelproxy.MaxConns = c.Int("max-conns")
+	if sentinelproxy.MaxConns < 1 {
+		log.Fatal("--max-conns must be at least 1")
+	}
+	if sentinelproxy.IdleTimeout > 0 {
+		go sentinelproxy.ReapIdle()
+	}
 	for _, sa := range c.StringSlice("sentineladdr") {
 		log.Printf("adding managing sentinel %s", sa)
-		managingSentinels.Add(sa)
+		sentinelproxy.Sentinels.Add(sa)
+	}
+	sentinelproxy.CacheTTL = c.Duration("cache-ttl")
+	for _, sa := range sentinelproxy.Sentinels.List() {
+		sentinelproxy.Cache.Watch(sa)
+	}
+	sentinelproxy.ProbeInterval = c.Duration("probe-interval")
+	sentinelproxy.ForgetAfter = c.Duration("forget-after")
+	if sentinelproxy.ProbeInterval > 0 {
+		go sentinelproxy.Discover()
 	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
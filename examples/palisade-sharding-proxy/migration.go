@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	NoMigration      = errors.New("NOMIGRATION no resharding is in progress")
+	MigrationRunning = errors.New("MIGRATING a resharding is already in progress")
+
+	// migrationFile keeps the migration state, and the shard count a
+	// finished migration left, across restarts when set.
+	migrationFile string
+	migration     = &Migration{}
+)
+
+// Migration tracks a move from the current shard count to a new one. While
+// it runs, targets whose shard changes keep resolving to their old shard
+// until they are marked migrated, so clients find their data before, during
+// and after it moves.
+type Migration struct {
+	sync.RWMutex
+	Active   bool
+	Shards   int
+	Migrated map[string]bool
+	placer   Placer
+}
+
+type migrationState struct {
+	// Current is the shard count in use, which a finished migration
+	// changes from the one given with --shards.
+	Current  int
+	Shards   int      `json:",omitempty"`
+	Migrated []string `json:",omitempty"`
+}
+
+// Location is where a target resolves to and why.
+type Location struct {
+	Target string
+	Shard  int
+	// Slot is the target's hash under the placement algorithm.
+	Slot uint64
+	Pod  string
+	// Source is "override" for pinned targets, whose Shard is -1, "hash",
+	// or during a migration "migrated" for moved targets and "pending" for
+	// those still on their old shard.
+	Source string
+}
+
+// locate resolves a target to its shard, consulting the overrides first.
+func locate(target string) Location {
+	if pod, pinned := shardMap.Lookup(target); pinned {
+		return Location{Target: target, Shard: -1, Pod: pod, Source: "override"}
+	}
+	migration.RLock()
+	loc := Location{Target: target, Shard: placement.Shard(target), Slot: placement.Slot(target), Source: "hash"}
+	if migration.Active {
+		if next := migration.placer.Shard(target); next != loc.Shard {
+			if migration.Migrated[target] {
+				loc.Shard, loc.Source = next, "migrated"
+			} else {
+				loc.Source = "pending"
+			}
+		}
+	}
+	migration.RUnlock()
+	loc.Pod = podForShard(loc.Shard)
+	return loc
+}
+
+// Start begins a migration to shards shards.
+func (m *Migration) Start(shards int) error {
+	placer, err := NewPlacer(placementAlgo, weightsFor(shards))
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.Active {
+		return MigrationRunning
+	}
+	m.Active, m.Shards, m.placer = true, shards, placer
+	m.Migrated = make(map[string]bool)
+	return m.save()
+}
+
+// Mark records targets as moved, or not moved when migrated is false.
+func (m *Migration) Mark(targets []string, migrated bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.Active {
+		return NoMigration
+	}
+	for _, t := range targets {
+		if migrated {
+			m.Migrated[t] = true
+		} else {
+			delete(m.Migrated, t)
+		}
+	}
+	return m.save()
+}
+
+// Finish makes the new shard count the current one. That needs a
+// migrationFile to outlive a restart, which would otherwise go back to
+// --shards while the data sits on the new shards.
+func (m *Migration) Finish() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.Active {
+		return NoMigration
+	}
+	if migrationFile == "" {
+		return fmt.Errorf("ERR without --migration-file the new shard count would be lost on restart; restart with --shards %d instead", m.Shards)
+	}
+	placement, shardCount = m.placer, m.Shards
+	m.Active, m.Migrated, m.placer = false, nil, nil
+	log.Printf("resharding finished, now %d shards", shardCount)
+	return m.save()
+}
+
+// Abort forgets the migration; every target resolves as before it began.
+func (m *Migration) Abort() error {
+	m.Lock()
+	defer m.Unlock()
+	if !m.Active {
+		return NoMigration
+	}
+	m.Active, m.Migrated, m.placer = false, nil, nil
+	return m.save()
+}
+
+// save writes the shard count and the migration state to migrationFile. It
+// is called with the lock held.
+func (m *Migration) save() error {
+	if migrationFile == "" {
+		return nil
+	}
+	st := migrationState{Current: shardCount}
+	if m.Active {
+		st.Shards = m.Shards
+	}
+	for t := range m.Migrated {
+		st.Migrated = append(st.Migrated, t)
+	}
+	sort.Strings(st.Migrated)
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := migrationFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, migrationFile)
+}
+
+// loadMigration takes up the shard count saved in migrationFile, and
+// resumes the migration saved there.
+func loadMigration() error {
+	if migrationFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(migrationFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st migrationState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %v", migrationFile, err)
+	}
+	if st.Current != 0 && st.Current != shardCount {
+		current, err := NewPlacer(placementAlgo, weightsFor(st.Current))
+		if err != nil {
+			return err
+		}
+		log.Printf("using the %d shards a resharding left, not --shards %d", st.Current, shardCount)
+		placement, shardCount = current, st.Current
+	}
+	if st.Shards == 0 {
+		return nil
+	}
+	placer, err := NewPlacer(placementAlgo, weightsFor(st.Shards))
+	if err != nil {
+		return err
+	}
+	migration.Lock()
+	defer migration.Unlock()
+	migration.Active, migration.Shards, migration.placer = true, st.Shards, placer
+	migration.Migrated = make(map[string]bool)
+	for _, t := range st.Migrated {
+		migration.Migrated[t] = true
+	}
+	log.Printf("resuming resharding to %d shards, %d targets migrated", st.Shards, len(st.Migrated))
+	return nil
+}
+
+// reshardCommand plans and runs a change of shard count:
+//
+//	RESHARD PLAN <shards> <target> [target ...]
+//	RESHARD START <shards>
+//	RESHARD MIGRATED <target> [target ...]
+//	RESHARD UNMIGRATED <target> [target ...]
+//	RESHARD STATUS
+//	RESHARD FINISH
+//	RESHARD ABORT
+func reshardCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var targets []string
+	for i := 2; i < c.ArgCount(); i++ {
+		targets = append(targets, string(c.Get(i)))
+	}
+	var err error
+	switch subcomm {
+	case "PLAN":
+		return reshardPlan(w, targets)
+	case "START":
+		shards, perr := strconv.Atoi(string(c.Get(2)))
+		if perr != nil {
+			return SendError(w, ExpectNumber.Error())
+		}
+		err = migration.Start(shards)
+	case "MIGRATED", "UNMIGRATED":
+		if len(targets) == 0 {
+			return SendError(w, fmt.Sprintf("ERR wrong number of arguments for 'reshard %s' command", strings.ToLower(subcomm)))
+		}
+		err = migration.Mark(targets, subcomm == "MIGRATED")
+	case "STATUS":
+		return reshardStatus(w)
+	case "FINISH":
+		err = migration.Finish()
+	case "ABORT":
+		err = migration.Abort()
+	default:
+		return SendError(w, fmt.Sprintf("Command 'RESHARD %s' not supported", subcomm))
+	}
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
+}
+
+// reshardPlan lists the given targets that would move with a new shard
+// count, each as target, old pod, new pod.
+func reshardPlan(w *bufio.Writer, args []string) error {
+	if len(args) < 2 {
+		return SendError(w, "ERR wrong number of arguments for 'reshard plan' command")
+	}
+	shards, err := strconv.Atoi(args[0])
+	if err != nil {
+		return SendError(w, ExpectNumber.Error())
+	}
+	next, err := NewPlacer(placementAlgo, weightsFor(shards))
+	if err != nil {
+		return SendError(w, "ERR "+err.Error())
+	}
+	moves := [][]string{}
+	migration.RLock()
+	defer migration.RUnlock()
+	for _, target := range args[1:] {
+		if _, pinned := shardMap.Lookup(target); pinned {
+			continue
+		}
+		from, to := placement.Shard(target), next.Shard(target)
+		if from != to {
+			moves = append(moves, []string{target, podForShard(from), podForShard(to)})
+		}
+	}
+	return SendBulkStringArrays(w, moves)
+}
+
+func reshardStatus(w *bufio.Writer) error {
+	migration.RLock()
+	defer migration.RUnlock()
+	status := []string{"shards", strconv.Itoa(shardCount), "migrating", "0"}
+	if migration.Active {
+		status = []string{
+			"shards", strconv.Itoa(shardCount),
+			"migrating", "1",
+			"new-shards", strconv.Itoa(migration.Shards),
+			"migrated-targets", strconv.Itoa(len(migration.Migrated)),
+		}
+	}
+	return SendBulkStrings(w, status)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withShards places targets on shards shards with modulo, keeping the
+// migration state in file, and puts everything back after the test.
+func withShards(t *testing.T, shards int, file string) {
+	oldPlacement, oldAlgo, oldCount := placement, placementAlgo, shardCount
+	oldMigration, oldFile := migration, migrationFile
+	t.Cleanup(func() {
+		placement, placementAlgo, shardCount = oldPlacement, oldAlgo, oldCount
+		migration, migrationFile = oldMigration, oldFile
+	})
+	var err error
+	placementAlgo, shardCount, migrationFile = "modulo", shards, file
+	if placement, err = NewPlacer(placementAlgo, weightsFor(shards)); err != nil {
+		t.Fatal(err)
+	}
+	migration = &Migration{}
+}
+
+// moving finds a target that changes shard going from 4 to 5 shards.
+func moving(t *testing.T) string {
+	from, _ := NewPlacer("modulo", equalWeights(4))
+	to, _ := NewPlacer("modulo", equalWeights(5))
+	for _, target := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if from.Shard(target) != to.Shard(target) {
+			return target
+		}
+	}
+	t.Fatal("no target moves")
+	return ""
+}
+
+func TestFinishNeedsMigrationFile(t *testing.T) {
+	withShards(t, 4, "")
+	if err := migration.Start(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.Finish(); err == nil {
+		t.Fatal("FINISH without a migration file was accepted")
+	}
+	if shardCount != 4 || !migration.Active {
+		t.Errorf("a refused FINISH changed the layout to %d shards", shardCount)
+	}
+}
+
+func TestFinishedLayoutSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "migration.json")
+	target := moving(t)
+
+	withShards(t, 4, file)
+	before := locate(target)
+	if err := migration.Start(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.Mark([]string{target}, true); err != nil {
+		t.Fatal(err)
+	}
+	migrated := locate(target)
+	if migrated.Source != "migrated" || migrated.Shard == before.Shard {
+		t.Fatalf("a migrated target resolved to %+v", migrated)
+	}
+	if err := migration.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting with the old --shards keeps the finished layout.
+	withShards(t, 4, file)
+	if err := loadMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if shardCount != 5 || migration.Active {
+		t.Errorf("after a restart there are %d shards, migrating %t", shardCount, migration.Active)
+	}
+	if loc := locate(target); loc.Shard != migrated.Shard || loc.Source != "hash" {
+		t.Errorf("after a restart %s resolves to %+v, want shard %d", target, loc, migrated.Shard)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	NoSuchOverride = errors.New("NOSUCHOVERRIDE no override for that pattern")
+
+	// shardMapFile keeps the overrides across restarts when set.
+	shardMapFile string
+	shardMap     = &ShardMap{}
+)
+
+// Override kinds.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+// Override pins the targets matching Pattern to a pod of their own.
+type Override struct {
+	Pattern string
+	Kind    string
+	Pod     string
+	re      *regexp.Regexp
+}
+
+// ShardMap holds the overrides, which are consulted before hashing: exact
+// names first, then the longest matching prefix, then regular expressions
+// in the order they were added.
+type ShardMap struct {
+	sync.RWMutex
+	overrides []Override
+}
+
+func newOverride(pattern, kind, pod string) (Override, error) {
+	o := Override{Pattern: pattern, Kind: strings.ToLower(kind), Pod: pod}
+	switch o.Kind {
+	case MatchExact, MatchPrefix:
+	case MatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return o, fmt.Errorf("ERR invalid regex: %v", err)
+		}
+		o.re = re
+	default:
+		return o, fmt.Errorf("ERR match must be EXACT, PREFIX or REGEX")
+	}
+	return o, nil
+}
+
+// Lookup returns the pod a target is pinned to, if any.
+func (m *ShardMap) Lookup(target string) (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	prefix := ""
+	pod := ""
+	for _, o := range m.overrides {
+		switch o.Kind {
+		case MatchExact:
+			if o.Pattern == target {
+				return o.Pod, true
+			}
+		case MatchPrefix:
+			if strings.HasPrefix(target, o.Pattern) && len(o.Pattern) >= len(prefix) {
+				prefix, pod = o.Pattern, o.Pod
+			}
+		}
+	}
+	if pod != "" {
+		return pod, true
+	}
+	for _, o := range m.overrides {
+		if o.Kind == MatchRegex && o.re.MatchString(target) {
+			return o.Pod, true
+		}
+	}
+	return "", false
+}
+
+// Set adds an override or replaces the one with the same pattern and kind.
+// The overrides only change once they are saved.
+func (m *ShardMap) Set(o Override) error {
+	m.Lock()
+	defer m.Unlock()
+	next := append([]Override(nil), m.overrides...)
+	replaced := false
+	for i := range next {
+		if next[i].Pattern == o.Pattern && next[i].Kind == o.Kind {
+			next[i] = o
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		next = append(next, o)
+	}
+	if err := saveShardMap(next); err != nil {
+		return err
+	}
+	m.overrides = next
+	return nil
+}
+
+// Del removes the overrides with the given pattern. The overrides only
+// change once they are saved.
+func (m *ShardMap) Del(pattern string) error {
+	m.Lock()
+	defer m.Unlock()
+	kept := []Override{}
+	for _, o := range m.overrides {
+		if o.Pattern != pattern {
+			kept = append(kept, o)
+		}
+	}
+	if len(kept) == len(m.overrides) {
+		return NoSuchOverride
+	}
+	if err := saveShardMap(kept); err != nil {
+		return err
+	}
+	m.overrides = kept
+	return nil
+}
+
+// List returns the overrides sorted by kind and pattern.
+func (m *ShardMap) List() []Override {
+	m.RLock()
+	defer m.RUnlock()
+	list := append([]Override(nil), m.overrides...)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Kind != MatchRegex && list[i].Pattern < list[j].Pattern
+	})
+	return list
+}
+
+// saveShardMap writes overrides to shardMapFile.
+func saveShardMap(overrides []Override) error {
+	if shardMapFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := shardMapFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, shardMapFile)
+}
+
+// loadShardMap reads the overrides saved in shardMapFile.
+func loadShardMap() error {
+	if shardMapFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(shardMapFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Override
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", shardMapFile, err)
+	}
+	var overrides []Override
+	for _, s := range saved {
+		o, err := newOverride(s.Pattern, s.Kind, s.Pod)
+		if err != nil {
+			return fmt.Errorf("%s: '%s': %v", shardMapFile, s.Pattern, err)
+		}
+		overrides = append(overrides, o)
+	}
+	shardMap.Lock()
+	shardMap.overrides = overrides
+	shardMap.Unlock()
+	return nil
+}
+
+// shardMapCommand edits the overrides:
+//
+//	SHARDMAP SET <pattern> <pod> [EXACT|PREFIX|REGEX]
+//	SHARDMAP DEL <pattern>
+//	SHARDMAP LIST
+func shardMapCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var err error
+	switch subcomm {
+	case "SET":
+		pattern, pod := string(c.Get(2)), string(c.Get(3))
+		if pattern == "" || pod == "" {
+			return SendError(w, "ERR wrong number of arguments for 'shardmap set' command")
+		}
+		kind := MatchExact
+		if c.ArgCount() > 4 {
+			kind = string(c.Get(4))
+		}
+		o, oerr := newOverride(pattern, kind, pod)
+		if oerr != nil {
+			return SendError(w, oerr.Error())
+		}
+		err = shardMap.Set(o)
+	case "DEL":
+		err = shardMap.Del(string(c.Get(2)))
+	case "LIST":
+		var list [][]string
+		for _, o := range shardMap.List() {
+			list = append(list, []string{o.Pattern, o.Kind, o.Pod})
+		}
+		return SendBulkStringArrays(w, list)
+	default:
+		return SendError(w, fmt.Sprintf("Command 'SHARDMAP %s' not supported", subcomm))
+	}
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
+}
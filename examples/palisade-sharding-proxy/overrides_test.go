@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShardMapUnchangedWhenSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-shardmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { shardMapFile = file }(shardMapFile)
+	shardMapFile = filepath.Join(dir, "shardmap.json")
+
+	m := &ShardMap{}
+	for _, pattern := range []string{"big-a", "big-b", "big-c"} {
+		o, _ := newOverride(pattern, MatchExact, pattern+"-pod")
+		if err := m.Set(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := m.List()
+
+	// Nothing can be saved into a directory that is gone.
+	shardMapFile = filepath.Join(dir, "gone", "shardmap.json")
+	o, _ := newOverride("big-a", MatchExact, "elsewhere")
+	if err := m.Set(o); err == nil {
+		t.Error("SET succeeded without saving")
+	}
+	o, _ = newOverride("big-d", MatchExact, "big-d-pod")
+	if err := m.Set(o); err == nil {
+		t.Error("SET of a new pattern succeeded without saving")
+	}
+	if err := m.Del("big-a"); err == nil {
+		t.Error("DEL succeeded without saving")
+	}
+	if after := m.List(); !reflect.DeepEqual(after, before) {
+		t.Errorf("failed saves changed the overrides from %v to %v", before, after)
+	}
+	if pod, _ := m.Lookup("big-c"); pod != "big-c-pod" {
+		t.Errorf("big-c is pinned to %q after a failed DEL", pod)
+	}
+}
@@ -8,16 +8,31 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
 )
 
+// Session is a client connection.
+type Session struct {
+	Addr string
+}
+
+// tokenHash is the SHA-256 hash tokens are kept as.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func authConnection(c *Command, w *bufio.Writer) error {
 	token := string(c.Get(1))
-	valid, exists := tokens[token]
+	valid, exists := tokens[tokenHash(token)]
 	if exists && valid {
 		return nil
 	}
@@ -26,22 +41,47 @@ func authConnection(c *Command, w *bufio.Writer) error {
 
 func addSentinel(c *Command, w *bufio.Writer) error {
 	sa := string(c.Get(1))
-	managingSentinels.Add(sa)
+	sentinelproxy.Sentinels.Add(sa)
+	sentinelproxy.Cache.Watch(sa)
 	return SendOk(w)
 }
 
+// knownSentinels reports every managing sentinel and its health:
+// KNOWNSENTINELS
 func knownSentinels(c *Command, w *bufio.Writer) error {
-	var sentinels []string
-	for s, _ := range managingSentinels {
-		sentinels = append(sentinels, s)
+	return SendBulkStringArrays(w, sentinelproxy.KnownSentinels())
+}
+
+// poolStats reports the connection pool of every managing sentinel:
+// POOLSTATS
+func poolStats(c *Command, w *bufio.Writer) error {
+	return SendBulkStringArrays(w, sentinelproxy.PoolStats())
+}
+
+// info reports the proxy's state: INFO
+func info(c *Command, w *bufio.Writer) error {
+	lines := append([]string{"# Cache"}, sentinelproxy.Cache.Info()...)
+	return SendBulkString(w, strings.Join(lines, "\r\n")+"\r\n")
+}
+
+// passthroughCommand relays a command to a managing sentinel and sends its
+// reply back to the client byte for byte.
+func passthroughCommand(c *Command, w *bufio.Writer) error {
+	raw, err := sentinelproxy.Relay(c)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
 	}
-	return SendBulkStrings(w, sentinels)
+	return w.Flush()
 }
 
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	parser := NewParser(conn)
 	w := bufio.NewWriter(conn)
+	session := &Session{Addr: conn.RemoteAddr().String()}
 	authorized := false
 	authfails := 0
 	maxauths := 3
@@ -59,6 +99,7 @@ func handleConnection(conn net.Conn) {
 				break
 			}
 		} else {
+			command.Session = session
 			cmd := strings.ToUpper(string(command.Get(0)))
 			if cmd == "QUIT" {
 				conn.Close()
@@ -107,6 +148,8 @@ func handleConnection(conn net.Conn) {
 			handler, exists := commandHandlers[cmd]
 			if exists {
 				ew = handler(command, w)
+			} else if sentinelproxy.PassthroughAllowed(command) {
+				ew = passthroughCommand(command, w)
 			} else {
 				log.Printf("unsupported command: %s", cmd)
 				var args []string
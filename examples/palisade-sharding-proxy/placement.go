@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// placement maps targets to shards; shardCount and shardName describe
+	// the shards it was built for.
+	placement     Placer
+	placementAlgo = "modulo"
+	shardCount    = 4
+	// shardWeights is the configured weight of each shard, by index. Shards
+	// without one weigh 1.
+	shardWeights []int
+	// shardName names a shard's pod, {index} being its number.
+	shardName = "shard-{index}"
+
+	// KetamaPoints is how many points on the ring each unit of weight gets.
+	KetamaPoints = 160
+	// MaxShardWeight bounds a shard's weight.
+	MaxShardWeight = 1000
+
+	placementAlgorithms = []string{"modulo", "ketama", "jump", "rendezvous"}
+)
+
+// Placer picks the shard, numbered from 0, a target lives on. Slot is the
+// hash of the target the shard is picked from, which doesn't depend on the
+// shard count.
+type Placer interface {
+	Shard(target string) int
+	Slot(target string) uint64
+}
+
+// NewPlacer builds the placement algorithm called algo for shards with the
+// given weights, one per shard. Each shard gets a share of the targets
+// proportional to its weight; a shard weighing 0 gets none.
+func NewPlacer(algo string, weights []int) (Placer, error) {
+	if len(weights) < 1 {
+		return nil, fmt.Errorf("a shard count of %d is not valid", len(weights))
+	}
+	total := 0
+	for shard, weight := range weights {
+		if weight < 0 || weight > MaxShardWeight {
+			return nil, fmt.Errorf("shard %d has a weight of %d, it must be between 0 and %d", shard, weight, MaxShardWeight)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("at least one shard needs a weight above 0")
+	}
+	switch strings.ToLower(algo) {
+	case "modulo":
+		return moduloPlacer(bucketTable(weights)), nil
+	case "ketama":
+		return newKetamaPlacer(weights), nil
+	case "jump":
+		return jumpPlacer(bucketTable(weights)), nil
+	case "rendezvous":
+		return rendezvousPlacer(weights), nil
+	}
+	return nil, fmt.Errorf("unknown placement algorithm '%s', use one of %s", algo, strings.Join(placementAlgorithms, ", "))
+}
+
+// equalWeights weighs shards shards the same.
+func equalWeights(shards int) []int {
+	weights := make([]int, shards)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return weights
+}
+
+// weightsFor is the configured weight of each of shards shards.
+func weightsFor(shards int) []int {
+	weights := equalWeights(shards)
+	copy(weights, shardWeights)
+	return weights
+}
+
+// parseWeights reads a comma separated list of weights, the first being
+// shard 0's, as given to --shard-weights.
+func parseWeights(spec string) ([]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var weights []int
+	for _, field := range strings.Split(spec, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid shard weight", field)
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+// bucketTable gives each shard as many consecutive buckets as its weight,
+// shard 0's first. Adding shards, or weight to the last shard, appends
+// buckets, so jump only moves targets onto the new buckets. Changing the
+// weight of any other shard shifts the buckets of every shard after it,
+// and jump then moves targets between shards whose weights didn't change.
+func bucketTable(weights []int) []int {
+	var buckets []int
+	for shard, weight := range weights {
+		for i := 0; i < weight; i++ {
+			buckets = append(buckets, shard)
+		}
+	}
+	return buckets
+}
+
+// podForShard names the pod holding a shard.
+func podForShard(shard int) string {
+	return strings.Replace(shardName, "{index}", strconv.Itoa(shard), -1)
+}
+
+func fnv32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func fnv64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// moduloPlacer is the original fnv32a modulo shard count, taken over a
+// bucket per unit of weight. Changing the shard count moves almost every
+// target.
+type moduloPlacer []int
+
+func (m moduloPlacer) Shard(target string) int {
+	return m[fnv32(target)%uint32(len(m))]
+}
+
+func (m moduloPlacer) Slot(target string) uint64 {
+	return uint64(fnv32(target))
+}
+
+// ketamaPlacer is a hash ring with KetamaPoints virtual nodes per unit of
+// a shard's weight, laid out the way libketama does.
+type ketamaPlacer struct {
+	points []uint32
+	shards map[uint32]int
+}
+
+func newKetamaPlacer(weights []int) *ketamaPlacer {
+	k := &ketamaPlacer{shards: make(map[uint32]int)}
+	for shard, weight := range weights {
+		for v := 0; v < KetamaPoints*weight/4; v++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%d-%d", shard, v)))
+			for i := 0; i < 4; i++ {
+				point := binary.LittleEndian.Uint32(digest[i*4:])
+				if _, taken := k.shards[point]; taken {
+					continue
+				}
+				k.shards[point] = shard
+				k.points = append(k.points, point)
+			}
+		}
+	}
+	sort.Slice(k.points, func(i, j int) bool { return k.points[i] < k.points[j] })
+	return k
+}
+
+func (k *ketamaPlacer) Shard(target string) int {
+	h := uint32(k.Slot(target))
+	i := sort.Search(len(k.points), func(i int) bool { return k.points[i] >= h })
+	if i == len(k.points) {
+		i = 0
+	}
+	return k.shards[k.points[i]]
+}
+
+// Slot is the target's point on the ring.
+func (k *ketamaPlacer) Slot(target string) uint64 {
+	digest := md5.Sum([]byte(target))
+	return uint64(binary.LittleEndian.Uint32(digest[:4]))
+}
+
+// jumpPlacer is Lamping and Veach's jump consistent hash over a bucket per
+// unit of weight. Shards can only be added or removed at the end.
+type jumpPlacer []int
+
+func (j jumpPlacer) Shard(target string) int {
+	key := fnv64(target)
+	b, next := int64(-1), int64(0)
+	for next < int64(len(j)) {
+		b = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return j[b]
+}
+
+func (j jumpPlacer) Slot(target string) uint64 {
+	return fnv64(target)
+}
+
+// rendezvousPlacer gives each target to the shard scoring highest for it,
+// so removing any shard only moves the targets that were on it. Scores are
+// weighted as in Schindelhauer and Schomaker's weighted distributed hash
+// tables: weight / -ln(hash), the hash scaled into (0, 1).
+type rendezvousPlacer []int
+
+func (r rendezvousPlacer) Shard(target string) int {
+	best, bestScore := 0, -1.0
+	for shard, weight := range r {
+		h := mix64(fnv64(target) ^ fnv64(strconv.Itoa(shard)))
+		u := (float64(h>>11) + 0.5) / (1 << 53)
+		score := float64(weight) / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = shard, score
+		}
+	}
+	return best
+}
+
+func (r rendezvousPlacer) Slot(target string) uint64 {
+	return fnv64(target)
+}
+
+// mix64 is the splitmix64 finaliser, spreading similar hashes apart.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const movementSamples = 20000
+
+// movement places movementSamples targets with algo before and after a
+// change of weights, returning the share that moved and how many moved to
+// each shard.
+func movement(t *testing.T, algo string, before, after []int) (float64, map[int]int) {
+	t.Helper()
+	from, err := NewPlacer(algo, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := NewPlacer(algo, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	destinations := make(map[int]int)
+	for i := 0; i < movementSamples; i++ {
+		target := fmt.Sprintf("target-%d", i)
+		if a, b := from.Shard(target), to.Shard(target); a != b {
+			moved++
+			destinations[b]++
+		}
+	}
+	return float64(moved) / movementSamples, destinations
+}
+
+func TestMovementAddingShards(t *testing.T) {
+	for _, tc := range []struct {
+		algo     string
+		min, max float64
+	}{
+		{"modulo", 0.75, 0.85},
+		{"ketama", 0.14, 0.26},
+		{"jump", 0.18, 0.22},
+		{"rendezvous", 0.18, 0.22},
+	} {
+		ratio, destinations := movement(t, tc.algo, equalWeights(4), equalWeights(5))
+		if ratio < tc.min || ratio > tc.max {
+			t.Errorf("%s moved %.1f%% of targets going from 4 to 5 shards, want %.0f%% to %.0f%%", tc.algo, ratio*100, tc.min*100, tc.max*100)
+		}
+		if tc.algo != "modulo" && (len(destinations) != 1 || destinations[4] == 0) {
+			t.Errorf("%s moved targets between existing shards: %v", tc.algo, destinations)
+		}
+	}
+}
+
+func TestMovementChangingWeights(t *testing.T) {
+	// Weight added to the last shard only moves targets onto it.
+	for _, algo := range []string{"ketama", "jump", "rendezvous"} {
+		ratio, destinations := movement(t, algo, []int{1, 1, 1, 1}, []int{1, 1, 1, 2})
+		if ratio > 0.26 || len(destinations) != 1 || destinations[3] == 0 {
+			t.Errorf("%s moved %.1f%% of targets to %v when shard 3 grew", algo, ratio*100, destinations)
+		}
+	}
+	// Elsewhere, jump's consecutive buckets move targets between shards
+	// whose weights stayed the same, while ketama and rendezvous don't.
+	for _, algo := range []string{"ketama", "rendezvous"} {
+		_, destinations := movement(t, algo, []int{1, 1, 1, 1}, []int{2, 1, 1, 1})
+		if len(destinations) != 1 || destinations[0] == 0 {
+			t.Errorf("%s moved targets to %v when shard 0 grew", algo, destinations)
+		}
+	}
+	if _, destinations := movement(t, "jump", []int{1, 1, 1, 1}, []int{2, 1, 1, 1}); len(destinations) == 1 {
+		t.Errorf("jump only moved targets to the grown shard, unlike bucketTable says")
+	}
+}
+
+func TestWeightedShares(t *testing.T) {
+	weights := []int{1, 3, 0, 4}
+	for _, algo := range placementAlgorithms {
+		p, err := NewPlacer(algo, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make([]int, len(weights))
+		for i := 0; i < movementSamples; i++ {
+			counts[p.Shard(fmt.Sprintf("target-%d", i))]++
+		}
+		for shard, weight := range weights {
+			share := float64(counts[shard]) / movementSamples
+			want := float64(weight) / 8
+			if share < want-0.05 || share > want+0.05 {
+				t.Errorf("%s gave shard %d (weight %d) %.1f%% of targets, want about %.1f%%", algo, shard, weight, share*100, want*100)
+			}
+		}
+	}
+}
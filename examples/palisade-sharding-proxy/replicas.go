@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/resp"
+)
+
+var (
+	// ReplicaStrategy is how a replica is chosen when the client doesn't
+	// say: random, least-lag or zone.
+	ReplicaStrategy = "random"
+	// localZone is the zone the zone strategy prefers, and zoneSubnets the
+	// subnets making up each zone.
+	localZone   string
+	zoneSubnets = make(map[string][]*net.IPNet)
+
+	replicaStrategies = []string{"random", "least-lag", "zone"}
+)
+
+// Replica is a replica as a managing sentinel describes it.
+type Replica struct {
+	Host, Port string
+	Flags      string
+	LinkStatus string
+	Offset     int64
+}
+
+// Healthy is true for replicas the sentinel sees up and in sync with the
+// master.
+func (r Replica) Healthy() bool {
+	for _, flag := range strings.Split(r.Flags, ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	return r.LinkStatus == "" || r.LinkStatus == "ok"
+}
+
+// Zone is the zone whose subnets hold the replica, or "".
+func (r Replica) Zone() string {
+	ip := net.ParseIP(r.Host)
+	if ip == nil {
+		return ""
+	}
+	for zone, subnets := range zoneSubnets {
+		for _, subnet := range subnets {
+			if subnet.Contains(ip) {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+// parseZoneSubnets reads --zone-subnet values written as zone=cidr.
+func parseZoneSubnets(specs []string) error {
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("'%s' is not written as zone=cidr", spec)
+		}
+		_, subnet, err := net.ParseCIDR(parts[1])
+		if err != nil {
+			return err
+		}
+		zoneSubnets[parts[0]] = append(zoneSubnets[parts[0]], subnet)
+	}
+	return nil
+}
+
+// getReplicas asks the managing sentinels for a pod's replicas, taking the
+// first answer. Sentinels older than Redis 5 only know SENTINEL SLAVES.
+func getReplicas(pod string) ([]Replica, error) {
+	var lastErr error
+	for _, sa := range sentinelproxy.Usable() {
+		reply, err := sentinelproxy.PoolFor(sa).Do("SENTINEL", "REPLICAS", pod)
+		if rerr, ok := err.(resp.Error); ok && strings.Contains(strings.ToLower(string(rerr)), "unknown") {
+			reply, err = sentinelproxy.PoolFor(sa).Do("SENTINEL", "SLAVES", pod)
+		}
+		if err != nil {
+			log.Printf("[%s] error: %s", sa, err.Error())
+			lastErr = err
+			continue
+		}
+		list, ok := reply.([]interface{})
+		if !ok {
+			lastErr = resp.UnexpectedReply
+			continue
+		}
+		var replicas []Replica
+		for _, entry := range list {
+			fields, err := resp.Strings(entry)
+			if err != nil {
+				return nil, err
+			}
+			offset, _ := strconv.ParseInt(sentinelproxy.FieldValue(fields, "slave-repl-offset"), 10, 64)
+			replicas = append(replicas, Replica{
+				Host:       sentinelproxy.FieldValue(fields, "ip"),
+				Port:       sentinelproxy.FieldValue(fields, "port"),
+				Flags:      sentinelproxy.FieldValue(fields, "flags"),
+				LinkStatus: sentinelproxy.FieldValue(fields, "master-link-status"),
+				Offset:     offset,
+			})
+		}
+		return replicas, nil
+	}
+	return nil, lastErr
+}
+
+// chooseReplica picks one of the healthy replicas with strategy, the zone
+// strategy being written "zone" or "zone:<name>". It returns false when
+// there is no healthy replica.
+func chooseReplica(replicas []Replica, strategy string) (Replica, bool) {
+	var healthy []Replica
+	for _, r := range replicas {
+		if r.Healthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return Replica{}, false
+	}
+	switch {
+	case strategy == "least-lag":
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.Offset > best.Offset {
+				best = r
+			}
+		}
+		return best, true
+	case strategy == "zone" || strings.HasPrefix(strategy, "zone:"):
+		zone := localZone
+		if strings.HasPrefix(strategy, "zone:") {
+			zone = strategy[len("zone:"):]
+		}
+		var local []Replica
+		for _, r := range healthy {
+			if zone != "" && r.Zone() == zone {
+				local = append(local, r)
+			}
+		}
+		if len(local) > 0 {
+			healthy = local
+		}
+	}
+	return healthy[rand.Intn(len(healthy))], true
+}
+
+func validReplicaStrategy(strategy string) bool {
+	if strings.HasPrefix(strategy, "zone:") {
+		return true
+	}
+	for _, s := range replicaStrategies {
+		if strategy == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sentinelGetReplicaAddressByName returns a healthy replica of the target's
+// pod, or its master when it has none:
+//
+//	SENTINEL GET-REPLICA-ADDR-BY-NAME <target> [random|least-lag|zone[:<name>]]
+func sentinelGetReplicaAddressByName(c *Command, w *bufio.Writer) error {
+	name := string(c.Get(2))
+	if name == "" {
+		return SendError(w, "ERR wrong number of arguments for 'sentinel get-replica-addr-by-name' command")
+	}
+	strategy := ReplicaStrategy
+	if c.ArgCount() > 3 {
+		strategy = strings.ToLower(string(c.Get(3)))
+	}
+	if !validReplicaStrategy(strategy) {
+		return SendError(w, fmt.Sprintf("ERR unknown replica strategy '%s', use one of %s", strategy, strings.Join(replicaStrategies, ", ")))
+	}
+	loc := locate(name)
+	countLookup(loc)
+	replicas, err := getReplicas(loc.Pod)
+	if err != nil {
+		log.Printf("no replicas for '%s' on %s: %v", name, loc.Pod, err)
+	}
+	if r, found := chooseReplica(replicas, strategy); found {
+		return SendBulkStrings(w, []string{r.Host, r.Port})
+	}
+	log.Printf("no healthy replica of %s for target '%s', returning the master", loc.Pod, name)
+	pod, found, err := proxy.LookupMaster(loc.Pod)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if !found {
+		return SendError(w, fmt.Sprintf("-ERR No target for '%s'", name))
+	}
+	return SendBulkStrings(w, []string{pod.IP, pod.Port})
+}
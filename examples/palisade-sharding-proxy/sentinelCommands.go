@@ -3,35 +3,37 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"hash/fnv"
 	"log"
-	"math"
 	"strings"
 
-	"github.com/fatih/structs"
-	"github.com/therealbill/libredis/client"
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+	"github.com/therealbill/palisade/sentinel"
 )
 
 var (
 	sentinelSubcommands map[string]CommandHandler
-	slotcount           float64
 )
 
 func init() {
 	sentinelSubcommands = make(map[string]CommandHandler)
 	sentinelSubcommands["MASTER"] = sentinelGetMasterByName
 	sentinelSubcommands["GET-MASTER-ADDR-BY-NAME"] = sentinelGetMasterAddressByName
-	// make configurable?
-	slotcount = 4
+	sentinelSubcommands["GET-REPLICA-ADDR-BY-NAME"] = sentinelGetReplicaAddressByName
 }
 
-func getShardId(key string) (string, error) {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	num := float64(h.Sum32())
-	slotnum := math.Mod(num, slotcount)
-	log.Print(key, "->", slotnum)
-	return fmt.Sprintf("shard-%d", int(slotnum)), nil
+var (
+	// proxy asks the managing sentinels about pods, and backend places
+	// targets on their pods in front of it.
+	proxy                    = sentinelproxy.NewBackend()
+	backend sentinel.Backend = &sentinel.ShardingBackend{Next: proxy, Place: placeTarget}
+)
+
+// placeTarget is the pod holding a target, counting the lookup.
+func placeTarget(target string) string {
+	loc := locate(target)
+	countLookup(loc)
+	log.Print(target, "->", loc.Shard, " slot ", loc.Slot, " (", loc.Source, ")")
+	return loc.Pod
 }
 
 func Sentinel(c *Command, w *bufio.Writer) error {
@@ -39,6 +41,8 @@ func Sentinel(c *Command, w *bufio.Writer) error {
 	handler, exists := sentinelSubcommands[subcomm]
 	if exists {
 		return handler(c, w)
+	} else if sentinelproxy.PassthroughAllowed(c) {
+		return passthroughCommand(c, w)
 	} else {
 		return SendError(w, fmt.Sprintf("Command '%s' not supported", subcomm))
 	}
@@ -47,46 +51,27 @@ func Sentinel(c *Command, w *bufio.Writer) error {
 
 func sentinelGetMasterAddressByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	shardid, _ := getShardId(name)
-	log.Print(shardid)
-	var minfo []string
-	for sa, _ := range managingSentinels {
-		sc, err := client.DialAddress(sa)
-		if err == nil {
-			res, _ := sc.SentinelGetMaster(shardid)
-			if res.Host > "" {
-				minfo = append(minfo, res.Host)
-				minfo = append(minfo, fmt.Sprintf("%d", res.Port))
-				return SendBulkStrings(w, minfo)
-			}
-			log.Printf("[%s] no such pod", sa)
-			continue
-		}
-		log.Printf("[%s] error: %s", sa, err.Error())
+	pod, found, err := backend.LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
 	}
-	log.Printf("Shard for target '%s' not found anywhere, return error", name)
-	return SendError(w, fmt.Sprintf("-ERR No target for '%s'", name))
+	if !found {
+		log.Printf("Shard for target '%s' not found anywhere, return error", name)
+		return SendError(w, fmt.Sprintf("-ERR No target for '%s'", name))
+	}
+	return SendBulkStrings(w, []string{pod.IP, pod.Port})
 }
 
+// sentinelGetMasterByName returns the details of the target's pod, adding
+// "placement" to say whether an override or the hash chose it.
 func sentinelGetMasterByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	shardid, _ := getShardId(name)
-	var minfo []string
-	for sa, _ := range managingSentinels {
-		sc, err := client.DialAddress(sa)
-		if err == nil {
-			res, err := sc.SentinelMaster(shardid)
-			if res.Name > "" {
-				m := structs.Fields(res)
-				for _, v := range m {
-					minfo = append(minfo, v.Tag("redis"))
-					minfo = append(minfo, fmt.Sprintf("%v", v.Value()))
-				}
-			}
-			if err != nil {
-				log.Printf("[%s] error: %s", sc, err.Error())
-			}
-		}
+	pod, found, err := backend.LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if !found {
+		return SendBulkStrings(w, nil)
 	}
-	return SendBulkStrings(w, minfo)
+	return SendBulkStrings(w, append(sentinel.PodInfo(pod), "placement", locate(name).Source))
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/therealbill/palisade/examples/sentinelproxy"
+)
+
+// shardOf reports where each target lives, resolving its master too:
+//
+//	SHARDOF <target> [target ...]
+//
+// Each target gets target, shard, slot, placement, pod and master fields.
+// Pinned targets have shard -1 and no slot, and master is empty when no
+// sentinel knows the pod.
+func shardOf(c *Command, w *bufio.Writer) error {
+	if c.ArgCount() < 2 {
+		return SendError(w, "ERR wrong number of arguments for 'shardof' command")
+	}
+	var replies [][]string
+	for i := 1; i < c.ArgCount(); i++ {
+		loc := locate(string(c.Get(i)))
+		slot := ""
+		if loc.Shard >= 0 {
+			slot = strconv.FormatUint(loc.Slot, 10)
+		}
+		master := ""
+		if pod, found, err := proxy.LookupMaster(loc.Pod); err == nil && found {
+			master = net.JoinHostPort(pod.IP, pod.Port)
+		}
+		replies = append(replies, []string{
+			"target", loc.Target,
+			"shard", strconv.Itoa(loc.Shard),
+			"slot", slot,
+			"placement", loc.Source,
+			"pod", loc.Pod,
+			"master", master,
+		})
+	}
+	return SendBulkStringArrays(w, replies)
+}
+
+// shards reports every shard and the state of the pod behind it:
+//
+//	SHARDS
+//
+// During a resharding the shards of both layouts are listed, with state
+// "adding" for shards only in the new one and "removing" for those only in
+// the old one. Status is "ok", "sdown" or "odown" as the managing sentinels
+// see the pod, or "unknown" when none of them knows it.
+func shards(c *Command, w *bufio.Writer) error {
+	migration.RLock()
+	current, next := shardCount, shardCount
+	if migration.Active {
+		next = migration.Shards
+	}
+	migration.RUnlock()
+	var replies [][]string
+	for shard := 0; shard < current || shard < next; shard++ {
+		state := "active"
+		switch {
+		case shard >= current:
+			state = "adding"
+		case shard >= next:
+			state = "removing"
+		}
+		pod := podForShard(shard)
+		replies = append(replies, append([]string{
+			"shard", strconv.Itoa(shard),
+			"state", state,
+		}, podStatus(pod)...))
+	}
+	return SendBulkStringArrays(w, replies)
+}
+
+// podStatus describes a pod from the first managing sentinel that knows it.
+func podStatus(pod string) []string {
+	status := []string{"pod", pod, "status", "unknown", "master", "", "flags", "", "replicas", "", "sentinels", ""}
+	for _, sa := range sentinelproxy.Usable() {
+		fields, err := sentinelproxy.GetMaster(sa, pod)
+		if err != nil || len(fields) == 0 {
+			continue
+		}
+		flags := sentinelproxy.FieldValue(fields, "flags")
+		state := "ok"
+		switch {
+		case strings.Contains(flags, "o_down"):
+			state = "odown"
+		case strings.Contains(flags, "s_down"):
+			state = "sdown"
+		}
+		sentinels := 1
+		if n, err := strconv.Atoi(sentinelproxy.FieldValue(fields, "num-other-sentinels")); err == nil {
+			sentinels += n
+		}
+		return []string{
+			"pod", pod,
+			"status", state,
+			"master", net.JoinHostPort(sentinelproxy.FieldValue(fields, "ip"), sentinelproxy.FieldValue(fields, "port")),
+			"flags", flags,
+			"replicas", sentinelproxy.FieldValue(fields, "num-slaves"),
+			"sentinels", strconv.Itoa(sentinels),
+		}
+	}
+	return status
+}
+
+var (
+	// DistributionSamples is how many made up targets DISTRIBUTION places
+	// when not told, and MaxDistributionSamples the most it may be told.
+	DistributionSamples    = 10000
+	MaxDistributionSamples = 1000000
+	// MaxTrackedTargets bounds how many distinct looked up targets are
+	// remembered; later ones are only counted as lookups.
+	MaxTrackedTargets = 100000
+
+	lookupLock sync.Mutex
+	// shardLookups counts the lookups resolved to each shard, -1 counting
+	// those resolved by an override.
+	shardLookups = make(map[int]int64)
+	// shardTargets is the shard each looked up target last resolved to.
+	shardTargets = make(map[string]int)
+)
+
+func countLookup(loc Location) {
+	lookupLock.Lock()
+	shardLookups[loc.Shard]++
+	if _, tracked := shardTargets[loc.Target]; tracked || len(shardTargets) < MaxTrackedTargets {
+		shardTargets[loc.Target] = loc.Shard
+	}
+	lookupLock.Unlock()
+}
+
+// distribution compares the share of targets each shard should get with
+// the share it gets:
+//
+//	DISTRIBUTION [samples]
+//	DISTRIBUTION RESET
+//
+// Each shard gets its pod, weight, expected share and the share of samples
+// made up targets placed on it. Then, since start or the last reset, come
+// the lookups resolved to it and the distinct targets looked up on it, each
+// with their share of all hashed ones. Shares are percentages. Overrides
+// are reported as shard -1.
+func distribution(c *Command, w *bufio.Writer) error {
+	samples := DistributionSamples
+	if arg := string(c.Get(1)); arg != "" {
+		if strings.ToUpper(arg) == "RESET" {
+			lookupLock.Lock()
+			shardLookups = make(map[int]int64)
+			shardTargets = make(map[string]int)
+			lookupLock.Unlock()
+			return SendOk(w)
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return SendError(w, ExpectNumber.Error())
+		}
+		if n > MaxDistributionSamples {
+			return SendError(w, fmt.Sprintf("ERR at most %d samples", MaxDistributionSamples))
+		}
+		samples = n
+	}
+	migration.RLock()
+	placer, shards := placement, shardCount
+	migration.RUnlock()
+	weights := weightsFor(shards)
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	placed := make([]int, shards)
+	for i := 0; i < samples; i++ {
+		placed[placer.Shard(fmt.Sprintf("target-%d", i))]++
+	}
+	lookupLock.Lock()
+	lookups := make(map[int]int64, len(shardLookups))
+	for shard, n := range shardLookups {
+		lookups[shard] = n
+	}
+	targets := make(map[int]int64)
+	for _, shard := range shardTargets {
+		targets[shard]++
+	}
+	lookupLock.Unlock()
+	// Migrated targets may already resolve to shards beyond the current
+	// layout.
+	for shard := range lookups {
+		if shard >= shards {
+			shards = shard + 1
+		}
+	}
+	hashed, hashedTargets := int64(0), int64(0)
+	for shard, n := range lookups {
+		if shard >= 0 {
+			hashed += n
+			hashedTargets += targets[shard]
+		}
+	}
+	var replies [][]string
+	for shard := 0; shard < shards; shard++ {
+		weight, expected, sampled := 0, 0.0, 0.0
+		if shard < len(placed) {
+			weight = weights[shard]
+			expected = percent(int64(weight), int64(total))
+			sampled = percent(int64(placed[shard]), int64(samples))
+		}
+		replies = append(replies, []string{
+			"shard", strconv.Itoa(shard),
+			"pod", podForShard(shard),
+			"weight", strconv.Itoa(weight),
+			"expected", fmt.Sprintf("%.2f", expected),
+			"sampled", fmt.Sprintf("%.2f", sampled),
+			"lookups", strconv.FormatInt(lookups[shard], 10),
+			"lookup-share", fmt.Sprintf("%.2f", percent(lookups[shard], hashed)),
+			"targets", strconv.FormatInt(targets[shard], 10),
+			"target-share", fmt.Sprintf("%.2f", percent(targets[shard], hashedTargets)),
+		})
+	}
+	if n := lookups[-1]; n > 0 {
+		replies = append(replies, []string{
+			"shard", "-1",
+			"pod", "",
+			"weight", "",
+			"expected", "",
+			"sampled", "",
+			"lookups", strconv.FormatInt(n, 10),
+			"lookup-share", "",
+			"targets", strconv.FormatInt(targets[-1], 10),
+			"target-share", "",
+		})
+	}
+	return SendBulkStringArrays(w, replies)
+}
+
+func percent(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(of)
+}
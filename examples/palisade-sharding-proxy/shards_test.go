@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCountLookupTracksDistinctTargets(t *testing.T) {
+	defer func(max int) { MaxTrackedTargets = max }(MaxTrackedTargets)
+	lookupLock.Lock()
+	shardLookups, shardTargets = make(map[int]int64), make(map[string]int)
+	lookupLock.Unlock()
+	MaxTrackedTargets = 2
+
+	for _, loc := range []Location{
+		{Target: "a", Shard: 0},
+		{Target: "a", Shard: 0},
+		{Target: "a", Shard: 0},
+		{Target: "b", Shard: 1},
+		{Target: "c", Shard: 1},
+		// Already tracked, so still followed once the limit is reached.
+		{Target: "a", Shard: 1},
+	} {
+		countLookup(loc)
+	}
+	if shardLookups[0] != 3 || shardLookups[1] != 3 {
+		t.Errorf("lookups per shard are %v", shardLookups)
+	}
+	if len(shardTargets) != 2 || shardTargets["a"] != 1 || shardTargets["b"] != 1 {
+		t.Errorf("tracked targets are %v", shardTargets)
+	}
+}
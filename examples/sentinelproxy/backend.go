@@ -0,0 +1,32 @@
+package sentinelproxy
+
+import (
+	"github.com/therealbill/palisade/sentinel"
+)
+
+// Backend ends the proxies' sentinel.Backend chains. It is a
+// sentinel.ProxyBackend asking the usable managing sentinels through their
+// connection pools, with masters served from Cache.
+type Backend struct {
+	*sentinel.ProxyBackend
+	// FetchMaster finds a pod on a cache miss. When nil the first managing
+	// sentinel that answers is asked.
+	FetchMaster func(name string) (sentinel.RedisPod, bool, error)
+}
+
+func NewBackend() *Backend {
+	return &Backend{ProxyBackend: &sentinel.ProxyBackend{
+		Addrs: Usable,
+		Do: func(sa string, args ...string) (interface{}, error) {
+			return PoolFor(sa).Do(args...)
+		},
+	}}
+}
+
+func (b *Backend) LookupMaster(name string) (sentinel.RedisPod, bool, error) {
+	fetch := b.FetchMaster
+	if fetch == nil {
+		fetch = b.ProxyBackend.LookupMaster
+	}
+	return Cache.Lookup(name, fetch)
+}
@@ -0,0 +1,278 @@
+package sentinelproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+var (
+	// ProbeInterval is how often each sentinel is pinged and asked for its
+	// peers.
+	ProbeInterval = 10 * time.Second
+	// ProbeFailures consecutive failed probes mark a sentinel unhealthy.
+	ProbeFailures = 2
+	// ForgetAfter removes discovered sentinels that have been unhealthy
+	// this long. Sentinels given on the command line are never removed.
+	ForgetAfter = 10 * time.Minute
+)
+
+// SentinelStatus is what the proxy knows about a managing sentinel.
+type SentinelStatus struct {
+	Addr       string
+	Discovered bool
+	Probed     bool
+	Healthy    bool
+	Failures   int
+	LastSeen   time.Time
+	DownSince  time.Time
+	Latency    time.Duration
+	Pods       []string
+}
+
+var (
+	statusLock     sync.Mutex
+	sentinelStatus = make(map[string]*SentinelStatus)
+)
+
+func statusFor(sa string) *SentinelStatus {
+	st, exists := sentinelStatus[sa]
+	if !exists {
+		st = &SentinelStatus{Addr: sa}
+		sentinelStatus[sa] = st
+	}
+	return st
+}
+
+// Usable lists the managing sentinels not known to be unhealthy.
+// When every one of them is unhealthy they are all returned, so requests
+// still get a chance rather than failing outright.
+func Usable() []string {
+	all := Sentinels.List()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	var usable []string
+	for _, sa := range all {
+		if st, exists := sentinelStatus[sa]; !exists || !st.unhealthy() {
+			usable = append(usable, sa)
+		}
+	}
+	if len(usable) == 0 {
+		return all
+	}
+	return usable
+}
+
+// unhealthy is true once ProbeFailures probes in a row have failed.
+func (st *SentinelStatus) unhealthy() bool {
+	return st.Probed && !st.Healthy && st.Failures >= ProbeFailures
+}
+
+// Watching lists the managing sentinels that watch pod, healthy or not, as
+// their last successful probe found. Sentinels that have never answered a
+// probe are assumed to watch it.
+func Watching(pod string) []string {
+	all := Sentinels.List()
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	var watching []string
+	for _, sa := range all {
+		st, exists := sentinelStatus[sa]
+		if !exists || st.LastSeen.IsZero() {
+			watching = append(watching, sa)
+			continue
+		}
+		i := sort.SearchStrings(st.Pods, pod)
+		if i < len(st.Pods) && st.Pods[i] == pod {
+			watching = append(watching, sa)
+		}
+	}
+	return watching
+}
+
+// addDiscovered adds a sentinel learnt from a peer.
+func addDiscovered(sa, from string) {
+	if Sentinels.Add(sa) {
+		return
+	}
+	statusLock.Lock()
+	statusFor(sa).Discovered = true
+	statusLock.Unlock()
+	Cache.Watch(sa)
+	log.Printf("discovered managing sentinel %s through %s", sa, from)
+}
+
+// Discover probes every managing sentinel each ProbeInterval, adding the
+// peers they report. It runs until the process exits.
+func Discover() {
+	for {
+		var wg sync.WaitGroup
+		for _, sa := range Sentinels.List() {
+			wg.Add(1)
+			go func(sa string) {
+				defer wg.Done()
+				probe(sa)
+			}(sa)
+		}
+		wg.Wait()
+		forgetDown()
+		time.Sleep(ProbeInterval)
+	}
+}
+
+// probe pings a sentinel and, when it answers, asks it which pods it
+// watches and which other sentinels watch them.
+func probe(sa string) {
+	pool := PoolFor(sa)
+	start := time.Now()
+	_, err := pool.Do("PING")
+	latency := time.Since(start)
+	var pods []string
+	var peers map[string]bool
+	if err == nil {
+		pods, peers, err = sentinelPeers(pool)
+	}
+	statusLock.Lock()
+	st := statusFor(sa)
+	st.Probed = true
+	if err != nil {
+		st.Failures++
+		if st.Failures >= ProbeFailures && st.Healthy {
+			log.Printf("[%s] marked unhealthy: %v", sa, err)
+		}
+		if st.Failures >= ProbeFailures {
+			if st.Healthy || st.DownSince.IsZero() {
+				st.DownSince = time.Now()
+			}
+			st.Healthy = false
+		}
+		statusLock.Unlock()
+		return
+	}
+	if !st.Healthy && st.Failures >= ProbeFailures {
+		log.Printf("[%s] healthy again", sa)
+	}
+	st.Healthy = true
+	st.Failures = 0
+	st.DownSince = time.Time{}
+	st.LastSeen = time.Now()
+	st.Latency = latency
+	st.Pods = pods
+	statusLock.Unlock()
+	for peer := range peers {
+		addDiscovered(peer, sa)
+	}
+}
+
+// sentinelPeers asks a sentinel for its pods and their other sentinels.
+func sentinelPeers(pool *Pool) ([]string, map[string]bool, error) {
+	reply, err := pool.Do("SENTINEL", "MASTERS")
+	if err != nil {
+		return nil, nil, err
+	}
+	masters, ok := reply.([]interface{})
+	if !ok {
+		return nil, nil, resp.UnexpectedReply
+	}
+	var pods []string
+	for _, m := range masters {
+		fields, err := resp.Strings(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name := FieldValue(fields, "name"); name != "" {
+			pods = append(pods, name)
+		}
+	}
+	sort.Strings(pods)
+	peers := make(map[string]bool)
+	for _, pod := range pods {
+		reply, err := pool.Do("SENTINEL", "SENTINELS", pod)
+		if err != nil {
+			return nil, nil, err
+		}
+		list, _ := reply.([]interface{})
+		for _, s := range list {
+			fields, err := resp.Strings(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			ip, port := FieldValue(fields, "ip"), FieldValue(fields, "port")
+			if ip != "" && port != "" {
+				peers[net.JoinHostPort(ip, port)] = true
+			}
+		}
+	}
+	return pods, peers, nil
+}
+
+// FieldValue finds a value in a flat field/value list.
+func FieldValue(fields []string, key string) string {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == key {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// forgetDown drops discovered sentinels that have been down ForgetAfter.
+func forgetDown() {
+	if ForgetAfter <= 0 {
+		return
+	}
+	statusLock.Lock()
+	var forget []string
+	for sa, st := range sentinelStatus {
+		if st.Discovered && !st.Healthy && !st.DownSince.IsZero() && time.Since(st.DownSince) > ForgetAfter {
+			forget = append(forget, sa)
+			delete(sentinelStatus, sa)
+		}
+	}
+	statusLock.Unlock()
+	for _, sa := range forget {
+		Sentinels.Remove(sa)
+		Cache.Unwatch(sa)
+		log.Printf("[%s] forgotten after being down for %s", sa, ForgetAfter)
+	}
+}
+
+// KnownSentinels reports every managing sentinel and its health, for the
+// KNOWNSENTINELS command.
+func KnownSentinels() [][]string {
+	var infos [][]string
+	for _, sa := range Sentinels.List() {
+		statusLock.Lock()
+		st := *statusFor(sa)
+		statusLock.Unlock()
+		state := "unknown"
+		if st.Probed && st.Healthy {
+			state = "healthy"
+		} else if st.unhealthy() {
+			state = "unhealthy"
+		}
+		lastSeen := ""
+		if !st.LastSeen.IsZero() {
+			lastSeen = st.LastSeen.Format(time.RFC3339)
+		}
+		source := "configured"
+		if st.Discovered {
+			source = "discovered"
+		}
+		infos = append(infos, []string{
+			"addr", sa,
+			"state", state,
+			"source", source,
+			"last-seen", lastSeen,
+			"latency-ms", fmt.Sprintf("%.3f", float64(st.Latency)/float64(time.Millisecond)),
+			"pods", strings.Join(st.Pods, ","),
+		})
+	}
+	return infos
+}
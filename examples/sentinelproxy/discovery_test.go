@@ -0,0 +1,61 @@
+package sentinelproxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withSentinels sets the managing sentinels and their status for a test.
+func withSentinels(t *testing.T, status map[string]*SentinelStatus) {
+	statusLock.Lock()
+	sentinelStatus = status
+	statusLock.Unlock()
+	for sa := range status {
+		Sentinels.Add(sa)
+	}
+	t.Cleanup(func() {
+		for sa := range status {
+			Sentinels.Remove(sa)
+		}
+		statusLock.Lock()
+		sentinelStatus = make(map[string]*SentinelStatus)
+		statusLock.Unlock()
+	})
+}
+
+func TestUsableWaitsForProbeFailures(t *testing.T) {
+	now := time.Now()
+	withSentinels(t, map[string]*SentinelStatus{
+		// Never answered, failed one probe.
+		"s1:26379": {Probed: true, Failures: 1},
+		// Never answered, failed enough probes.
+		"s2:26379": {Probed: true, Failures: ProbeFailures},
+		// Was healthy, failed one probe.
+		"s3:26379": {Probed: true, Healthy: true, Failures: 1, LastSeen: now},
+		// Was healthy, failed enough probes.
+		"s4:26379": {Probed: true, Failures: ProbeFailures, LastSeen: now},
+		"s5:26379": {},
+	})
+	want := []string{"s1:26379", "s3:26379", "s5:26379"}
+	if got := Usable(); !reflect.DeepEqual(got, want) {
+		t.Errorf("usable sentinels are %v, want %v", got, want)
+	}
+}
+
+func TestWatching(t *testing.T) {
+	now := time.Now()
+	withSentinels(t, map[string]*SentinelStatus{
+		"s1:26379": {Probed: true, Healthy: true, LastSeen: now, Pods: []string{"cache", "queue"}},
+		"s2:26379": {Probed: true, Healthy: true, LastSeen: now, Pods: []string{"queue"}},
+		"s3:26379": {Probed: true, Failures: ProbeFailures, LastSeen: now, Pods: []string{"cache"}},
+		// Not probed yet, so it might watch anything.
+		"s4:26379": {},
+	})
+	if got, want := Watching("cache"), []string{"s1:26379", "s3:26379", "s4:26379"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sentinels watching cache are %v, want %v", got, want)
+	}
+	if got, want := Watching("queue"), []string{"s1:26379", "s2:26379", "s4:26379"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sentinels watching queue are %v, want %v", got, want)
+	}
+}
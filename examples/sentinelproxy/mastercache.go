@@ -0,0 +1,291 @@
+package sentinelproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+	"github.com/therealbill/palisade/sentinel"
+)
+
+var (
+	// CacheTTL is how long a master is served from the cache when no
+	// event has invalidated it. 0 disables the cache.
+	CacheTTL = 30 * time.Second
+	// EventPing is how long an event subscription may stay silent before
+	// it is pinged, and then dropped if the ping gets no answer.
+	EventPing = 15 * time.Second
+	// ResubscribeDelay is the wait before reconnecting a lost subscription.
+	ResubscribeDelay = time.Second
+
+	masterEvents = []string{"+switch-master", "+odown", "+config-update-from-sentinel"}
+)
+
+// cachedMaster is a pod as last fetched, with its master address moved by
+// any +switch-master since. A +switch-master for a pod that wasn't cached
+// leaves an entry with only the address, which is not served on its own.
+type cachedMaster struct {
+	pod     sentinel.RedisPod
+	partial bool
+	fetched time.Time
+}
+
+// subscription is the event subscription to one sentinel.
+type subscription struct {
+	up   bool
+	stop chan struct{}
+	conn *resp.Conn
+}
+
+// MasterCache keeps the pods and master addresses learnt from the managing
+// sentinels.
+// Entries expire after CacheTTL and are dropped or replaced as soon as a
+// sentinel announces a failover, an objective down or a config change for
+// the pod.
+type MasterCache struct {
+	sync.Mutex
+	masters    map[string]cachedMaster
+	subscribed map[string]*subscription
+	// generation counts the changes events and flushes made to the cache,
+	// so a lookup can tell that what it fetched may be out of date.
+	generation    uint64
+	hits, misses  int64
+	invalidations int64
+	lastEvent     time.Time
+}
+
+// Cache is the proxy's master address cache.
+var Cache = &MasterCache{
+	masters:    make(map[string]cachedMaster),
+	subscribed: make(map[string]*subscription),
+}
+
+// Lookup returns the pod from the cache, calling fetch and caching its
+// answer when there is no fresh entry.
+func (mc *MasterCache) Lookup(name string, fetch func(string) (sentinel.RedisPod, bool, error)) (sentinel.RedisPod, bool, error) {
+	mc.Lock()
+	entry, cached := mc.masters[name]
+	if cached && !entry.partial && time.Since(entry.fetched) < CacheTTL {
+		mc.hits++
+		mc.Unlock()
+		return entry.pod, true, nil
+	}
+	mc.misses++
+	generation := mc.generation
+	mc.Unlock()
+	pod, found, err := fetch(name)
+	if err != nil || !found || CacheTTL <= 0 {
+		return pod, found, err
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.generation != generation {
+		// An event arrived during the fetch, which may have asked a
+		// sentinel that hadn't heard of it yet. A +switch-master left the
+		// new address; anything else leaves the answer uncached.
+		if entry, cached := mc.masters[name]; cached {
+			pod.IP, pod.Port = entry.pod.IP, entry.pod.Port
+		}
+		return pod, true, nil
+	}
+	mc.masters[name] = cachedMaster{pod: pod, fetched: time.Now()}
+	return pod, true, nil
+}
+
+// Watch subscribes to the master events of a managing sentinel, once per
+// sentinel.
+func (mc *MasterCache) Watch(sa string) {
+	mc.Lock()
+	defer mc.Unlock()
+	if _, watching := mc.subscribed[sa]; watching {
+		return
+	}
+	sub := &subscription{stop: make(chan struct{})}
+	mc.subscribed[sa] = sub
+	go mc.subscribe(sa, sub)
+}
+
+// Unwatch stops receiving a sentinel's events.
+func (mc *MasterCache) Unwatch(sa string) {
+	mc.Lock()
+	defer mc.Unlock()
+	sub, watching := mc.subscribed[sa]
+	if !watching {
+		return
+	}
+	delete(mc.subscribed, sa)
+	close(sub.stop)
+	if sub.conn != nil {
+		sub.conn.Close()
+	}
+}
+
+func (mc *MasterCache) subscribe(sa string, sub *subscription) {
+	for {
+		err := mc.receive(sa, sub)
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+		mc.Lock()
+		lost := sub.up
+		sub.up = false
+		sub.conn = nil
+		mc.Unlock()
+		if lost {
+			// Events may be missed until the subscription is back.
+			mc.Flush()
+			log.Printf("[%s] event subscription lost: %v", sa, err)
+		}
+		select {
+		case <-sub.stop:
+			return
+		case <-time.After(ResubscribeDelay):
+		}
+	}
+}
+
+func (mc *MasterCache) receive(sa string, sub *subscription) error {
+	conn, err := resp.Dial(sa, DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	mc.Lock()
+	select {
+	case <-sub.stop:
+		mc.Unlock()
+		return nil
+	default:
+	}
+	sub.conn = conn
+	mc.Unlock()
+	conn.WriteTimeout = WriteTimeout
+	if err := conn.Send(append([]string{"SUBSCRIBE"}, masterEvents...)...); err != nil {
+		return err
+	}
+	pinged := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(EventPing))
+		reply, err := resp.ReadReply(conn.R)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !pinged {
+			if err := conn.Send("PING"); err != nil {
+				return err
+			}
+			pinged = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pinged = false
+		msg, err := resp.Strings(reply)
+		if err != nil || len(msg) < 3 {
+			continue
+		}
+		switch msg[0] {
+		case "subscribe":
+			if msg[2] == fmt.Sprintf("%d", len(masterEvents)) {
+				mc.Lock()
+				sub.up = true
+				mc.Unlock()
+			}
+		case "message":
+			mc.event(sa, msg[1], msg[2])
+		}
+	}
+}
+
+// event applies a sentinel event to the cache.
+func (mc *MasterCache) event(sa, channel, payload string) {
+	f := strings.Fields(payload)
+	mc.Lock()
+	defer mc.Unlock()
+	mc.lastEvent = time.Now()
+	mc.generation++
+	switch channel {
+	case "+switch-master":
+		// <name> <old ip> <old port> <new ip> <new port>
+		if len(f) == 5 {
+			entry, cached := mc.masters[f[0]]
+			if !cached {
+				entry = cachedMaster{pod: sentinel.RedisPod{Name: f[0]}, partial: true}
+			}
+			entry.pod.IP, entry.pod.Port, entry.fetched = f[3], f[4], time.Now()
+			mc.masters[f[0]] = entry
+			mc.invalidations++
+			log.Printf("[%s] %s switched master to %s:%s", sa, f[0], f[3], f[4])
+		}
+	case "+odown":
+		// master <name> <ip> <port> ...
+		if len(f) >= 2 && f[0] == "master" {
+			mc.drop(f[1])
+		}
+	case "+config-update-from-sentinel":
+		// sentinel <id> <ip> <port> @ <name> <ip> <port>
+		for i, word := range f {
+			if word == "@" && i+1 < len(f) {
+				mc.drop(f[i+1])
+			}
+		}
+	}
+}
+
+func (mc *MasterCache) drop(name string) {
+	if _, cached := mc.masters[name]; cached {
+		delete(mc.masters, name)
+		mc.invalidations++
+	}
+}
+
+// Flush empties the cache.
+func (mc *MasterCache) Flush() {
+	mc.Lock()
+	mc.masters = make(map[string]cachedMaster)
+	mc.generation++
+	mc.Unlock()
+}
+
+// Info reports the cache for the INFO command. cache_stale is 1 when a
+// managing sentinel's events can't currently be received, so changes may
+// go unnoticed until entries expire.
+func (mc *MasterCache) Info() []string {
+	mc.Lock()
+	defer mc.Unlock()
+	up := 0
+	for _, sub := range mc.subscribed {
+		if sub.up {
+			up++
+		}
+	}
+	oldest := 0.0
+	for _, entry := range mc.masters {
+		if age := time.Since(entry.fetched).Seconds(); age > oldest {
+			oldest = age
+		}
+	}
+	lastEvent := -1
+	if !mc.lastEvent.IsZero() {
+		lastEvent = int(time.Since(mc.lastEvent).Seconds())
+	}
+	stale := 0
+	if up < len(mc.subscribed) {
+		stale = 1
+	}
+	return []string{
+		fmt.Sprintf("cache_ttl_seconds:%d", int(CacheTTL.Seconds())),
+		fmt.Sprintf("cached_masters:%d", len(mc.masters)),
+		fmt.Sprintf("cache_hits:%d", mc.hits),
+		fmt.Sprintf("cache_misses:%d", mc.misses),
+		fmt.Sprintf("cache_invalidations:%d", mc.invalidations),
+		fmt.Sprintf("cache_oldest_entry_seconds:%d", int(oldest)),
+		fmt.Sprintf("event_subscriptions:%d/%d", up, len(mc.subscribed)),
+		fmt.Sprintf("last_event_seconds_ago:%d", lastEvent),
+		fmt.Sprintf("cache_stale:%d", stale),
+	}
+}
@@ -0,0 +1,169 @@
+package sentinelproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+	"github.com/therealbill/palisade/sentinel"
+)
+
+func init() {
+	// Subscriptions outlive the tests that start them, so this is set
+	// once rather than per test.
+	ResubscribeDelay = 10 * time.Millisecond
+}
+
+func newTestCache() *MasterCache {
+	return &MasterCache{masters: make(map[string]cachedMaster), subscribed: make(map[string]*subscription)}
+}
+
+func TestLookupDiscardsFetchesOvertakenByEvents(t *testing.T) {
+	mc := newTestCache()
+	// The sentinel asked had not heard of the failover announced while it
+	// was being asked.
+	pod, _, _ := mc.Lookup("cache", func(name string) (sentinel.RedisPod, bool, error) {
+		mc.event("s1", "+switch-master", "cache 10.0.0.1 6379 10.0.0.2 6379")
+		return sentinel.RedisPod{Name: name, IP: "10.0.0.1", Port: "6379", Quorum: "2"}, true, nil
+	})
+	if pod.IP != "10.0.0.2" || pod.Port != "6379" || pod.Quorum != "2" {
+		t.Errorf("lookup during a failover returned %+v", pod)
+	}
+	if entry := mc.masters["cache"]; entry.pod.IP != "10.0.0.2" {
+		t.Errorf("cached %s after a failover", entry.pod.IP)
+	}
+	// The address alone isn't a pod to serve.
+	fetched := false
+	mc.Lookup("cache", func(name string) (sentinel.RedisPod, bool, error) {
+		fetched = true
+		return sentinel.RedisPod{Name: name, IP: "10.0.0.2", Port: "6379"}, true, nil
+	})
+	if !fetched {
+		t.Errorf("served a pod known only from a +switch-master")
+	}
+	mc.event("s1", "+switch-master", "cache 10.0.0.2 6379 10.0.0.3 6379")
+	if pod, _, _ := mc.Lookup("cache", nil); pod.IP != "10.0.0.3" {
+		t.Errorf("cached pod at %s after another failover", pod.IP)
+	}
+
+	fetches := 0
+	fetch := func(name string) (sentinel.RedisPod, bool, error) {
+		fetches++
+		if fetches == 1 {
+			mc.event("s1", "+odown", "master queue 10.0.0.3 6379 #quorum 2/2")
+		}
+		return sentinel.RedisPod{Name: name, IP: "10.0.0.3", Port: "6379"}, true, nil
+	}
+	mc.Lookup("queue", fetch)
+	mc.Lookup("queue", fetch)
+	if fetches != 2 {
+		t.Errorf("an answer fetched during +odown was cached")
+	}
+	mc.Lookup("queue", fetch)
+	if fetches != 2 {
+		t.Errorf("an answer fetched without events in between was not cached")
+	}
+}
+
+// fakeSentinel accepts SUBSCRIBE connections, confirming every channel,
+// and reports each connection it sees close.
+func fakeSentinel(t *testing.T) (string, chan struct{}, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	opened, closed := make(chan struct{}, 10), make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				opened <- struct{}{}
+				r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+				for {
+					args, err := resp.Strings(mustRead(r))
+					if err != nil {
+						closed <- struct{}{}
+						return
+					}
+					for i, ch := range args[1:] {
+						fmt.Fprintf(w, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, i+1)
+					}
+					w.Flush()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), opened, closed
+}
+
+func mustRead(r *bufio.Reader) interface{} {
+	reply, err := resp.ReadReply(r)
+	if err != nil {
+		return err
+	}
+	return reply
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if ok() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestUnwatchClosesSubscription(t *testing.T) {
+	mc := newTestCache()
+	addr, opened, closed := fakeSentinel(t)
+	mc.Watch(addr)
+	<-opened
+	waitFor(t, "the subscription", func() bool {
+		mc.Lock()
+		defer mc.Unlock()
+		return mc.subscribed[addr] != nil && mc.subscribed[addr].up
+	})
+	mc.Unwatch(addr)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription was not closed")
+	}
+	select {
+	case <-opened:
+		t.Error("an unwatched sentinel was subscribed to again")
+	case <-time.After(10 * ResubscribeDelay):
+	}
+}
+
+func TestFailedResubscribesKeepCache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	mc := newTestCache()
+	mc.Watch(addr)
+	defer mc.Unwatch(addr)
+	mc.Lookup("cache", func(name string) (sentinel.RedisPod, bool, error) {
+		return sentinel.RedisPod{Name: name, IP: "10.0.0.1", Port: "6379"}, true, nil
+	})
+	time.Sleep(10 * ResubscribeDelay)
+	mc.Lock()
+	_, cached := mc.masters["cache"]
+	mc.Unlock()
+	if !cached {
+		t.Error("failing to subscribe again and again flushed the cache")
+	}
+}
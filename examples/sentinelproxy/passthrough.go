@@ -0,0 +1,90 @@
+package sentinelproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var (
+	NoSentinel = errors.New("ERR no managing sentinel could be reached")
+
+	// Passthrough relays commands a proxy doesn't handle itself to a
+	// managing sentinel.
+	Passthrough      bool
+	PassthroughAllow []string
+	// PassthroughDeny wins over PassthroughAllow. It starts with the
+	// commands that change sentinels, including IS-MASTER-DOWN-BY-ADDR,
+	// which casts a sentinel's failover vote, that can't be relayed one
+	// reply at a time, and that change the state of the pooled connection they are
+	// relayed on, which later clients would inherit; proxies add their own.
+	PassthroughDeny = []string{
+		"SENTINEL MONITOR", "SENTINEL REMOVE", "SENTINEL SET",
+		"SENTINEL RESET", "SENTINEL FAILOVER", "SENTINEL CONFIG",
+		"SENTINEL FLUSHCONFIG", "SENTINEL DEBUG", "SENTINEL SIMULATE-FAILURE",
+		"SENTINEL IS-MASTER-DOWN-BY-ADDR",
+		"SHUTDOWN", "PUBLISH", "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE",
+		"MONITOR", "DEBUG", "CLIENT", "AUTH", "HELLO", "RESET", "ACL",
+	}
+)
+
+// passthroughRule reports whether rule, such as "INFO", "SENTINEL *" or
+// "SENTINEL CKQUORUM", covers the command.
+func passthroughRule(rule, cmd, sub string) bool {
+	rule = strings.ToUpper(strings.TrimSpace(rule))
+	if rule == "*" || rule == cmd {
+		return true
+	}
+	return sub != "" && (rule == cmd+" *" || rule == cmd+" "+sub)
+}
+
+// PassthroughAllowed decides whether a command may be relayed.
+func PassthroughAllowed(c Command) bool {
+	if !Passthrough {
+		return false
+	}
+	cmd := strings.ToUpper(string(c.Get(0)))
+	sub := ""
+	if cmd == "SENTINEL" {
+		sub = strings.ToUpper(string(c.Get(1)))
+	}
+	for _, rule := range PassthroughDeny {
+		if passthroughRule(rule, cmd, sub) {
+			return false
+		}
+	}
+	if len(PassthroughAllow) == 0 {
+		return true
+	}
+	for _, rule := range PassthroughAllow {
+		if passthroughRule(rule, cmd, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// Relay sends a command to the first managing sentinel that answers and
+// returns its reply byte for byte.
+func Relay(c Command) ([]byte, error) {
+	args := Args(c)
+	for _, sa := range Usable() {
+		raw, err := PoolFor(sa).DoRaw(args...)
+		if err != nil {
+			log.Printf("[%s] error: %s", sa, err.Error())
+			continue
+		}
+		return raw, nil
+	}
+	return nil, NoSentinel
+}
+
+// PassthroughInfo describes the pass-through rules for the logs.
+func PassthroughInfo() string {
+	allow := "everything"
+	if len(PassthroughAllow) > 0 {
+		allow = strings.Join(PassthroughAllow, ", ")
+	}
+	return fmt.Sprintf("passing through %s except %s", allow, strings.Join(PassthroughDeny, ", "))
+}
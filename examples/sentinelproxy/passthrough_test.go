@@ -0,0 +1,58 @@
+package sentinelproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+type testCommand []string
+
+func (c testCommand) ArgCount() int {
+	return len(c)
+}
+
+func (c testCommand) Get(index int) []byte {
+	if index >= len(c) {
+		return nil
+	}
+	return []byte(c[index])
+}
+
+func TestPassthroughAllowed(t *testing.T) {
+	defer func(deny, allow []string) {
+		Passthrough, PassthroughDeny, PassthroughAllow = false, deny, allow
+	}(PassthroughDeny, PassthroughAllow)
+	Passthrough = true
+	PassthroughDeny = append(PassthroughDeny, "SENTINEL CKQUORUM")
+	for line, want := range map[string]bool{
+		"INFO":                            true,
+		"SENTINEL INFO-CACHE":             true,
+		"SENTINEL INFO-CACHE cache":       true,
+		"SENTINEL MYID":                   true,
+		"sentinel masters":                true,
+		"SENTINEL IS-MASTER-DOWN-BY-ADDR": false,
+		"sentinel set cache x 1":          false,
+		"SENTINEL CKQUORUM cache":         false,
+		"PUBLISH __sentinel__ x":          false,
+		"AUTH secret":                     false,
+		"HELLO 3":                         false,
+		"RESET":                           false,
+		"ACL SETUSER bob on":              false,
+		"CLIENT SETNAME x":                false,
+		"SENTINEL SIMULATE-FAILURE":       false,
+	} {
+		if got := PassthroughAllowed(testCommand(strings.Fields(line))); got != want {
+			t.Errorf("%q allowed = %t, want %t", line, got, want)
+		}
+	}
+
+	// An allow list can't let through what the deny list holds.
+	PassthroughAllow = []string{"*"}
+	if PassthroughAllowed(testCommand{"AUTH", "secret"}) {
+		t.Error("AUTH passed with an allow list of *")
+	}
+	PassthroughAllow = []string{"SENTINEL *"}
+	if PassthroughAllowed(testCommand{"INFO"}) {
+		t.Error("INFO passed with an allow list of SENTINEL *")
+	}
+}
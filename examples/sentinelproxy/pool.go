@@ -0,0 +1,287 @@
+package sentinelproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+var (
+	PoolExhausted = errors.New("all connections to the sentinel are busy")
+	SentinelDown  = errors.New("sentinel is marked down")
+
+	DialTimeout  = 2 * time.Second
+	ReadTimeout  = 2 * time.Second
+	WriteTimeout = 2 * time.Second
+	IdleTimeout  = time.Minute
+	MaxConns     = 8
+	// MaxFailures consecutive errors mark a sentinel down; it is then only
+	// tried again once every RetryDown.
+	MaxFailures = 3
+	RetryDown   = 5 * time.Second
+)
+
+type poolConn struct {
+	*resp.Conn
+	counted  *countingConn
+	lastUsed time.Time
+}
+
+// countingConn counts the bytes written to a connection, so a failed
+// command can be told to have reached the sentinel or not.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// Pool holds the connections to one managing sentinel.
+type Pool struct {
+	Addr string
+
+	sync.Mutex
+	idle     []*poolConn
+	slots    chan struct{}
+	failures int
+	down     bool
+	lastErr  error
+	lastOK   time.Time
+	lastTry  time.Time
+
+	dials, reuses, errs, timeouts int64
+}
+
+var (
+	poolsLock sync.Mutex
+	pools     = make(map[string]*Pool)
+)
+
+// PoolFor returns the pool for a sentinel, creating it on first use.
+func PoolFor(addr string) *Pool {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	p, exists := pools[addr]
+	if !exists {
+		p = &Pool{Addr: addr, slots: make(chan struct{}, MaxConns)}
+		pools[addr] = p
+	}
+	return p
+}
+
+// ReapIdle closes connections left idle longer than IdleTimeout. It runs
+// until the process exits.
+func ReapIdle() {
+	for range time.Tick(IdleTimeout / 2) {
+		poolsLock.Lock()
+		var all []*Pool
+		for _, p := range pools {
+			all = append(all, p)
+		}
+		poolsLock.Unlock()
+		for _, p := range all {
+			p.Lock()
+			kept := p.idle[:0]
+			for _, pc := range p.idle {
+				if time.Since(pc.lastUsed) > IdleTimeout {
+					pc.Close()
+				} else {
+					kept = append(kept, pc)
+				}
+			}
+			p.idle = kept
+			p.Unlock()
+		}
+	}
+}
+
+// Do runs a command on the sentinel and returns its reply. Error replies
+// come back as both the reply and a resp.Error, so they can be told apart
+// from connection problems, which count against the sentinel's health.
+func (p *Pool) Do(args ...string) (interface{}, error) {
+	var reply interface{}
+	err := p.run(func(pc *poolConn) (err error) {
+		reply, err = pc.Do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// DoRaw runs a command on the sentinel and returns its reply exactly as
+// sent, whatever its type.
+func (p *Pool) DoRaw(args ...string) ([]byte, error) {
+	var raw []byte
+	err := p.run(func(pc *poolConn) (err error) {
+		raw, err = pc.DoRaw(args...)
+		return err
+	})
+	return raw, err
+}
+
+// run calls fn with a pooled connection, keeping track of the sentinel's
+// health. A command is only tried again when none of it was sent, so one
+// that fails after reaching the sentinel never runs twice.
+func (p *Pool) run(fn func(*poolConn) error) error {
+	p.Lock()
+	if p.down && time.Since(p.lastTry) < RetryDown {
+		p.Unlock()
+		return SentinelDown
+	}
+	p.lastTry = time.Now()
+	p.Unlock()
+	select {
+	case p.slots <- struct{}{}:
+	case <-time.After(DialTimeout):
+		return PoolExhausted
+	}
+	defer func() { <-p.slots }()
+	pc, reused, err := p.get()
+	if err != nil {
+		p.failed(err)
+		return err
+	}
+	sent := pc.counted.written
+	err = fn(pc)
+	if _, ok := err.(resp.Error); err != nil && !ok && reused && pc.counted.written == sent {
+		// The sentinel may have closed an idle connection; a fresh one
+		// tells a dead sentinel from a stale connection.
+		pc.Close()
+		if pc, err = p.dial(); err != nil {
+			p.failed(err)
+			return err
+		}
+		err = fn(pc)
+	}
+	if _, ok := err.(resp.Error); err != nil && !ok {
+		pc.Close()
+		p.failed(err)
+		return err
+	}
+	p.Lock()
+	pc.lastUsed = time.Now()
+	p.idle = append(p.idle, pc)
+	p.failures = 0
+	p.down = false
+	p.lastOK = pc.lastUsed
+	p.Unlock()
+	return err
+}
+
+// get takes an idle connection, or dials one when there is none.
+func (p *Pool) get() (*poolConn, bool, error) {
+	p.Lock()
+	if n := len(p.idle); n > 0 {
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.reuses++
+		p.Unlock()
+		return pc, true, nil
+	}
+	p.Unlock()
+	pc, err := p.dial()
+	return pc, false, err
+}
+
+func (p *Pool) dial() (*poolConn, error) {
+	p.Lock()
+	p.dials++
+	p.Unlock()
+	nc, err := net.DialTimeout("tcp", p.Addr, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	counted := &countingConn{Conn: nc}
+	conn := resp.NewConn(counted)
+	conn.ReadTimeout, conn.WriteTimeout = ReadTimeout, WriteTimeout
+	return &poolConn{Conn: conn, counted: counted}, nil
+}
+
+func (p *Pool) failed(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.errs++
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		p.timeouts++
+	}
+	p.failures++
+	p.lastErr = err
+	if p.failures >= MaxFailures {
+		p.down = true
+	}
+}
+
+// Stats reports the pool's state as field/value pairs.
+func (p *Pool) Stats() []string {
+	p.Lock()
+	defer p.Unlock()
+	lastErr := ""
+	if p.lastErr != nil {
+		lastErr = p.lastErr.Error()
+	}
+	lastOK := ""
+	if !p.lastOK.IsZero() {
+		lastOK = p.lastOK.Format(time.RFC3339)
+	}
+	return []string{
+		"addr", p.Addr,
+		"healthy", fmt.Sprintf("%t", !p.down),
+		"in-use", strconv.Itoa(len(p.slots)),
+		"idle", strconv.Itoa(len(p.idle)),
+		"max", strconv.Itoa(cap(p.slots)),
+		"dials", strconv.FormatInt(p.dials, 10),
+		"reuses", strconv.FormatInt(p.reuses, 10),
+		"errors", strconv.FormatInt(p.errs, 10),
+		"timeouts", strconv.FormatInt(p.timeouts, 10),
+		"consecutive-failures", strconv.Itoa(p.failures),
+		"last-ok", lastOK,
+		"last-error", lastErr,
+	}
+}
+
+// PoolStats reports the connection pool of every managing sentinel, for the
+// POOLSTATS command.
+func PoolStats() [][]string {
+	var stats [][]string
+	for _, sa := range Sentinels.List() {
+		stats = append(stats, PoolFor(sa).Stats())
+	}
+	return stats
+}
+
+// GetMasterAddr asks a sentinel for a pod's master address. An empty host
+// means the sentinel doesn't know the pod.
+func GetMasterAddr(sa, name string) (string, string, error) {
+	reply, err := PoolFor(sa).Do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", name)
+	if err != nil {
+		return "", "", err
+	}
+	if reply == nil {
+		return "", "", nil
+	}
+	if arr, ok := reply.([]interface{}); ok && arr == nil {
+		return "", "", nil
+	}
+	addr, err := resp.Strings(reply)
+	if err != nil || len(addr) != 2 {
+		return "", "", resp.UnexpectedReply
+	}
+	return addr[0], addr[1], nil
+}
+
+// GetMaster asks a sentinel for a pod's details as field/value pairs.
+func GetMaster(sa, name string) ([]string, error) {
+	reply, err := PoolFor(sa).Do("SENTINEL", "MASTER", name)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Strings(reply)
+}
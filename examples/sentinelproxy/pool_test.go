@@ -0,0 +1,51 @@
+package sentinelproxy
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPoolDoesNotRepeatSentCommands(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The sentinel answers the first command and drops the connection
+	// after reading any other without answering.
+	var received int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, ok := mustRead(r).(error); ok {
+						return
+					}
+					if atomic.AddInt32(&received, 1) > 1 {
+						return
+					}
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}()
+		}
+	}()
+
+	p := PoolFor(l.Addr().String())
+	if _, err := p.Do("SENTINEL", "FAILOVER", "cache"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Do("SENTINEL", "FAILOVER", "cache"); err == nil {
+		t.Fatal("a command left unanswered succeeded")
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Errorf("the sentinel received %d commands, want 2", n)
+	}
+}
@@ -0,0 +1,79 @@
+// Package sentinelproxy is what the example proxies share for talking to
+// the managing sentinels behind them: pooled connections, discovery and
+// health tracking, an event-driven master address cache and pass-through
+// of commands the proxies don't handle themselves.
+package sentinelproxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// Sentinels are the managing sentinels a proxy asks about pods.
+var Sentinels = NewSentinelSet()
+
+// SentinelSet is a set of sentinel addresses. It is shared by client
+// connections and background discovery, so access is locked.
+type SentinelSet struct {
+	sync.RWMutex
+	addrs map[string]struct{}
+}
+
+func NewSentinelSet() *SentinelSet {
+	return &SentinelSet{addrs: make(map[string]struct{})}
+}
+
+// Add adds a sentinel and reports whether it was already there.
+func (c *SentinelSet) Add(address string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, exists := c.addrs[address]
+	c.addrs[address] = struct{}{}
+	return exists
+}
+
+func (c *SentinelSet) Remove(address string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.addrs, address)
+}
+
+func (c *SentinelSet) Contains(address string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, exists := c.addrs[address]
+	return exists
+}
+
+// List returns the addresses in order.
+func (c *SentinelSet) List() []string {
+	c.RLock()
+	defer c.RUnlock()
+	list := make([]string, 0, len(c.addrs))
+	for address := range c.addrs {
+		list = append(list, address)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (c *SentinelSet) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.addrs)
+}
+
+// Command is a client command as the proxies parse it.
+type Command interface {
+	ArgCount() int
+	Get(index int) []byte
+}
+
+// Args returns a command's arguments as strings.
+func Args(c Command) []string {
+	args := make([]string, 0, c.ArgCount())
+	for i := 0; i < c.ArgCount(); i++ {
+		args = append(args, string(c.Get(i)))
+	}
+	return args
+}
@@ -117,3 +117,20 @@ func SendBulkStrings(w *bufio.Writer, strs []string) error {
 	}
 	return SendBulks(w, t)
 }
+func SendBulkStringArrays(w *bufio.Writer, arrs [][]string) error {
+	pre := "*" + intToString(int64(len(arrs))) + "\r\n"
+	_, e := w.Write([]byte(pre))
+	if e != nil {
+		return e
+	}
+	for _, strs := range arrs {
+		t := make([][]byte, 0, len(strs))
+		for i := 0; i < len(strs); i++ {
+			t = append(t, []byte(strs[i]))
+		}
+		if e = sendBulks(w, t); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	NoSuchVersion = errors.New("NOSUCHVERSION version is not in the history")
+
+	HistoryMaxEntries = 1000
+)
+
+// PodChange is what one version did to one pod. A nil Before means the pod
+// was added, a nil After that it was removed.
+type PodChange struct {
+	Name   string
+	Before *RedisPod
+	After  *RedisPod
+}
+
+// HistoryEntry is one recorded version.
+type HistoryEntry struct {
+	Version uint64
+	Time    time.Time
+	Actor   string
+	Command string
+	Changes []PodChange
+}
+
+// History remembers the last HistoryMaxEntries changes made to a PodStore's
+// pods so they can be reviewed and undone. It is kept with the store, so it
+// is persisted and replicated with it.
+type History struct {
+	sync.Mutex
+	entries []HistoryEntry
+	version uint64
+}
+
+type historyState struct {
+	Entries []HistoryEntry `json:",omitempty"`
+	Version uint64         `json:",omitempty"`
+}
+
+// Record adds a new version and returns its number.
+func (h *History) Record(actor, command string, at time.Time, changes []PodChange) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	h.version++
+	h.entries = append(h.entries, HistoryEntry{
+		Version: h.version,
+		Time:    at,
+		Actor:   actor,
+		Command: command,
+		Changes: changes,
+	})
+	if len(h.entries) > HistoryMaxEntries {
+		h.entries = h.entries[len(h.entries)-HistoryMaxEntries:]
+	}
+	return h.version
+}
+
+// Version returns the latest version.
+func (h *History) Version() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.version
+}
+
+func (h *History) state() historyState {
+	h.Lock()
+	defer h.Unlock()
+	return historyState{Entries: h.entries, Version: h.version}
+}
+
+func (h *History) restore(st historyState) {
+	h.Lock()
+	defer h.Unlock()
+	h.entries = st.Entries
+	h.version = st.Version
+}
+
+// Entries lists the recorded versions, oldest first, optionally only those
+// touching pod.
+func (h *History) Entries(pod string) []HistoryEntry {
+	h.Lock()
+	defer h.Unlock()
+	var out []HistoryEntry
+	for _, e := range h.entries {
+		if pod == "" || e.touches(pod) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (e HistoryEntry) touches(pod string) bool {
+	for _, ch := range e.Changes {
+		if ch.Name == pod {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion fails when v is newer than the latest version or older than
+// the oldest one still held. Version 0 is the state before the first entry
+// and stays valid while that entry is held.
+func (h *History) checkVersion(v uint64) error {
+	if v > h.version {
+		return NoSuchVersion
+	}
+	if len(h.entries) > 0 && v+1 < h.entries[0].Version {
+		return NoSuchVersion
+	}
+	return nil
+}
+
+// StatesAt works out what each pod changed after version v looked like at
+// v, given the current pods. A nil state means the pod did not exist.
+func (h *History) StatesAt(v uint64) (map[string]*RedisPod, error) {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.checkVersion(v); err != nil {
+		return nil, err
+	}
+	states := make(map[string]*RedisPod)
+	for _, e := range h.entries {
+		if e.Version <= v {
+			continue
+		}
+		for _, ch := range e.Changes {
+			if _, seen := states[ch.Name]; !seen {
+				states[ch.Name] = ch.Before
+			}
+		}
+	}
+	return states, nil
+}
+
+// Diff returns the pods that changed between versions from and to, with
+// their state at each.
+func (h *History) Diff(from, to uint64) (map[string][2]*RedisPod, error) {
+	h.Lock()
+	defer h.Unlock()
+	if from > to {
+		from, to = to, from
+	}
+	if err := h.checkVersion(from); err != nil {
+		return nil, err
+	}
+	if err := h.checkVersion(to); err != nil {
+		return nil, err
+	}
+	diff := make(map[string][2]*RedisPod)
+	for _, e := range h.entries {
+		if e.Version <= from || e.Version > to {
+			continue
+		}
+		for _, ch := range e.Changes {
+			states, seen := diff[ch.Name]
+			if !seen {
+				states[0] = ch.Before
+			}
+			states[1] = ch.After
+			diff[ch.Name] = states
+		}
+	}
+	return diff, nil
+}
+
+// podFields lists the fields of a pod that history compares, in a stable
+// order. Passwords are never shown, only whether they changed.
+func podFields(pod *RedisPod) [][2]string {
+	if pod == nil {
+		return nil
+	}
+	pass := ""
+	if pod.AuthPass != "" {
+		pass = "(set)"
+	}
+	return [][2]string{
+		{"ip", pod.IP},
+		{"port", pod.Port},
+		{"quorum", pod.Quorum},
+		{"auth-user", pod.AuthUser},
+		{"auth-pass", pass},
+		{"parallel-syncs", fmt.Sprintf("%d", pod.ParallelSyncs)},
+		{"down-after-milliseconds", fmt.Sprintf("%d", pod.DownAfterMilliseconds)},
+		{"failover-timeout", fmt.Sprintf("%d", pod.FailoverTimeout)},
+		{"notification-script", pod.NotificationScript},
+		{"client-reconfig-script", pod.ClientReconfigScript},
+	}
+}
+
+// describeChange renders a pod's change as lines such as
+// "cache quorum 2 -> 3", "+cache 10.0.0.1:6379" or "-cache".
+func describeChange(name string, before, after *RedisPod) []string {
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []string{fmt.Sprintf("+%s %s:%s", name, after.IP, after.Port)}
+	case after == nil:
+		return []string{"-" + name}
+	}
+	var lines []string
+	bf, af := podFields(before), podFields(after)
+	for i := range bf {
+		if bf[i][1] != af[i][1] {
+			lines = append(lines, fmt.Sprintf("%s %s %s -> %s", name, bf[i][0], bf[i][1], af[i][1]))
+		}
+	}
+	if before.AuthPass != after.AuthPass && bf[4][1] == af[4][1] {
+		lines = append(lines, name+" auth-pass changed")
+	}
+	return lines
+}
+
+func sortedPodNames(m map[string][2]*RedisPod) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// originOf says who sent c, for the change history.
+func originOf(c *Command) Origin {
+	return Origin{Actor: c.Session.Actor(), Command: commandLine(c), Time: time.Now()}
+}
+
+// commandLine renders a command for the history, hiding passwords.
+func commandLine(c *Command) string {
+	args := make([]string, 0, c.ArgCount())
+	for i := 0; i < c.ArgCount(); i++ {
+		args = append(args, string(c.Get(i)))
+	}
+	if len(args) > 4 && strings.EqualFold(args[1], "SET") && strings.EqualFold(args[3], "AUTH-PASS") {
+		args[4] = "***"
+	}
+	return strings.Join(args, " ")
+}
+
+// rollback returns every pod changed after version v, or only pod when
+// given, to its state at v. The pods are restored by a single mutation,
+// recorded as a new version.
+func rollback(c *Command, v uint64, pod string) (uint64, error) {
+	states, err := store.History().StatesAt(v)
+	if err != nil {
+		return 0, err
+	}
+	if pod != "" {
+		target, changed := states[pod]
+		states = map[string]*RedisPod{}
+		if changed {
+			states[pod] = target
+		}
+	}
+	if len(states) > 0 {
+		if err := commit(stamp(originOf(c), Mutation{Op: OpRestore, Pods: states})); err != nil {
+			return 0, err
+		}
+	}
+	return store.History().Version(), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// useDurable points the command handlers at a durable registry in dir and
+// puts the previous globals back when the test ends.
+func useDurable(t *testing.T, dir string) *DurableRegistry {
+	oldStore, oldRegistry, oldBackend := store, registry, backend
+	t.Cleanup(func() { store, registry, backend = oldStore, oldRegistry, oldBackend })
+	s := NewPodStore()
+	r, err := NewDurableRegistry(DurableConfig{Dir: dir, Fsync: FsyncAlways}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, registry, backend = s, r, &StoreBackend{Registry: r, Store: s}
+	return r
+}
+
+// run sends a command from ops@10.1.1.1:5000 to handler and returns the
+// reply.
+func run(t *testing.T, handler func(*Command, *bufio.Writer) error, args ...string) string {
+	argv := make([][]byte, len(args))
+	for i, a := range args {
+		argv[i] = []byte(a)
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := handler(&Command{argv: argv, Session: &Session{Addr: "10.1.1.1:5000", User: "ops"}}, w); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func TestHistoryRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := useDurable(t, dir)
+
+	run(t, sentinelMonitor, "SENTINEL", "MONITOR", "cache", "10.0.0.1", "6379", "2")
+	run(t, sentinelSet, "SENTINEL", "SET", "cache", "parallel-syncs", "3")
+	run(t, sentinelSet, "SENTINEL", "SET", "cache", "auth-pass", "hunter2")
+	run(t, sentinelMonitor, "SENTINEL", "MONITOR", "queue", "10.0.0.2", "6379", "2")
+
+	entries := store.History().Entries("")
+	if len(entries) != 4 {
+		t.Fatalf("recorded %d versions, want 4", len(entries))
+	}
+	if e := entries[1]; e.Actor != "ops@10.1.1.1:5000" || e.Command != "SENTINEL SET cache parallel-syncs 3" {
+		t.Errorf("version 2 was recorded as %q by %q", e.Command, e.Actor)
+	}
+	if e := entries[2]; strings.Contains(e.Command, "hunter2") {
+		t.Errorf("the history holds a password: %q", e.Command)
+	}
+
+	// Rolling back to version 1 puts parallel-syncs back to 0 and removes
+	// queue, in one new version.
+	if reply := run(t, historyCommand, "HISTORY", "ROLLBACK", "1"); reply != ":5\r\n" {
+		t.Fatalf("ROLLBACK replied %q", reply)
+	}
+	pod, _ := store.Get("cache")
+	if pod.ParallelSyncs != 0 || pod.AuthPass != "" {
+		t.Errorf("cache was not rolled back: %+v", pod)
+	}
+	if _, exists := store.Get("queue"); exists {
+		t.Errorf("queue survived a rollback to before it was added")
+	}
+	entries = store.History().Entries("")
+	if len(entries) != 5 || len(entries[4].Changes) != 2 {
+		t.Fatalf("the rollback was not recorded as one version changing both pods: %+v", entries[len(entries)-1])
+	}
+
+	// The history is kept with the pods across a restart, both from the
+	// log and from a snapshot.
+	r.Close()
+	r = useDurable(t, dir)
+	if v := store.History().Version(); v != 5 {
+		t.Errorf("recovered history at version %d, want 5", v)
+	}
+	if err := r.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	r = useDurable(t, dir)
+	defer r.Close()
+	entries = store.History().Entries("cache")
+	if len(entries) != 4 || entries[0].Actor != "ops@10.1.1.1:5000" {
+		t.Errorf("history for cache after a snapshot: %+v", entries)
+	}
+}
+
+func TestHistoryRecordsLoads(t *testing.T) {
+	s := NewPodStore()
+	s.Load(Origin{Actor: "pod-file", Command: "reload pods.yaml"}, map[string]RedisPod{
+		"cache": {Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"},
+	})
+	s.Load(Origin{Actor: "pod-file", Command: "reload pods.yaml"}, map[string]RedisPod{
+		"cache": {Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"},
+	})
+	entries := s.History().Entries("cache")
+	if len(entries) != 1 || entries[0].Actor != "pod-file" || entries[0].Changes[0].Before != nil {
+		t.Errorf("loads were recorded as %+v", entries)
+	}
+}
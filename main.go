@@ -46,24 +46,30 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/therealbill/palisade/credential"
+	"github.com/therealbill/palisade/sentinel"
 )
 
 type CommandHandler func(*Command, *bufio.Writer) error
-type RedisPod struct {
-	Name          string
-	IP            string
-	Port          string
-	Quorum        string
-	AuthPass      string
-	ParallelSyncs int64
-}
+type (
+	RedisPod      = sentinel.RedisPod
+	KnownSentinel = sentinel.KnownSentinel
+)
 
 var (
 	stockData       map[string][]byte
 	commandHandlers map[string]CommandHandler
-	pods            map[string]RedisPod
-	tokens          map[string]bool
+	store           *PodStore
+	registry        Registry
+	backend         Backend
+	cluster         *ClusterNode
+	app             *cli.App
 )
 
 func init() {
@@ -72,22 +78,54 @@ func init() {
 	commandHandlers["SET"] = Set
 	commandHandlers["SENTINEL"] = Sentinel
 	commandHandlers["AUTH"] = authConnection
+	commandHandlers["TOKEN"] = tokenCommand
+	commandHandlers["RAFT"] = raftCommand
+	commandHandlers["HISTORY"] = historyCommand
 	stockData = make(map[string][]byte)
 	stockData["foo"] = []byte{'f', 'o', 'o'}
-	pods = make(map[string]RedisPod)
-	tokens = make(map[string]bool)
-	tokens["secretpass1"] = true
+	store = NewPodStore()
+	registry = localRegistry{store}
+	backend = &StoreBackend{Registry: registry, Store: store}
 }
 
+// authToken is the credential of --authtoken, which is accepted besides
+// the tokens in the store without being kept there.
+var authToken *credential.Credential
+
 func authConnection(c *Command, w *bufio.Writer) error {
-	token := string(c.Get(1))
-	valid, exists := tokens[token]
-	if exists && valid {
+	creds := store.Tokens()
+	if authToken != nil {
+		creds = append(creds, *authToken)
+	}
+	if credential.Check(creds, string(c.Get(1))) {
 		return nil
 	}
 	return errors.New("Invalid auth")
 }
 
+// Session describes the client connection a command came from.
+type Session struct {
+	Addr string
+	// User is who the client authenticated as, if known.
+	User string
+}
+
+// Actor names the session in logs and the change history.
+func (s *Session) Actor() string {
+	if s == nil {
+		return "internal"
+	}
+	if s.User != "" {
+		return s.User + "@" + s.Addr
+	}
+	return s.Addr
+}
+
+// commit applies a mutation through the active registry.
+func commit(m Mutation) error {
+	return registry.Apply(m)
+}
+
 func Set(command *Command, w *bufio.Writer) error {
 	log.Print("SET called")
 	key := string(command.Get(1))
@@ -110,6 +148,7 @@ func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	parser := NewParser(conn)
 	w := bufio.NewWriter(conn)
+	session := &Session{Addr: conn.RemoteAddr().String()}
 	authorized := false
 	authfails := 0
 	maxauths := 3
@@ -127,6 +166,7 @@ func handleConnection(conn net.Conn) {
 				break
 			}
 		} else {
+			command.Session = session
 			cmd := strings.ToUpper(string(command.Get(0)))
 			if cmd == "QUIT" {
 				conn.Close()
@@ -194,7 +234,372 @@ func handleConnection(conn net.Conn) {
 }
 
 func main() {
-	listener, err := net.Listen("tcp", ":6380")
+	app = cli.NewApp()
+	app.Name = "palisade"
+	app.Usage = "A partial Sentinel implementation"
+	app.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:   "port, p",
+			Value:  6380,
+			Usage:  "The port to listen on",
+			EnvVar: "PALISADE_PORT",
+		},
+		cli.StringFlag{
+			Name:   "authtoken",
+			Usage:  "A token clients can AUTH with, besides those added with TOKEN ADD",
+			EnvVar: "PALISADE_AUTHTOKEN",
+		},
+		cli.StringFlag{
+			Name:   "sentinel-conf, c",
+			Usage:  "sentinel.conf to import pods from and rewrite on SENTINEL FLUSHCONFIG",
+			EnvVar: "PALISADE_SENTINEL_CONF",
+		},
+		cli.StringFlag{
+			Name:   "pod-file, f",
+			Usage:  "YAML or JSON file defining the pods to serve",
+			EnvVar: "PALISADE_POD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "sql-driver",
+			Value:  "sqlite3",
+			Usage:  "database/sql driver for the inventory database",
+			EnvVar: "PALISADE_SQL_DRIVER",
+		},
+		cli.StringFlag{
+			Name:   "sql-dsn",
+			Usage:  "Inventory database DSN; answers pod lookups from it when set",
+			EnvVar: "PALISADE_SQL_DSN",
+		},
+		cli.StringFlag{
+			Name:   "sql-pod-query",
+			Value:  DefaultSQLPodQuery,
+			Usage:  "Query taking a pod name (as ?) and returning ip, port, auth password",
+			EnvVar: "PALISADE_SQL_POD_QUERY",
+		},
+		cli.StringFlag{
+			Name:   "sql-replica-query",
+			Value:  DefaultSQLReplicaQuery,
+			Usage:  "Query taking a pod name (as ?) and returning ip, port per replica",
+			EnvVar: "PALISADE_SQL_REPLICA_QUERY",
+		},
+		cli.DurationFlag{
+			Name:   "sql-cache-ttl",
+			Value:  DefaultSQLCacheTTL,
+			Usage:  "How long inventory answers are cached",
+			EnvVar: "PALISADE_SQL_CACHE_TTL",
+		},
+		cli.StringSliceFlag{
+			Name:   "redis-cluster-seed",
+			Usage:  "Redis Cluster node to read the topology from; serves its shards as pods",
+			EnvVar: "PALISADE_REDIS_CLUSTER_SEEDS",
+		},
+		cli.DurationFlag{
+			Name:   "redis-cluster-poll",
+			Value:  DefaultRedisClusterPoll,
+			Usage:  "How often the Redis Cluster topology is refreshed",
+			EnvVar: "PALISADE_REDIS_CLUSTER_POLL",
+		},
+		cli.StringFlag{
+			Name:   "redis-cluster-pod-name",
+			Value:  DefaultRedisClusterPodName,
+			Usage:  "Pod name for each shard using {start}, {end}, {index} and {master-id}",
+			EnvVar: "PALISADE_REDIS_CLUSTER_POD_NAME",
+		},
+		cli.IntFlag{
+			Name:   "redis-cluster-quorum",
+			Usage:  "Quorum reported for each shard; a majority of the masters when 0",
+			EnvVar: "PALISADE_REDIS_CLUSTER_QUORUM",
+		},
+		cli.StringFlag{
+			Name:   "dns-domain",
+			Usage:  "Resolve pods as SRV/A records under this domain",
+			EnvVar: "PALISADE_DNS_DOMAIN",
+		},
+		cli.StringFlag{
+			Name:   "dns-server",
+			Usage:  "Resolver host:port; defaults to the first in /etc/resolv.conf",
+			EnvVar: "PALISADE_DNS_SERVER",
+		},
+		cli.DurationFlag{
+			Name:   "dns-interval",
+			Value:  DefaultDNSInterval,
+			Usage:  "How often expired DNS answers are refreshed",
+			EnvVar: "PALISADE_DNS_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "sentinel-name, n",
+			Value:  "palisade",
+			Usage:  "The name of this sentinel, used to find its pods in Consul",
+			EnvVar: "PALISADE_SENTINEL_NAME",
+		},
+		cli.StringFlag{
+			Name:   "consul-addr",
+			Usage:  "Consul HTTP address; keeps pods in Consul when set",
+			EnvVar: "PALISADE_CONSUL_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "consul-token",
+			Usage:  "Consul ACL token",
+			EnvVar: "PALISADE_CONSUL_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "consul-datacenter",
+			Usage:  "Consul datacenter",
+			EnvVar: "PALISADE_CONSUL_DATACENTER",
+		},
+		cli.StringFlag{
+			Name:   "consul-prefix",
+			Value:  "palisade",
+			Usage:  "Consul KV prefix palisade keeps its data under",
+			EnvVar: "PALISADE_CONSUL_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "data-dir, d",
+			Usage:  "Directory to persist pods and tokens in; survives restarts when set",
+			EnvVar: "PALISADE_DATA_DIR",
+		},
+		cli.StringFlag{
+			Name:   "fsync",
+			Value:  FsyncEverySec,
+			Usage:  "When the log is fsynced: always, everysec or no",
+			EnvVar: "PALISADE_FSYNC",
+		},
+		cli.DurationFlag{
+			Name:   "snapshot-interval",
+			Value:  DefaultSnapshotInterval,
+			Usage:  "How often the log is compacted into a snapshot",
+			EnvVar: "PALISADE_SNAPSHOT_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "backend",
+			Value:  "memory",
+			Usage:  "Backend chain ending in memory or proxy, e.g. passwords,sharding,proxy",
+			EnvVar: "PALISADE_BACKEND",
+		},
+		cli.StringSliceFlag{
+			Name:   "sentineladdr, s",
+			Usage:  "ip:port of a managing sentinel for the proxy backend",
+			EnvVar: "PALISADE_MANAGINGSENTINELS",
+		},
+		cli.IntFlag{
+			Name:   "shards",
+			Value:  1,
+			Usage:  "Number of shards for the sharding backend",
+			EnvVar: "PALISADE_SHARDS",
+		},
+		cli.StringFlag{
+			Name:   "shard-name",
+			Value:  "shard-%d",
+			Usage:  "Pod name of each shard for the sharding backend",
+			EnvVar: "PALISADE_SHARD_NAME",
+		},
+		cli.StringFlag{
+			Name:   "raft-id",
+			Usage:  "Node ID; enables cluster mode when set",
+			EnvVar: "PALISADE_RAFT_ID",
+		},
+		cli.StringFlag{
+			Name:   "raft-bind",
+			Value:  "127.0.0.1:7380",
+			Usage:  "Address to serve cluster traffic on",
+			EnvVar: "PALISADE_RAFT_BIND",
+		},
+		cli.StringFlag{
+			Name:   "raft-client-addr",
+			Usage:  "Address clients reach this node on, given to clients writing to a follower; defaults to the --raft-bind host and --port",
+			EnvVar: "PALISADE_RAFT_CLIENT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "raft-dir",
+			Usage:  "Directory for the cluster log and snapshots",
+			EnvVar: "PALISADE_RAFT_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "raft-bootstrap",
+			Usage:  "Bootstrap a new cluster with this node as the only member",
+			EnvVar: "PALISADE_RAFT_BOOTSTRAP",
+		},
+		cli.BoolFlag{
+			Name:   "raft-consistent-reads",
+			Usage:  "Only answer reads on the leader",
+			EnvVar: "PALISADE_RAFT_CONSISTENT_READS",
+		},
+	}
+	app.Action = serve
+	app.Run(os.Args)
+}
+
+func serve(c *cli.Context) {
+	if token := c.String("authtoken"); token != "" {
+		cred, err := credential.New(token, time.Time{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		authToken = &cred
+	}
+	sources := 0
+	for _, flag := range []string{"pod-file", "consul-addr", "sql-dsn", "dns-domain", "raft-id"} {
+		if c.String(flag) != "" {
+			sources++
+		}
+	}
+	if len(c.StringSlice("redis-cluster-seed")) > 0 {
+		sources++
+	}
+	if sources > 1 {
+		log.Fatal("only one of --pod-file, --consul-addr, --sql-dsn, --dns-domain, --redis-cluster-seed and --raft-id may be given")
+	}
+	if domain := c.String("dns-domain"); domain != "" {
+		cfg := DNSConfig{
+			Domain:   domain,
+			Server:   c.String("dns-server"),
+			Interval: c.Duration("dns-interval"),
+		}
+		var err error
+		registry, err = NewDNSRegistry(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to set up DNS discovery: %v", err)
+		}
+	}
+	if seeds := c.StringSlice("redis-cluster-seed"); len(seeds) > 0 {
+		cfg := RedisClusterConfig{
+			Seeds:        seeds,
+			PollInterval: c.Duration("redis-cluster-poll"),
+			PodName:      c.String("redis-cluster-pod-name"),
+			Quorum:       c.Int("redis-cluster-quorum"),
+		}
+		var err error
+		registry, err = NewRedisClusterRegistry(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to read Redis Cluster topology: %v", err)
+		}
+	}
+	if dsn := c.String("sql-dsn"); dsn != "" {
+		cfg := SQLConfig{
+			Driver:       c.String("sql-driver"),
+			DSN:          dsn,
+			PodQuery:     c.String("sql-pod-query"),
+			ReplicaQuery: c.String("sql-replica-query"),
+			CacheTTL:     c.Duration("sql-cache-ttl"),
+		}
+		var err error
+		registry, err = NewSQLRegistry(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to open inventory database: %v", err)
+		}
+	}
+	if path := c.String("pod-file"); path != "" {
+		var err error
+		registry, err = NewFileRegistry(path, store)
+		if err != nil {
+			log.Fatalf("unable to load pod file: %v", err)
+		}
+	}
+	if addr := c.String("consul-addr"); addr != "" {
+		cfg := ConsulConfig{
+			Address:      addr,
+			Token:        c.String("consul-token"),
+			Datacenter:   c.String("consul-datacenter"),
+			Prefix:       c.String("consul-prefix"),
+			SentinelName: c.String("sentinel-name"),
+		}
+		var err error
+		registry, err = NewConsulRegistry(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to load pods from consul: %v", err)
+		}
+		log.Printf("keeping pods in consul at %s", addr)
+	}
+	if id := c.String("raft-id"); id != "" {
+		cfg := ClusterConfig{
+			ID:              id,
+			BindAddr:        c.String("raft-bind"),
+			ClientAddr:      c.String("raft-client-addr"),
+			DataDir:         c.String("raft-dir"),
+			Bootstrap:       c.Bool("raft-bootstrap"),
+			ConsistentReads: c.Bool("raft-consistent-reads"),
+		}
+		if cfg.ClientAddr == "" {
+			host, _, err := net.SplitHostPort(cfg.BindAddr)
+			if err != nil {
+				log.Fatalf("invalid --raft-bind: %v", err)
+			}
+			cfg.ClientAddr = net.JoinHostPort(host, strconv.Itoa(c.Int("port")))
+		}
+		var err error
+		cluster, err = NewClusterNode(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to start cluster node: %v", err)
+		}
+		registry = cluster
+		log.Printf("cluster node %s listening on %s", id, cfg.BindAddr)
+	}
+	if dir := c.String("data-dir"); dir != "" {
+		if sources > 0 {
+			log.Fatal("--data-dir keeps palisade's own pods and can't be used with another pod source")
+		}
+		cfg := DurableConfig{
+			Dir:              dir,
+			Fsync:            c.String("fsync"),
+			SnapshotInterval: c.Duration("snapshot-interval"),
+		}
+		var err error
+		registry, err = NewDurableRegistry(cfg, store)
+		if err != nil {
+			log.Fatalf("unable to recover state from %s: %v", dir, err)
+		}
+	}
+	terminal := map[string]Backend{
+		"memory": &StoreBackend{Registry: registry, Store: store},
+		"proxy":  NewProxyBackend(c.StringSlice("sentineladdr")),
+	}
+	wrappers := map[string]func(Backend) Backend{
+		"sharding": func(next Backend) Backend {
+			return &ShardingBackend{Next: next, Shards: c.Int("shards"), NameFormat: c.String("shard-name")}
+		},
+		"passwords": func(next Backend) Backend { return NewPodPasswordBackend(next) },
+	}
+	var err error
+	backend, err = BuildBackend(c.String("backend"), terminal, wrappers)
+	if err != nil {
+		log.Fatalf("invalid --backend: %v", err)
+	}
+	if c.Int("shards") < 1 {
+		log.Fatal("--shards must be at least 1")
+	}
+	if path := c.String("sentinel-conf"); path != "" {
+		var err error
+		sentinelConf, err = LoadSentinelConf(path)
+		if err != nil {
+			log.Fatalf("unable to read %s: %v", path, err)
+		}
+		// Pods already known, say from --data-dir, keep the changes made
+		// to them since they were first imported.
+		known, err := backend.ListMasters()
+		if err != nil {
+			log.Fatalf("unable to list pods to import %s: %v", path, err)
+		}
+		have := make(map[string]bool, len(known))
+		for _, pod := range known {
+			have[pod.Name] = true
+		}
+		imported := 0
+		for _, pod := range sentinelConf.Pods {
+			if have[pod.Name] {
+				continue
+			}
+			o := Origin{Actor: "sentinel-conf", Command: "import " + path}
+			if err := backend.Monitor(o, pod); err != nil {
+				log.Fatalf("unable to import pod '%s' from %s: %v", pod.Name, path, err)
+			}
+			imported++
+		}
+		log.Printf("imported %d of %d pods from %s", imported, len(sentinelConf.Pods), path)
+	}
+	if authToken == nil && !store.HasTokens() {
+		log.Print("no --authtoken given and no tokens stored, clients can't AUTH until one is")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Int("port")))
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/therealbill/palisade/credential"
+)
+
+var NoSuchToken = errors.New("ERR no such token")
+
+// tokenCommand manages auth tokens:
+//
+//	TOKEN ADD <token> [TTL <seconds>]
+//	TOKEN LIST
+//	TOKEN EXPIRE <id> <seconds>
+//	TOKEN DEL <token|id>
+//
+// To rotate a token without downtime, add the new one, move clients over
+// and EXPIRE the old one.
+func tokenCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var args []string
+	for i := 2; i < c.ArgCount(); i++ {
+		args = append(args, string(c.Get(i)))
+	}
+	arity := map[string]int{"ADD": 1, "LIST": 0, "EXPIRE": 2, "DEL": 1}
+	n, known := arity[subcomm]
+	if !known {
+		return SendError(w, fmt.Sprintf("Command 'TOKEN %s' not supported", subcomm))
+	}
+	if len(args) < n {
+		return SendError(w, "ERR wrong number of arguments for 'token' command")
+	}
+	switch subcomm {
+	case "ADD":
+		expires, err := credential.ParseTTL(args[1:])
+		if err != nil {
+			return SendError(w, err.Error())
+		}
+		cred, err := credential.New(args[0], expires)
+		if err != nil {
+			return SendError(w, "ERR "+err.Error())
+		}
+		if err := commit(Mutation{Op: OpAddToken, Value: cred.String()}); err != nil {
+			return SendError(w, err.Error())
+		}
+		return SendBulkString(w, cred.ID())
+	case "LIST":
+		now := time.Now()
+		var list [][]string
+		for _, cred := range store.Tokens() {
+			kind, expires, state := "bcrypt", "", "active"
+			if cred.Legacy() {
+				kind = "sha256"
+			}
+			if !cred.Expires.IsZero() {
+				expires = cred.Expires.UTC().Format(time.RFC3339)
+			}
+			if cred.Expired(now) {
+				state = "expired"
+			}
+			list = append(list, []string{"id", cred.ID(), "kind", kind, "expires", expires, "state", state})
+		}
+		return SendBulkStringArrays(w, list)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || seconds < 0 {
+			return SendError(w, "ERR expiry must be a number of seconds, 0 for now")
+		}
+		for _, cred := range store.Tokens() {
+			if cred.ID() == args[0] {
+				cred.Expires = time.Now().Add(time.Duration(seconds) * time.Second)
+				if err := commit(Mutation{Op: OpAddToken, Value: cred.String()}); err != nil {
+					return SendError(w, err.Error())
+				}
+				return SendOk(w)
+			}
+		}
+		return SendError(w, NoSuchToken.Error())
+	case "DEL":
+		deleted := 0
+		for _, cred := range store.Tokens() {
+			if cred.ID() != args[0] && !cred.Matches(args[0]) {
+				continue
+			}
+			if err := commit(Mutation{Op: OpDelToken, Value: cred.Hash}); err != nil {
+				return SendError(w, err.Error())
+			}
+			deleted++
+		}
+		if deleted == 0 {
+			return SendError(w, NoSuchToken.Error())
+		}
+	}
+	return SendOk(w)
+}
+
+// raftCommand manages cluster membership:
+//
+//	RAFT STATUS
+//	RAFT JOIN <id> <raft-addr>
+//	RAFT LEAVE <id>
+//	RAFT SNAPSHOT
+func raftCommand(c *Command, w *bufio.Writer) error {
+	if cluster == nil {
+		return SendError(w, ClusterDisabled.Error())
+	}
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	var err error
+	switch subcomm {
+	case "STATUS":
+		return raftStatus(w)
+	case "JOIN":
+		err = cluster.Join(string(c.Get(2)), string(c.Get(3)))
+	case "LEAVE":
+		err = cluster.Leave(string(c.Get(2)))
+	case "SNAPSHOT":
+		err = cluster.Snapshot()
+	default:
+		return SendError(w, fmt.Sprintf("Command 'RAFT %s' not supported", subcomm))
+	}
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
+}
+
+func raftStatus(w *bufio.Writer) error {
+	members, err := cluster.Members()
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	leader, leaderAddr := cluster.Leader()
+	info := []string{
+		"id", cluster.Config.ID,
+		"state", cluster.Raft.State().String(),
+		"leader", leader,
+		"leader-addr", leaderAddr,
+		"applied-index", fmt.Sprintf("%d", cluster.Raft.AppliedIndex()),
+	}
+	for _, m := range members {
+		info = append(info, "member", fmt.Sprintf("%s %s %s", m.ID, m.Address, m.Suffrage))
+	}
+	return SendBulkStrings(w, info)
+}
+
+// historyCommand reviews and undoes pod changes:
+//
+//	HISTORY LIST [pod]
+//	HISTORY DIFF <from-version> <to-version>
+//	HISTORY ROLLBACK <version> [pod]
+func historyCommand(c *Command, w *bufio.Writer) error {
+	subcomm := strings.ToUpper(string(c.Get(1)))
+	switch subcomm {
+	case "LIST":
+		return historyList(w, string(c.Get(2)))
+	case "DIFF":
+		from, err1 := strconv.ParseUint(string(c.Get(2)), 10, 64)
+		to, err2 := strconv.ParseUint(string(c.Get(3)), 10, 64)
+		if err1 != nil || err2 != nil {
+			return SendError(w, ExpectNumber.Error())
+		}
+		return historyDiff(w, from, to)
+	case "ROLLBACK":
+		v, err := strconv.ParseUint(string(c.Get(2)), 10, 64)
+		if err != nil {
+			return SendError(w, ExpectNumber.Error())
+		}
+		version, err := rollback(c, v, string(c.Get(3)))
+		if err != nil {
+			return SendError(w, err.Error())
+		}
+		log.Printf("%s rolled back to version %d as version %d", c.Session.Actor(), v, version)
+		return SendInt(w, int64(version))
+	}
+	return SendError(w, fmt.Sprintf("Command 'HISTORY %s' not supported", subcomm))
+}
+
+func historyList(w *bufio.Writer, pod string) error {
+	entries := store.History().Entries(pod)
+	infos := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		var changes []string
+		for _, ch := range e.Changes {
+			changes = append(changes, describeChange(ch.Name, ch.Before, ch.After)...)
+		}
+		infos = append(infos, []string{
+			"version", strconv.FormatUint(e.Version, 10),
+			"time", e.Time.Format(time.RFC3339),
+			"actor", e.Actor,
+			"command", e.Command,
+			"changes", strings.Join(changes, "; "),
+		})
+	}
+	return SendBulkStringArrays(w, infos)
+}
+
+func historyDiff(w *bufio.Writer, from, to uint64) error {
+	diff, err := store.History().Diff(from, to)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	lines := []string{}
+	for _, name := range sortedPodNames(diff) {
+		lines = append(lines, describeChange(name, diff[name][0], diff[name][1])...)
+	}
+	return SendBulkStrings(w, lines)
+}
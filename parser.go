@@ -35,6 +35,8 @@ func (p *ProtocolError) Error() string {
 
 type Command struct {
 	argv [][]byte
+	// Session is the connection the command arrived on.
+	Session *Session
 }
 
 func (c *Command) Get(index int) []byte {
@@ -202,7 +204,7 @@ func (r *RedisParser) parseBinary() (*Command, error) {
 			return nil, e
 		}
 	}
-	return &Command{argv}, nil
+	return &Command{argv: argv}, nil
 }
 func (r *RedisParser) parseTelnet() (*Command, error) {
 	nlPos := -1
@@ -220,7 +222,7 @@ func (r *RedisParser) parseTelnet() (*Command, error) {
 		}
 	}
 	r.reset()
-	return &Command{bytes.Split(r.buffer[:nlPos-1], spaceSlice)}, nil
+	return &Command{argv: bytes.Split(r.buffer[:nlPos-1], spaceSlice)}, nil
 }
 
 func (r *RedisParser) reset() {
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	PodFileReadOnly = errors.New("READONLY pods are defined in the pod file")
+
+	PodFilePollInterval = time.Second
+)
+
+// podFile is the on-disk layout of a pod file. YAML and JSON use the same
+// keys:
+//
+//	pods:
+//	  - name: cache
+//	    ip: 10.0.0.1
+//	    port: 6379
+//	    quorum: 2
+//	    auth-user: sentinel
+//	    auth-pass: secret
+//	    parallel-syncs: 1
+//	    down-after-milliseconds: 30000
+//	    failover-timeout: 180000
+//	    replicas: ["10.0.0.2:6379"]
+//
+// The settings are checked as SENTINEL SET checks them.
+type podFile struct {
+	Pods []podFileEntry `yaml:"pods" json:"pods"`
+}
+
+type podFileEntry struct {
+	Name                  string   `yaml:"name" json:"name"`
+	IP                    string   `yaml:"ip" json:"ip"`
+	Port                  int      `yaml:"port" json:"port"`
+	Quorum                int      `yaml:"quorum" json:"quorum"`
+	AuthUser              string   `yaml:"auth-user" json:"auth-user"`
+	AuthPass              string   `yaml:"auth-pass" json:"auth-pass"`
+	ParallelSyncs         int64    `yaml:"parallel-syncs" json:"parallel-syncs"`
+	DownAfterMilliseconds int64    `yaml:"down-after-milliseconds" json:"down-after-milliseconds"`
+	FailoverTimeout       int64    `yaml:"failover-timeout" json:"failover-timeout"`
+	NotificationScript    string   `yaml:"notification-script" json:"notification-script"`
+	ClientReconfigScript  string   `yaml:"client-reconfig-script" json:"client-reconfig-script"`
+	Replicas              []string `yaml:"replicas" json:"replicas"`
+}
+
+// FileRegistry serves pods declared in a YAML or JSON file. The file is
+// reloaded when it changes on disk or the process receives SIGHUP. A file
+// that fails validation is ignored and the previous pods stay in place, so a
+// reload either applies completely or not at all.
+type FileRegistry struct {
+	Path  string
+	store *PodStore
+
+	sync.Mutex
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+}
+
+func NewFileRegistry(path string, store *PodStore) (*FileRegistry, error) {
+	f := &FileRegistry{Path: path, store: store, done: make(chan struct{})}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	go f.watch()
+	return f, nil
+}
+
+// Apply refuses pod changes, which must be made in the file. Token changes
+// are applied locally.
+func (f *FileRegistry) Apply(m Mutation) error {
+	switch m.Op {
+	case OpMonitor, OpSet, OpRemove, OpRestore:
+		return PodFileReadOnly
+	}
+	return f.store.Apply(m)
+}
+
+func (f *FileRegistry) ReadBarrier() error {
+	return nil
+}
+
+// Reload reads, validates and loads the pod file.
+func (f *FileRegistry) Reload() error {
+	f.Lock()
+	defer f.Unlock()
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	// Remember what we looked at even when it is invalid, so a bad file is
+	// reported once rather than on every poll.
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	pods, err := loadPodFile(f.Path)
+	if err != nil {
+		return err
+	}
+	f.store.Load(Origin{Actor: "pod-file", Command: "reload " + f.Path}, pods)
+	log.Printf("loaded %d pods from %s", len(pods), f.Path)
+	return nil
+}
+
+func (f *FileRegistry) changed() bool {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return false
+	}
+	f.Lock()
+	defer f.Unlock()
+	return !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size
+}
+
+func (f *FileRegistry) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(PodFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s", f.Path)
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+		}
+		if err := f.Reload(); err != nil {
+			log.Printf("not reloading %s: %v", f.Path, err)
+		}
+	}
+}
+
+// Close stops watching the file.
+func (f *FileRegistry) Close() {
+	close(f.done)
+}
+
+func loadPodFile(path string) (map[string]RedisPod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf podFile
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&pf)
+	} else {
+		err = yaml.UnmarshalStrict(data, &pf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pods := make(map[string]RedisPod, len(pf.Pods))
+	for i, entry := range pf.Pods {
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("%s: pod %d: %v", path, i+1, err)
+		}
+		if _, exists := pods[entry.Name]; exists {
+			return nil, fmt.Errorf("%s: pod '%s' defined more than once", path, entry.Name)
+		}
+		pod, err := entry.pod()
+		if err != nil {
+			return nil, fmt.Errorf("%s: pod %d: '%s' %v", path, i+1, entry.Name, err)
+		}
+		pods[entry.Name] = pod
+	}
+	return pods, nil
+}
+
+func (e podFileEntry) validate() error {
+	switch {
+	case e.Name == "":
+		return errors.New("name is required")
+	case net.ParseIP(e.IP) == nil:
+		return fmt.Errorf("'%s' has an invalid ip '%s'", e.Name, e.IP)
+	case e.Port < 1 || e.Port > 65535:
+		return fmt.Errorf("'%s' has an invalid port %d", e.Name, e.Port)
+	case e.Quorum < 1:
+		return fmt.Errorf("'%s' needs a quorum of at least 1", e.Name)
+	case e.ParallelSyncs < 0:
+		return fmt.Errorf("'%s' has negative parallel-syncs", e.Name)
+	case e.NotificationScript != "" && !checkScript(e.NotificationScript):
+		return fmt.Errorf("'%s' notification-script %s is not an executable file", e.Name, e.NotificationScript)
+	case e.ClientReconfigScript != "" && !checkScript(e.ClientReconfigScript):
+		return fmt.Errorf("'%s' client-reconfig-script %s is not an executable file", e.Name, e.ClientReconfigScript)
+	}
+	for _, r := range e.Replicas {
+		host, port, err := net.SplitHostPort(r)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("'%s' has an invalid replica address '%s'", e.Name, r)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("'%s' has an invalid replica port in '%s'", e.Name, r)
+		}
+	}
+	return nil
+}
+
+// pod is the pod the entry declares, with its settings applied as
+// SENTINEL SET applies them. Settings left out keep their defaults.
+func (e podFileEntry) pod() (RedisPod, error) {
+	pod := RedisPod{
+		Name:     e.Name,
+		IP:       e.IP,
+		Port:     strconv.Itoa(e.Port),
+		Replicas: e.Replicas,
+	}
+	settings := []struct {
+		name, value string
+		set         bool
+	}{
+		{"quorum", strconv.Itoa(e.Quorum), true},
+		{"auth-user", e.AuthUser, e.AuthUser != ""},
+		{"auth-pass", e.AuthPass, e.AuthPass != ""},
+		{"parallel-syncs", strconv.FormatInt(e.ParallelSyncs, 10), e.ParallelSyncs != 0},
+		{"down-after-milliseconds", strconv.FormatInt(e.DownAfterMilliseconds, 10), e.DownAfterMilliseconds != 0},
+		{"failover-timeout", strconv.FormatInt(e.FailoverTimeout, 10), e.FailoverTimeout != 0},
+		{"notification-script", e.NotificationScript, e.NotificationScript != ""},
+		{"client-reconfig-script", e.ClientReconfigScript, e.ClientReconfigScript != ""},
+	}
+	for _, setting := range settings {
+		if !setting.set {
+			continue
+		}
+		if err := applySetting(&pod, setting.name, setting.value); err != nil {
+			return pod, fmt.Errorf("%s: %v", setting.name, err)
+		}
+	}
+	return pod, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPodFileEntryQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		quorum int
+		valid  bool
+	}{{0, false}, {-1, false}, {1, true}, {3, true}} {
+		e := podFileEntry{Name: "cache", IP: "10.0.0.1", Port: 6379, Quorum: tc.quorum}
+		if err := e.validate(); (err == nil) != tc.valid {
+			t.Errorf("quorum %d: validate returned %v, want valid=%v", tc.quorum, err, tc.valid)
+		}
+	}
+}
+
+func TestPodFileEntrySettings(t *testing.T) {
+	e := podFileEntry{Name: "cache", IP: "10.0.0.1", Port: 6379, Quorum: 2, AuthUser: "sentinel", AuthPass: "secret", DownAfterMilliseconds: 30000, FailoverTimeout: 180000}
+	pod, err := e.pod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.AuthUser != "sentinel" || pod.AuthPass != "secret" || pod.DownAfterMilliseconds != 30000 || pod.FailoverTimeout != 180000 {
+		t.Errorf("the settings gave %+v", pod)
+	}
+	e.FailoverTimeout = -1
+	if _, err := e.pod(); err == nil {
+		t.Error("a negative failover-timeout was accepted")
+	}
+}
+
+// writePodFile replaces the pod file at path with the given pods, one
+// "name ip port" per entry.
+func writePodFile(t *testing.T, path string, pods ...string) {
+	t.Helper()
+	data := "pods:\n"
+	for _, pod := range pods {
+		f := strings.Fields(pod)
+		data += fmt.Sprintf("  - {name: %s, ip: %s, port: %s, quorum: 2, down-after-milliseconds: 5000}\n", f[0], f[1], f[2])
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPodFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-podfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pods.yaml")
+	writePodFile(t, path, "cache 10.0.0.1 6379", "queue 10.0.0.2 6379")
+	store := NewPodStore()
+	f, err := NewFileRegistry(path, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	defer AddEventListener(func(pod RedisPod, etype, msg string) {
+		mu.Lock()
+		events = append(events, etype+" "+pod.Name)
+		mu.Unlock()
+	})()
+
+	// A file with one bad pod changes nothing.
+	writePodFile(t, path, "cache 10.0.0.9 6379", "queue not-an-ip 6379")
+	if err := f.Reload(); err == nil {
+		t.Error("a file with an invalid pod was loaded")
+	}
+	if pod, _ := store.Get("cache"); pod.IP != "10.0.0.1" {
+		t.Errorf("a rejected file moved cache to %s", pod.IP)
+	}
+
+	writePodFile(t, path, "cache 10.0.0.9 6379", "stream 10.0.0.3 6379")
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := append([]string(nil), events...)
+	mu.Unlock()
+	sort.Strings(got)
+	want := []string{"+monitor stream", "+switch-master cache", "-monitor queue"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reloading sent %v, want %v", got, want)
+	}
+	if pod, _ := store.Get("cache"); pod.DownAfterMilliseconds != 5000 {
+		t.Errorf("cache has down-after-milliseconds %d", pod.DownAfterMilliseconds)
+	}
+}
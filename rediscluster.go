@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+var (
+	RedisClusterReadOnly = errors.New("READONLY pods are the shards of a Redis Cluster")
+	NoClusterSeed        = errors.New("no Redis Cluster seed node could be queried")
+
+	DefaultRedisClusterPoll    = 5 * time.Second
+	DefaultRedisClusterPodName = "shard-{start}"
+	RedisClusterDialTimeout    = 2 * time.Second
+)
+
+// RedisClusterConfig describes which Redis Cluster to present and how its
+// shards are named.
+type RedisClusterConfig struct {
+	// Seeds are the cluster nodes asked for the topology, in order.
+	Seeds []string
+	// PollInterval is how often the topology is refreshed.
+	PollInterval time.Duration
+	// PodName names the pod for each shard. {start} and {end} are its
+	// lowest and highest slot, {index} is the shard's position ordered by
+	// lowest slot and {master-id} is the current master's node id. Names
+	// that change show up as a removed and an added pod rather than a
+	// +switch-master: {master-id} changes on failover, and {index} renames
+	// every later shard when slots move, so the default names shards by
+	// {start}.
+	PodName string
+	// Quorum is reported as each pod's quorum. When zero it is a majority
+	// of the cluster's masters, the number that must agree a master has
+	// failed before the cluster fails it over.
+	Quorum int
+}
+
+type clusterInstance struct {
+	ID     string
+	IP     string
+	Port   string
+	Master bool
+	Failed bool
+}
+
+type clusterShard struct {
+	Start, End int
+	Master     clusterInstance
+	Replicas   []clusterInstance
+}
+
+// RedisClusterRegistry polls a Redis Cluster and presents each shard as a
+// pod, so clients that only speak Sentinel can find shard masters. When a
+// cluster failover moves a shard's master a +switch-master is announced.
+type RedisClusterRegistry struct {
+	Config RedisClusterConfig
+	store  *PodStore
+	done   chan struct{}
+}
+
+func NewRedisClusterRegistry(cfg RedisClusterConfig, store *PodStore) (*RedisClusterRegistry, error) {
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = DefaultRedisClusterPoll
+	}
+	if cfg.PodName == "" {
+		cfg.PodName = DefaultRedisClusterPodName
+	}
+	r := &RedisClusterRegistry{Config: cfg, store: store, done: make(chan struct{})}
+	if err := r.Refresh(); err != nil {
+		return nil, err
+	}
+	go r.poll()
+	return r, nil
+}
+
+func (r *RedisClusterRegistry) Apply(m Mutation) error {
+	switch m.Op {
+	case OpMonitor, OpSet, OpRemove, OpRestore:
+		return RedisClusterReadOnly
+	}
+	return r.store.Apply(m)
+}
+
+func (r *RedisClusterRegistry) ReadBarrier() error {
+	return nil
+}
+
+// Refresh fetches the topology from the first seed that answers and loads
+// the shards into the store.
+func (r *RedisClusterRegistry) Refresh() error {
+	for _, seed := range r.Config.Seeds {
+		shards, err := fetchClusterShards(seed)
+		if err != nil {
+			log.Printf("redis cluster: unable to query %s: %v", seed, err)
+			continue
+		}
+		r.store.Load(Origin{Actor: "redis-cluster", Command: "refresh from " + seed}, r.pods(shards))
+		return nil
+	}
+	return NoClusterSeed
+}
+
+func (r *RedisClusterRegistry) poll() {
+	ticker := time.NewTicker(r.Config.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.Refresh(); err != nil {
+				log.Printf("redis cluster: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops polling the cluster.
+func (r *RedisClusterRegistry) Close() {
+	close(r.done)
+}
+
+func (r *RedisClusterRegistry) pods(shards []clusterShard) map[string]RedisPod {
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Start < shards[j].Start })
+	pods := make(map[string]RedisPod, len(shards))
+	quorum := r.Config.Quorum
+	if quorum < 1 {
+		quorum = len(shards)/2 + 1
+	}
+	for i, shard := range shards {
+		name := strings.NewReplacer(
+			"{index}", strconv.Itoa(i),
+			"{start}", strconv.Itoa(shard.Start),
+			"{end}", strconv.Itoa(shard.End),
+			"{master-id}", shard.Master.ID,
+		).Replace(r.Config.PodName)
+		pod := RedisPod{Name: name, IP: shard.Master.IP, Port: shard.Master.Port, Quorum: strconv.Itoa(quorum)}
+		for _, replica := range shard.Replicas {
+			if !replica.Failed {
+				pod.Replicas = append(pod.Replicas, net.JoinHostPort(replica.IP, replica.Port))
+			}
+		}
+		pods[name] = pod
+	}
+	return pods
+}
+
+// fetchClusterShards asks a node for the topology with CLUSTER SHARDS,
+// falling back to CLUSTER NODES for servers older than Redis 7.
+func fetchClusterShards(addr string) ([]clusterShard, error) {
+	conn, err := resp.Dial(addr, RedisClusterDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	reply, err := conn.Do("CLUSTER", "SHARDS")
+	if err == nil {
+		return parseClusterShards(reply)
+	}
+	if _, ok := err.(resp.Error); !ok {
+		return nil, err
+	}
+	reply, err = conn.Do("CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	text, err := resp.String(reply)
+	if err != nil {
+		return nil, err
+	}
+	return parseClusterNodes(text)
+}
+
+func parseClusterShards(reply interface{}) ([]clusterShard, error) {
+	list, ok := reply.([]interface{})
+	if !ok {
+		return nil, resp.UnexpectedReply
+	}
+	var shards []clusterShard
+	for _, entry := range list {
+		fields, err := resp.Map(entry)
+		if err != nil {
+			return nil, err
+		}
+		slots, _ := fields["slots"].([]interface{})
+		nodes, _ := fields["nodes"].([]interface{})
+		if len(slots) < 2 {
+			// Shards without slots hold no data clients could want.
+			continue
+		}
+		shard := clusterShard{Start: -1}
+		for i := 0; i+1 < len(slots); i += 2 {
+			start, err1 := resp.Int(slots[i])
+			end, err2 := resp.Int(slots[i+1])
+			if err1 != nil || err2 != nil {
+				return nil, resp.UnexpectedReply
+			}
+			if shard.Start == -1 || int(start) < shard.Start {
+				shard.Start = int(start)
+			}
+			if int(end) > shard.End {
+				shard.End = int(end)
+			}
+		}
+		for _, n := range nodes {
+			nf, err := resp.Map(n)
+			if err != nil {
+				return nil, err
+			}
+			inst := clusterInstance{}
+			inst.ID, _ = resp.String(nf["id"])
+			inst.IP, _ = resp.String(nf["ip"])
+			if port, err := resp.Int(nf["port"]); err == nil {
+				inst.Port = strconv.FormatInt(port, 10)
+			}
+			role, _ := resp.String(nf["role"])
+			health, _ := resp.String(nf["health"])
+			inst.Master = role == "master"
+			inst.Failed = health == "fail" || health == "failed"
+			if inst.Master {
+				if shard.Master.ID == "" || shard.Master.Failed {
+					shard.Master = inst
+				}
+			} else {
+				shard.Replicas = append(shard.Replicas, inst)
+			}
+		}
+		if shard.Master.ID == "" {
+			return nil, fmt.Errorf("shard at slot %d has no master", shard.Start)
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// parseClusterNodes turns CLUSTER NODES output, one node per line of
+// <id> <ip:port@cport> <flags> <master> <ping> <pong> <epoch> <link> <slot>...
+// into shards.
+func parseClusterNodes(text string) ([]clusterShard, error) {
+	masters := make(map[string]*clusterShard)
+	replicas := make(map[string][]clusterInstance)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			if len(fields) > 0 {
+				return nil, fmt.Errorf("malformed CLUSTER NODES line '%s'", line)
+			}
+			continue
+		}
+		addr := fields[1]
+		if i := strings.IndexAny(addr, "@,"); i >= 0 {
+			addr = addr[:i]
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed node address '%s'", fields[1])
+		}
+		flags := "," + fields[2] + ","
+		inst := clusterInstance{
+			ID:     fields[0],
+			IP:     host,
+			Port:   port,
+			Master: strings.Contains(flags, ",master,"),
+			Failed: strings.Contains(flags, ",fail,") || strings.Contains(flags, ",noaddr,"),
+		}
+		if !inst.Master {
+			replicas[fields[3]] = append(replicas[fields[3]], inst)
+			continue
+		}
+		shard := &clusterShard{Start: -1, Master: inst}
+		for _, slot := range fields[8:] {
+			if strings.HasPrefix(slot, "[") {
+				// Slots being imported or migrated.
+				continue
+			}
+			bounds := strings.SplitN(slot, "-", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("malformed slot range '%s'", slot)
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("malformed slot range '%s'", slot)
+				}
+			}
+			if shard.Start == -1 || start < shard.Start {
+				shard.Start = start
+			}
+			if end > shard.End {
+				shard.End = end
+			}
+		}
+		if shard.Start == -1 {
+			continue
+		}
+		masters[inst.ID] = shard
+	}
+	// A failed master can still claim the slots of the replica that
+	// replaced it until the cluster notices; the healthy one wins.
+	byStart := make(map[int]clusterShard)
+	for id, shard := range masters {
+		shard.Replicas = replicas[id]
+		if prev, exists := byStart[shard.Start]; !exists || (prev.Master.Failed && !shard.Master.Failed) {
+			byStart[shard.Start] = *shard
+		}
+	}
+	shards := make([]clusterShard, 0, len(byStart))
+	for _, shard := range byStart {
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis serves RESP on a loopback port, answering each command with the
+// raw reply handler returns.
+func fakeRedis(t *testing.T, handler func(args []string) string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readFakeCommand(r)
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(handler(args)))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestRedisClusterNodes(t *testing.T) {
+	var mu sync.Mutex
+	nodes := "" +
+		"a1 10.0.0.1:6379@16379 myself,master - 0 0 1 connected 0-5460\n" +
+		"a2 10.0.0.2:6379@16379 master - 0 0 2 connected 5461-10922\n" +
+		"a3 10.0.0.3:6379@16379 master - 0 0 3 connected 10923-16383\n" +
+		"b1 10.0.1.1:6379@16379 slave a1 0 0 1 connected\n" +
+		"b2 10.0.1.2:6379@16379 slave,fail a2 0 0 2 connected\n"
+	addr := fakeRedis(t, func(args []string) string {
+		if strings.ToUpper(args[1]) == "SHARDS" {
+			return "-ERR unknown subcommand 'SHARDS'\r\n"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return bulk(nodes)
+	})
+
+	var (
+		emu      sync.Mutex
+		switches []string
+	)
+	defer AddEventListener(func(pod RedisPod, etype, msg string) {
+		if etype == "+switch-master" {
+			emu.Lock()
+			switches = append(switches, msg)
+			emu.Unlock()
+		}
+	})()
+
+	store := NewPodStore()
+	r, err := NewRedisClusterRegistry(RedisClusterConfig{Seeds: []string{"127.0.0.1:1", addr}, PollInterval: 1 << 40}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	pod, ok := store.Get("shard-0")
+	if !ok || pod.IP != "10.0.0.1" || pod.Port != "6379" || len(pod.Replicas) != 1 || pod.Replicas[0] != "10.0.1.1:6379" {
+		t.Errorf("shard-0 = %+v", pod)
+	}
+	if pod.Quorum != "2" {
+		t.Errorf("shard-0 quorum %s, want a majority of 3 masters", pod.Quorum)
+	}
+	if pod, _ := store.Get("shard-5461"); len(pod.Replicas) != 0 {
+		t.Errorf("failed replica served for shard-5461: %+v", pod)
+	}
+
+	// The replica of the first shard takes over while its old master
+	// still claims the slots, flagged as failed.
+	mu.Lock()
+	nodes = strings.Replace(nodes, "myself,master - 0 0 1", "myself,master,fail - 0 0 1", 1)
+	nodes = strings.Replace(nodes, "slave a1 0 0 1 connected", "master - 0 0 4 connected 0-5460", 1)
+	mu.Unlock()
+	if err := r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if pod, _ := store.Get("shard-0"); pod.IP != "10.0.1.1" {
+		t.Errorf("shard-0 master %s after failover, want 10.0.1.1", pod.IP)
+	}
+	emu.Lock()
+	defer emu.Unlock()
+	if len(switches) != 1 || switches[0] != "shard-0 10.0.0.1 6379 10.0.1.1 6379" {
+		t.Errorf("got +switch-master %q", switches)
+	}
+}
+
+func TestRedisClusterShards(t *testing.T) {
+	node := func(id, ip, role, health string) string {
+		return "*10\r\n" + bulk("id") + bulk(id) + bulk("ip") + bulk(ip) + bulk("port") + ":6379\r\n" +
+			bulk("role") + bulk(role) + bulk("health") + bulk(health)
+	}
+	shard := func(start, end int, nodes ...string) string {
+		return "*4\r\n" + bulk("slots") + fmt.Sprintf("*2\r\n:%d\r\n:%d\r\n", start, end) +
+			bulk("nodes") + fmt.Sprintf("*%d\r\n", len(nodes)) + strings.Join(nodes, "")
+	}
+	reply := "*2\r\n" +
+		shard(8192, 16383, node("m2", "10.0.0.2", "master", "online"), node("m3", "10.0.0.3", "master", "fail")) +
+		shard(0, 8191, node("m0", "10.0.0.9", "master", "fail"), node("m1", "10.0.0.1", "master", "online"), node("r1", "10.0.1.1", "replica", "online"))
+	addr := fakeRedis(t, func(args []string) string { return reply })
+
+	store := NewPodStore()
+	r, err := NewRedisClusterRegistry(RedisClusterConfig{Seeds: []string{addr}, PollInterval: 1 << 40, PodName: "c-{start}-{end}", Quorum: 1}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pod, ok := store.Get("c-0-8191")
+	if !ok || pod.IP != "10.0.0.1" || pod.Quorum != "1" || len(pod.Replicas) != 1 {
+		t.Errorf("c-0-8191 = %+v", pod)
+	}
+	if pod, ok := store.Get("c-8192-16383"); !ok || pod.IP != "10.0.0.2" {
+		t.Errorf("c-8192-16383 = %+v, want the healthy master", pod)
+	}
+}
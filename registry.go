@@ -0,0 +1,32 @@
+package main
+
+// Registry is the authoritative home of pod state. Every mutation is sent
+// through the active registry, while reads are answered from the local
+// PodStore which each registry keeps current.
+type Registry interface {
+	// Apply commits a mutation. Errors are sent back to the client as is.
+	Apply(m Mutation) error
+	// ReadBarrier is called before reads and may refuse them when the
+	// local store cannot be trusted to be current.
+	ReadBarrier() error
+}
+
+// PodLookup is implemented by registries that answer reads themselves
+// instead of keeping the local store current, such as a database queried on
+// demand.
+type PodLookup interface {
+	Lookup(name string) (RedisPod, bool, error)
+}
+
+// localRegistry keeps state only in this process's PodStore.
+type localRegistry struct {
+	store *PodStore
+}
+
+func (r localRegistry) Apply(m Mutation) error {
+	return r.store.Apply(m)
+}
+
+func (r localRegistry) ReadBarrier() error {
+	return nil
+}
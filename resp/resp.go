@@ -0,0 +1,328 @@
+// Package resp is a small client side of the Redis protocol, shared by
+// palisade and its example proxies for talking to Redis and Sentinel
+// servers.
+//
+// Replies are decoded to string (simple strings), []byte (bulk strings, nil
+// when null), int64, []interface{} (arrays, nil when null) or Error. ReadRaw
+// instead copies a reply unchanged, for relaying it.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	UnexpectedReply = errors.New("unexpected reply type")
+
+	ExpectNumber   = &ProtocolError{"Expect Number"}
+	ExpectNewLine  = &ProtocolError{"Expect Newline"}
+	ExpectTypeChar = &ProtocolError{"Expect TypeChar"}
+
+	MaxDepth = 8
+	// MaxBulkLen and MaxArrayLen bound what a reply can make the reader
+	// allocate before any of it has arrived.
+	MaxBulkLen  = 64 << 20
+	MaxArrayLen = 1 << 20
+)
+
+// ProtocolError is a reply that doesn't follow the protocol.
+type ProtocolError struct {
+	message string
+}
+
+func (p *ProtocolError) Error() string {
+	return p.message
+}
+
+// Error is an error reply sent by a server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Conn is a client connection to a Redis or Sentinel server. ReadTimeout
+// and WriteTimeout, when set, bound each command's reply and request.
+type Conn struct {
+	net.Conn
+	R            *bufio.Reader
+	W            *bufio.Writer
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// Dial connects to addr, using timeout for the dial and for each command.
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(conn)
+	c.ReadTimeout, c.WriteTimeout = timeout, timeout
+	return c, nil
+}
+
+// NewConn wraps an established connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, R: bufio.NewReader(conn), W: bufio.NewWriter(conn)}
+}
+
+// Send writes a command without waiting for its reply.
+func (c *Conn) Send(args ...string) error {
+	if c.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+	return WriteCommand(c.W, args)
+}
+
+// Do sends a command and reads its reply. Error replies are returned as the
+// reply with an Error, so callers can tell them from I/O errors.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	if c.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	reply, err := ReadReply(c.R)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(Error); ok {
+		return reply, rerr
+	}
+	return reply, nil
+}
+
+// DoRaw sends a command and returns its reply exactly as sent, whatever its
+// type.
+func (c *Conn) DoRaw(args ...string) ([]byte, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	if c.ReadTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	var raw bytes.Buffer
+	if err := ReadRaw(c.R, &raw); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+// Receive reads the next message pushed by the server, such as a published
+// message after SUBSCRIBE. It waits without a deadline.
+func (c *Conn) Receive() (interface{}, error) {
+	c.SetReadDeadline(time.Time{})
+	return ReadReply(c.R)
+}
+
+// WriteCommand writes a command as an array of bulk strings and flushes it.
+func WriteCommand(w *bufio.Writer, args []string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return w.Flush()
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", ExpectNewLine
+	}
+	return line, nil
+}
+
+// length parses the length in a bulk or aggregate header, checking it
+// against max.
+func length(head string, max int) (int, error) {
+	n, err := strconv.Atoi(head)
+	if err != nil {
+		return 0, ExpectNumber
+	}
+	if n > max {
+		return 0, &ProtocolError{"reply too long"}
+	}
+	return n, nil
+}
+
+// ReadReply reads and decodes one RESP2 reply.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	return readReply(r, 0)
+}
+
+func readReply(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > MaxDepth {
+		return nil, &ProtocolError{"reply nested too deeply"}
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	head := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return head, nil
+	case '-':
+		return Error(head), nil
+	case ':':
+		n, err := strconv.ParseInt(head, 10, 64)
+		if err != nil {
+			return nil, ExpectNumber
+		}
+		return n, nil
+	case '$':
+		n, err := length(head, MaxBulkLen)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := length(head, MaxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = readReply(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, ExpectTypeChar
+}
+
+// ReadRaw copies one reply from r to buf unchanged, parsing only as much as
+// it takes to find where the reply ends. It understands RESP2 and RESP3, so
+// any reply a server sends survives being relayed.
+func ReadRaw(r *bufio.Reader, buf *bytes.Buffer) error {
+	return readRaw(r, buf, 0)
+}
+
+func readRaw(r *bufio.Reader, buf *bytes.Buffer, depth int) error {
+	if depth > MaxDepth {
+		return &ProtocolError{"reply nested too deeply"}
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(line)
+	head := line[1 : len(line)-2]
+	switch line[0] {
+	case '+', '-', ':', '_', '#', ',', '(':
+		return nil
+	case '$', '!', '=':
+		n, err := length(head, MaxBulkLen)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = io.CopyN(buf, r, int64(n)+2)
+		return err
+	case '*', '~', '>', '%', '|':
+		n, err := length(head, MaxArrayLen)
+		if err != nil {
+			return err
+		}
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if err := readRaw(r, buf, depth+1); err != nil {
+				return err
+			}
+		}
+		if line[0] == '|' {
+			// Attributes come ahead of the reply they describe.
+			return readRaw(r, buf, depth)
+		}
+		return nil
+	}
+	return ExpectTypeChar
+}
+
+// String converts a simple string, bulk string or integer reply to a
+// string.
+func String(reply interface{}) (string, error) {
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", UnexpectedReply
+}
+
+// Int converts an integer reply, or a string holding one, to an int64.
+func Int(reply interface{}) (int64, error) {
+	if n, ok := reply.(int64); ok {
+		return n, nil
+	}
+	s, err := String(reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Strings converts a flat array reply to strings.
+func Strings(reply interface{}) ([]string, error) {
+	arr, ok := reply.([]interface{})
+	if !ok {
+		return nil, UnexpectedReply
+	}
+	strs := make([]string, 0, len(arr))
+	for _, v := range arr {
+		s, err := String(v)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// Map converts a flat array of field/value pairs, as returned by commands
+// such as SENTINEL MASTER and CLUSTER SHARDS, to a map.
+func Map(reply interface{}) (map[string]interface{}, error) {
+	arr, ok := reply.([]interface{})
+	if !ok || len(arr)%2 != 0 {
+		return nil, UnexpectedReply
+	}
+	m := make(map[string]interface{}, len(arr)/2)
+	for i := 0; i < len(arr); i += 2 {
+		key, err := String(arr[i])
+		if err != nil {
+			return nil, err
+		}
+		m[key] = arr[i+1]
+	}
+	return m, nil
+}
@@ -0,0 +1,99 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func reader(s string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(s))
+}
+
+func TestReadReply(t *testing.T) {
+	for raw, want := range map[string]interface{}{
+		"+OK\r\n":                       "OK",
+		"-ERR no such master\r\n":       Error("ERR no such master"),
+		":42\r\n":                       int64(42),
+		"$5\r\nhello\r\n":               []byte("hello"),
+		"$-1\r\n":                       []byte(nil),
+		"*-1\r\n":                       []interface{}(nil),
+		"*2\r\n$2\r\nip\r\n:6379\r\n":   []interface{}{[]byte("ip"), int64(6379)},
+		"*1\r\n*1\r\n+nested\r\n":       []interface{}{[]interface{}{"nested"}},
+		"*2\r\n$1\r\na\r\n$-1\r\n":      []interface{}{[]byte("a"), []byte(nil)},
+		"$12\r\nline\r\nbreaks\r\n\r\n": []byte("line\r\nbreaks"),
+	} {
+		got, err := ReadReply(reader(raw))
+		if err != nil {
+			t.Errorf("%q: %v", raw, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q decoded to %#v, want %#v", raw, got, want)
+		}
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	for _, raw := range []string{
+		"+OK\r\n",
+		"*2\r\n$2\r\nip\r\n:6379\r\n",
+		"%1\r\n+key\r\n~2\r\n#t\r\n,1.5\r\n",
+		"|1\r\n+ttl\r\n:10\r\n$3\r\nval\r\n",
+		">3\r\n$7\r\nmessage\r\n$3\r\nchn\r\n_\r\n",
+	} {
+		var buf bytes.Buffer
+		// A second reply follows, which ReadRaw must leave alone.
+		r := reader(raw + "+next\r\n")
+		if err := ReadRaw(r, &buf); err != nil {
+			t.Errorf("%q: %v", raw, err)
+			continue
+		}
+		if buf.String() != raw {
+			t.Errorf("%q was copied as %q", raw, buf.String())
+		}
+		if next, err := ReadReply(r); err != nil || next != "next" {
+			t.Errorf("%q: the following reply read as %v, %v", raw, next, err)
+		}
+	}
+}
+
+func TestRejectsBadReplies(t *testing.T) {
+	for _, raw := range []string{
+		fmt.Sprintf("$%d\r\n", MaxBulkLen+1),
+		fmt.Sprintf("*%d\r\n", MaxArrayLen+1),
+		strings.Repeat("*1\r\n", MaxDepth+2) + "+deep\r\n",
+		"?\r\n",
+		"+no carriage return\n",
+		"$abc\r\n",
+	} {
+		if _, err := ReadReply(reader(raw)); err == nil {
+			t.Errorf("ReadReply accepted %q", raw)
+		} else if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("ReadReply failed %q with %v, want a protocol error", raw, err)
+		}
+		var buf bytes.Buffer
+		if err := ReadRaw(reader(raw), &buf); err == nil {
+			t.Errorf("ReadRaw accepted %q", raw)
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	reply := []interface{}{[]byte("name"), "cache", []byte("port"), int64(6379)}
+	strs, err := Strings(reply)
+	if err != nil || !reflect.DeepEqual(strs, []string{"name", "cache", "port", "6379"}) {
+		t.Errorf("Strings = %v, %v", strs, err)
+	}
+	m, err := Map(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, err := Int(m["port"]); err != nil || port != 6379 {
+		t.Errorf("port = %v, %v", port, err)
+	}
+	if _, err := Map(reply[:3]); err != UnexpectedReply {
+		t.Errorf("Map of an odd array returned %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// These mirror the limits Redis Sentinel hard-codes for notification-script
+// and client-reconfig-script execution. They are variables so tests and
+// embedders can shorten them.
+var (
+	ScriptMaxQueue     = 256
+	ScriptMaxRunning   = 16
+	ScriptMaxRetry     = 10
+	ScriptRetryDelay   = 30 * time.Second
+	ScriptMaxRuntime   = 60 * time.Second
+	ScriptPollInterval = 100 * time.Millisecond
+
+	scripts *ScriptRunner
+)
+
+func init() {
+	scripts = NewScriptRunner()
+}
+
+type scriptJob struct {
+	path       string
+	args       []string
+	retryNum   int
+	startAfter time.Time
+}
+
+// ScriptRunner queues and executes user scripts the way Sentinel does: at
+// most ScriptMaxRunning at once, each killed after ScriptMaxRuntime, retried
+// with an exponential delay when it exits 1 or dies on a signal, and never
+// more than ScriptMaxQueue jobs pending.
+type ScriptRunner struct {
+	sync.Mutex
+	queue   []*scriptJob
+	running int
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewScriptRunner() *ScriptRunner {
+	sr := &ScriptRunner{done: make(chan struct{})}
+	go sr.loop()
+	return sr
+}
+
+// Schedule queues a script for execution. When the queue is full the oldest
+// pending job is dropped to make room, as Sentinel does.
+func (sr *ScriptRunner) Schedule(path string, args ...string) {
+	if path == "" {
+		return
+	}
+	sr.Lock()
+	defer sr.Unlock()
+	if len(sr.queue) >= ScriptMaxQueue {
+		dropped := sr.queue[0]
+		sr.queue = sr.queue[1:]
+		log.Printf("script queue full, dropping pending '%s'", dropped.path)
+	}
+	sr.queue = append(sr.queue, &scriptJob{path: path, args: args})
+}
+
+// Pending returns the number of queued jobs and the number currently running.
+func (sr *ScriptRunner) Pending() (queued, running int) {
+	sr.Lock()
+	defer sr.Unlock()
+	return len(sr.queue), sr.running
+}
+
+// Stop halts dispatching and waits for running scripts to finish.
+func (sr *ScriptRunner) Stop() {
+	close(sr.done)
+	sr.wg.Wait()
+}
+
+func (sr *ScriptRunner) loop() {
+	ticker := time.NewTicker(ScriptPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sr.done:
+			return
+		case <-ticker.C:
+			sr.dispatch()
+		}
+	}
+}
+
+func (sr *ScriptRunner) dispatch() {
+	sr.Lock()
+	defer sr.Unlock()
+	now := time.Now()
+	remaining := sr.queue[:0]
+	for _, job := range sr.queue {
+		if sr.running < ScriptMaxRunning && !now.Before(job.startAfter) {
+			sr.running++
+			sr.wg.Add(1)
+			go sr.run(job)
+			continue
+		}
+		remaining = append(remaining, job)
+	}
+	sr.queue = remaining
+}
+
+func (sr *ScriptRunner) run(job *scriptJob) {
+	defer sr.wg.Done()
+	retry := runScript(job.path, job.args)
+	sr.Lock()
+	defer sr.Unlock()
+	sr.running--
+	if !retry {
+		return
+	}
+	job.retryNum++
+	if job.retryNum >= ScriptMaxRetry {
+		log.Printf("script '%s' failed %d times, giving up", job.path, job.retryNum)
+		return
+	}
+	job.startAfter = time.Now().Add(ScriptRetryDelay * time.Duration(1<<uint(job.retryNum-1)))
+	sr.queue = append(sr.queue, job)
+}
+
+// runScript executes a single script and reports whether it should be
+// retried. Exit code 1 and termination by signal (including our own timeout
+// kill) are retried; any other failure is not.
+func runScript(path string, args []string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), ScriptMaxRuntime)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	err := cmd.Run()
+	if err == nil {
+		return false
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("script '%s' timed out after %s", path, ScriptMaxRuntime)
+		return true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		log.Printf("script '%s' could not be started: %v", path, err)
+		return false
+	}
+	code := exitErr.ExitCode()
+	log.Printf("script '%s' exited with %d", path, code)
+	return code == 1 || code == -1
+}
+
+// checkScript verifies a script path is an executable regular file, which is
+// what Sentinel requires before accepting it as a pod setting.
+func checkScript(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return fi.Mode().Perm()&0111 != 0
+}
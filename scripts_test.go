@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScript creates an executable shell script in dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// waitForLines waits until path holds at least n lines and returns them.
+func waitForLines(t *testing.T, path string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(data) > 0 && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %q, want %d lines", path, data, n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSwitchMasterRunsScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notify := writeScript(t, dir, "notify.sh", `echo "$@" >> `+dir+`/notify.log`)
+	reconfig := writeScript(t, dir, "reconfig.sh", `echo "$@" >> `+dir+`/reconfig.log`)
+
+	s := NewPodStore()
+	steps := []Mutation{
+		{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.1", Port: "6379", Quorum: "2"}},
+		{Op: OpSet, Name: "cache", Setting: "notification-script", Value: notify},
+		{Op: OpSet, Name: "cache", Setting: "client-reconfig-script", Value: reconfig},
+		{Op: OpMonitor, Pod: RedisPod{Name: "cache", IP: "10.0.0.2", Port: "6380", Quorum: "2"}},
+	}
+	for _, m := range steps {
+		if err := s.Apply(m); err != nil {
+			t.Fatalf("%+v: %v", m, err)
+		}
+	}
+	pod, _ := s.Get("cache")
+	if pod.NotificationScript != notify || pod.ClientReconfigScript != reconfig {
+		t.Errorf("monitoring the pod again lost its scripts: %+v", pod)
+	}
+
+	got := waitForLines(t, filepath.Join(dir, "reconfig.log"), 1)
+	if want := "cache leader failover 10.0.0.1 6379 10.0.0.2 6380"; got[0] != want {
+		t.Errorf("client-reconfig-script got %q, want %q", got[0], want)
+	}
+	got = waitForLines(t, filepath.Join(dir, "notify.log"), 1)
+	if want := "+switch-master cache 10.0.0.1 6379 10.0.0.2 6380"; got[0] != want {
+		t.Errorf("notification-script got %q, want %q", got[0], want)
+	}
+
+	if err := s.Apply(Mutation{Op: OpRemove, Name: "cache"}); err != nil {
+		t.Fatal(err)
+	}
+	got = waitForLines(t, filepath.Join(dir, "notify.log"), 2)
+	if want := "-monitor master cache 10.0.0.2 6380"; got[1] != want {
+		t.Errorf("notification-script got %q, want %q", got[1], want)
+	}
+}
+
+// withScriptLimits shortens the script limits for a test.
+func withScriptLimits(t *testing.T) {
+	saved := []interface{}{ScriptMaxQueue, ScriptMaxRunning, ScriptMaxRetry, ScriptRetryDelay, ScriptMaxRuntime, ScriptPollInterval}
+	ScriptRetryDelay = 10 * time.Millisecond
+	ScriptPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		ScriptMaxQueue = saved[0].(int)
+		ScriptMaxRunning = saved[1].(int)
+		ScriptMaxRetry = saved[2].(int)
+		ScriptRetryDelay = saved[3].(time.Duration)
+		ScriptMaxRuntime = saved[4].(time.Duration)
+		ScriptPollInterval = saved[5].(time.Duration)
+	})
+}
+
+func TestScriptRetries(t *testing.T) {
+	withScriptLimits(t)
+	ScriptMaxRetry = 3
+	dir, err := ioutil.TempDir("", "palisade-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	retried := writeScript(t, dir, "exit1.sh", `echo run >> `+dir+`/exit1.log; exit 1`)
+	final := writeScript(t, dir, "exit2.sh", `echo run >> `+dir+`/exit2.log; exit 2`)
+
+	sr := NewScriptRunner()
+	sr.Schedule(retried)
+	sr.Schedule(final)
+	waitForLines(t, filepath.Join(dir, "exit1.log"), ScriptMaxRetry)
+	time.Sleep(100 * time.Millisecond)
+	sr.Stop()
+
+	if got := waitForLines(t, filepath.Join(dir, "exit1.log"), 1); len(got) != ScriptMaxRetry {
+		t.Errorf("exit 1 script ran %d times, want %d", len(got), ScriptMaxRetry)
+	}
+	if got := waitForLines(t, filepath.Join(dir, "exit2.log"), 1); len(got) != 1 {
+		t.Errorf("exit 2 script ran %d times, want 1", len(got))
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	withScriptLimits(t)
+	ScriptMaxRuntime = 100 * time.Millisecond
+	dir, err := ioutil.TempDir("", "palisade-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	slow := writeScript(t, dir, "slow.sh", "sleep 5")
+
+	start := time.Now()
+	retry := runScript(slow, nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("script ran for %s, want it killed after %s", elapsed, ScriptMaxRuntime)
+	}
+	if !retry {
+		t.Error("a timed out script should be retried")
+	}
+}
+
+func TestScriptConcurrencyAndQueueBound(t *testing.T) {
+	withScriptLimits(t)
+	ScriptMaxRunning = 1
+	ScriptMaxQueue = 2
+	dir, err := ioutil.TempDir("", "palisade-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	slow := writeScript(t, dir, "slow.sh", "sleep 0.3")
+
+	sr := NewScriptRunner()
+	defer sr.Stop()
+	sr.Schedule(slow, "first")
+	time.Sleep(50 * time.Millisecond)
+	sr.Schedule(slow, "second")
+	sr.Schedule(slow, "third")
+	sr.Schedule(slow, "fourth")
+	queued, running := sr.Pending()
+	if running != 1 || queued != 2 {
+		t.Errorf("got %d running and %d queued, want 1 and 2", running, queued)
+	}
+	sr.Lock()
+	oldest := sr.queue[0].args[0]
+	sr.Unlock()
+	if oldest != "third" {
+		t.Errorf("oldest pending job is %q, want the second dropped leaving %q", oldest, "third")
+	}
+}
@@ -0,0 +1,211 @@
+package sentinel
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend answers every SENTINEL command. Backends can be chained: a
+// wrapping backend adjusts requests or answers and passes them on to the
+// next one, ending in one that holds or fetches the pods, for example
+// passwords in front of sharding in front of proxy.
+type Backend interface {
+	LookupMaster(name string) (RedisPod, bool, error)
+	ListMasters() ([]RedisPod, error)
+	// Replicas returns the ip:port address of each of a pod's replicas.
+	Replicas(name string) ([]string, error)
+	Sentinels(name string) ([]KnownSentinel, error)
+	// Monitor, Set and Remove are told who asked for the change, for the
+	// change history.
+	Monitor(o Origin, pod RedisPod) error
+	Set(o Origin, name, setting, value string) error
+	Remove(o Origin, name string) error
+	// Subscribe calls l for every event about the pods until the returned
+	// function is called.
+	Subscribe(l EventListener) func()
+}
+
+// EventListener receives sentinel events: the pod an event is about, its
+// type, such as +switch-master, and its description.
+type EventListener func(pod RedisPod, etype, msg string)
+
+// Origin says who asked for a change.
+type Origin struct {
+	Actor   string
+	Command string
+	Time    time.Time
+}
+
+// BuildBackend assembles a chain from a comma separated list such as
+// "passwords,sharding,proxy". The last entry must be a terminal backend, "memory"
+// or "proxy"; the ones before it wrap it in the order given.
+func BuildBackend(spec string, terminal map[string]Backend, wrappers map[string]func(Backend) Backend) (Backend, error) {
+	names := strings.Split(spec, ",")
+	last := strings.TrimSpace(names[len(names)-1])
+	b, ok := terminal[last]
+	if !ok {
+		return nil, fmt.Errorf("'%s' can not be the last backend", last)
+	}
+	for i := len(names) - 2; i >= 0; i-- {
+		name := strings.TrimSpace(names[i])
+		wrap, ok := wrappers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend '%s'", name)
+		}
+		b = wrap(b)
+	}
+	return b, nil
+}
+
+// ShardingBackend maps a target, such as a user or server id, to the pod
+// holding its shard before asking the next backend about that pod. Listing,
+// changes and events address the shard pods by their own names. Targets are
+// placed by an fnv-1a hash modulo Shards, so changing Shards moves most
+// targets, unless Place is given; the sharding proxy example places them
+// by hash slot instead so fewer move.
+type ShardingBackend struct {
+	Next   Backend
+	Shards int
+	// NameFormat turns a shard number into a pod name, e.g. "shard-%d".
+	NameFormat string
+	// Place, when set, returns the pod holding a target in place of the
+	// hash.
+	Place func(target string) string
+}
+
+func (b *ShardingBackend) ShardFor(target string) string {
+	if b.Place != nil {
+		return b.Place(target)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return fmt.Sprintf(b.NameFormat, h.Sum32()%uint32(b.Shards))
+}
+
+func (b *ShardingBackend) LookupMaster(target string) (RedisPod, bool, error) {
+	return b.Next.LookupMaster(b.ShardFor(target))
+}
+
+func (b *ShardingBackend) ListMasters() ([]RedisPod, error) {
+	return b.Next.ListMasters()
+}
+
+func (b *ShardingBackend) Replicas(target string) ([]string, error) {
+	return b.Next.Replicas(b.ShardFor(target))
+}
+
+func (b *ShardingBackend) Sentinels(target string) ([]KnownSentinel, error) {
+	return b.Next.Sentinels(b.ShardFor(target))
+}
+
+func (b *ShardingBackend) Monitor(o Origin, pod RedisPod) error {
+	return b.Next.Monitor(o, pod)
+}
+
+func (b *ShardingBackend) Set(o Origin, name, setting, value string) error {
+	return b.Next.Set(o, name, setting, value)
+}
+
+func (b *ShardingBackend) Remove(o Origin, name string) error {
+	return b.Next.Remove(o, name)
+}
+
+func (b *ShardingBackend) Subscribe(l EventListener) func() {
+	return b.Next.Subscribe(l)
+}
+
+// PodPasswordBackend keeps each pod's auth password itself and adds it to
+// the answers of the backends behind it. Real sentinels never hand out a
+// pod's password, so this lets clients learn both where a pod is and how to
+// log in to it from palisade. It doesn't authenticate clients; that is
+// palisade's own AUTH.
+type PodPasswordBackend struct {
+	Next Backend
+
+	sync.RWMutex
+	passwords map[string]string
+}
+
+func NewPodPasswordBackend(next Backend) *PodPasswordBackend {
+	return &PodPasswordBackend{Next: next, passwords: make(map[string]string)}
+}
+
+func (b *PodPasswordBackend) withPassword(pod RedisPod) RedisPod {
+	b.RLock()
+	defer b.RUnlock()
+	if pass, ok := b.passwords[pod.Name]; ok {
+		pod.AuthPass = pass
+	}
+	return pod
+}
+
+func (b *PodPasswordBackend) LookupMaster(name string) (RedisPod, bool, error) {
+	pod, exists, err := b.Next.LookupMaster(name)
+	if err != nil || !exists {
+		return pod, exists, err
+	}
+	return b.withPassword(pod), true, nil
+}
+
+func (b *PodPasswordBackend) ListMasters() ([]RedisPod, error) {
+	pods, err := b.Next.ListMasters()
+	for i := range pods {
+		pods[i] = b.withPassword(pods[i])
+	}
+	return pods, err
+}
+
+func (b *PodPasswordBackend) Replicas(name string) ([]string, error) {
+	return b.Next.Replicas(name)
+}
+
+func (b *PodPasswordBackend) Sentinels(name string) ([]KnownSentinel, error) {
+	return b.Next.Sentinels(name)
+}
+
+func (b *PodPasswordBackend) Monitor(o Origin, pod RedisPod) error {
+	if err := b.Next.Monitor(o, pod); err != nil {
+		return err
+	}
+	if pod.AuthPass != "" {
+		b.Lock()
+		b.passwords[pod.Name] = pod.AuthPass
+		b.Unlock()
+	}
+	return nil
+}
+
+// Set passes every setting on, so the sentinels behind can still log in to
+// the pod, and remembers auth-pass.
+func (b *PodPasswordBackend) Set(o Origin, name, setting, value string) error {
+	if err := b.Next.Set(o, name, setting, value); err != nil {
+		return err
+	}
+	if strings.ToUpper(setting) == "AUTH-PASS" {
+		b.Lock()
+		b.passwords[name] = value
+		b.Unlock()
+	}
+	return nil
+}
+
+func (b *PodPasswordBackend) Remove(o Origin, name string) error {
+	if err := b.Next.Remove(o, name); err != nil {
+		return err
+	}
+	b.Lock()
+	delete(b.passwords, name)
+	b.Unlock()
+	return nil
+}
+
+// Subscribe passes the events of the backends behind on with the pods'
+// passwords added.
+func (b *PodPasswordBackend) Subscribe(l EventListener) func() {
+	return b.Next.Subscribe(func(pod RedisPod, etype, msg string) {
+		l(b.withPassword(pod), etype, msg)
+	})
+}
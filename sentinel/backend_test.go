@@ -0,0 +1,161 @@
+package sentinel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+// memBackend ends a chain in a map of pods, announcing what it is told to.
+type memBackend struct {
+	sync.Mutex
+	pods      map[string]RedisPod
+	listeners map[int]EventListener
+	next      int
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{pods: make(map[string]RedisPod), listeners: make(map[int]EventListener)}
+}
+
+func (b *memBackend) LookupMaster(name string) (RedisPod, bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	pod, ok := b.pods[name]
+	return pod, ok, nil
+}
+
+func (b *memBackend) ListMasters() ([]RedisPod, error) {
+	b.Lock()
+	defer b.Unlock()
+	var pods []RedisPod
+	for _, pod := range b.pods {
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func (b *memBackend) Replicas(name string) ([]string, error)          { return nil, nil }
+func (b *memBackend) Sentinels(name string) ([]KnownSentinel, error)  { return nil, nil }
+func (b *memBackend) Set(o Origin, name, setting, value string) error { return nil }
+func (b *memBackend) Remove(o Origin, name string) error              { return nil }
+
+func (b *memBackend) Monitor(o Origin, pod RedisPod) error {
+	b.Lock()
+	defer b.Unlock()
+	pod.AuthPass = ""
+	b.pods[pod.Name] = pod
+	return nil
+}
+
+func (b *memBackend) Subscribe(l EventListener) func() {
+	b.Lock()
+	defer b.Unlock()
+	id := b.next
+	b.next++
+	b.listeners[id] = l
+	return func() {
+		b.Lock()
+		delete(b.listeners, id)
+		b.Unlock()
+	}
+}
+
+func (b *memBackend) emit(pod RedisPod, etype, msg string) {
+	b.Lock()
+	defer b.Unlock()
+	for _, l := range b.listeners {
+		l(pod, etype, msg)
+	}
+}
+
+func TestBackendChain(t *testing.T) {
+	mem := newMemBackend()
+	b, err := BuildBackend("passwords, sharding, memory", map[string]Backend{"memory": mem}, map[string]func(Backend) Backend{
+		"passwords": func(next Backend) Backend { return NewPodPasswordBackend(next) },
+		"sharding": func(next Backend) Backend {
+			return &ShardingBackend{Next: next, Place: func(target string) string { return "shard-" + target[:1] }}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Monitor(Origin{}, RedisPod{Name: "shard-u", IP: "10.0.0.1", Port: "6379", AuthPass: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	pod, found, err := b.LookupMaster("user-42")
+	if err != nil || !found || pod.Name != "shard-u" || pod.AuthPass != "secret" {
+		t.Errorf("LookupMaster(user-42) = %+v, %v, %v", pod, found, err)
+	}
+
+	var got []string
+	unsubscribe := b.Subscribe(func(pod RedisPod, etype, msg string) {
+		got = append(got, fmt.Sprintf("%s %s %s", etype, pod.Name, pod.AuthPass))
+	})
+	mem.emit(RedisPod{Name: "shard-u"}, "+sdown", "master shard-u 10.0.0.1 6379")
+	unsubscribe()
+	mem.emit(RedisPod{Name: "shard-u"}, "-sdown", "master shard-u 10.0.0.1 6379")
+	if len(got) != 1 || got[0] != "+sdown shard-u secret" {
+		t.Errorf("events %q, want just +sdown with the password", got)
+	}
+}
+
+// publishingSentinel confirms a PSUBSCRIBE and then publishes payload on
+// +switch-master.
+func publishingSentinel(t *testing.T, payload string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+				if _, err := resp.ReadReply(r); err != nil {
+					return
+				}
+				fmt.Fprint(w, "*3\r\n$10\r\npsubscribe\r\n$1\r\n*\r\n:1\r\n")
+				fmt.Fprintf(w, "*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$14\r\n+switch-master\r\n$%d\r\n%s\r\n", len(payload), payload)
+				w.Flush()
+				resp.ReadReply(r)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxyBackendSubscribe(t *testing.T) {
+	payload := "cache 10.0.0.1 6379 10.0.0.2 6379"
+	b := NewProxyBackend([]string{publishingSentinel(t, payload), publishingSentinel(t, payload)})
+	events := make(chan RedisPod, 4)
+	defer b.Subscribe(func(pod RedisPod, etype, msg string) {
+		if etype == "+switch-master" && msg == payload {
+			events <- pod
+		}
+	})()
+	select {
+	case pod := <-events:
+		if pod.Name != "cache" || pod.IP != "10.0.0.2" || pod.Port != "6379" {
+			t.Errorf("event about %+v", pod)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event relayed")
+	}
+	select {
+	case <-events:
+		t.Error("the second sentinel's copy of the event was relayed too")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,56 @@
+// Package sentinel is what palisade and its example proxies share for
+// answering SENTINEL commands: the pods they describe, the chainable Backend
+// the commands go through, its sharding and password wrappers, and a proxy
+// backend relaying to real sentinels.
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+)
+
+var NoSuchPod = errors.New("NOSUCHPOD Pod doesn't exist")
+
+type RedisPod struct {
+	Name          string
+	IP            string
+	Port          string
+	Quorum        string
+	AuthPass      string
+	ParallelSyncs int64
+
+	NotificationScript   string
+	ClientReconfigScript string
+	// Replicas holds the ip:port addresses of the pod's known replicas.
+	Replicas []string
+
+	AuthUser              string
+	DownAfterMilliseconds int64
+	FailoverTimeout       int64
+	ConfigEpoch           int64
+	LeaderEpoch           int64
+	// Sentinels are the other sentinels known to monitor the pod.
+	Sentinels []KnownSentinel
+}
+
+type KnownSentinel struct {
+	IP    string
+	Port  string
+	RunID string
+}
+
+// PodInfo lists a pod's fields the way SENTINEL MASTER reports them.
+func PodInfo(pod RedisPod) []string {
+	return []string{"name", pod.Name,
+		"ip", pod.IP,
+		"port", pod.Port,
+		"quorum", pod.Quorum,
+		"auth-pass", pod.AuthPass,
+		"parallel-syncs", fmt.Sprintf("%d", pod.ParallelSyncs),
+		"down-after-milliseconds", fmt.Sprintf("%d", pod.DownAfterMilliseconds),
+		"failover-timeout", fmt.Sprintf("%d", pod.FailoverTimeout),
+		"config-epoch", fmt.Sprintf("%d", pod.ConfigEpoch),
+		"num-slaves", fmt.Sprintf("%d", len(pod.Replicas)),
+		"num-other-sentinels", fmt.Sprintf("%d", len(pod.Sentinels)),
+	}
+}
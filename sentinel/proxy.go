@@ -0,0 +1,346 @@
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/resp"
+)
+
+var (
+	NoSentinels = errors.New("NOSENTINELS no managing sentinel could be reached")
+
+	ProxyTimeout = 2 * time.Second
+	// ProxyResubscribe is the wait before a lost event subscription is
+	// made again, and ProxyEventDedupeFor how long an event delivered once
+	// is not delivered again when another sentinel publishes it.
+	ProxyResubscribe    = time.Second
+	ProxyEventDedupeFor = 2 * time.Second
+)
+
+// ProxyBackend passes commands on to the sentinels that actually manage the
+// pods. Lookups are answered by the first sentinel that responds; changes
+// are sent to every sentinel.
+type ProxyBackend struct {
+	// Addrs lists the managing sentinels in the order they are asked. When
+	// nil the ones added with AddSentinel are asked.
+	Addrs func() []string
+	// Do runs a command on a sentinel. When nil each command dials its own
+	// connection.
+	Do func(addr string, args ...string) (interface{}, error)
+
+	sync.RWMutex
+	sentinels []string
+}
+
+func NewProxyBackend(sentinels []string) *ProxyBackend {
+	b := &ProxyBackend{}
+	for _, sa := range sentinels {
+		b.AddSentinel(sa)
+	}
+	return b
+}
+
+// AddSentinel adds a managing sentinel's ip:port, reporting whether it was
+// already known.
+func (b *ProxyBackend) AddSentinel(addr string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, sa := range b.sentinels {
+		if sa == addr {
+			return true
+		}
+	}
+	b.sentinels = append(b.sentinels, addr)
+	return false
+}
+
+// SentinelAddrs lists the managing sentinels.
+func (b *ProxyBackend) SentinelAddrs() []string {
+	if b.Addrs != nil {
+		return b.Addrs()
+	}
+	b.RLock()
+	defer b.RUnlock()
+	return append([]string(nil), b.sentinels...)
+}
+
+func (b *ProxyBackend) do(addr string, args ...string) (interface{}, error) {
+	if b.Do != nil {
+		return b.Do(addr, args...)
+	}
+	conn, err := resp.Dial(addr, ProxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(args...)
+}
+
+// first runs args on each sentinel in turn until one gives an answer that
+// isn't an I/O error.
+func (b *ProxyBackend) first(args ...string) (interface{}, error) {
+	for _, sa := range b.SentinelAddrs() {
+		reply, err := b.do(sa, args...)
+		if _, ok := err.(resp.Error); err == nil || ok {
+			return reply, err
+		}
+		log.Printf("[%s] error: %s", sa, err.Error())
+	}
+	return nil, NoSentinels
+}
+
+// all runs args on every sentinel, returning the errors of any that failed.
+func (b *ProxyBackend) all(args ...string) error {
+	var failed []string
+	sentinels := b.SentinelAddrs()
+	for _, sa := range sentinels {
+		if _, err := b.do(sa, args...); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", sa, err))
+		}
+	}
+	if len(sentinels) == 0 {
+		return NoSentinels
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ERR failed on %d of %d sentinels: %s", len(failed), len(sentinels), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func isNoSuchMaster(err error) bool {
+	rerr, ok := err.(resp.Error)
+	return ok && strings.Contains(strings.ToLower(string(rerr)), "no such master")
+}
+
+func (b *ProxyBackend) LookupMaster(name string) (RedisPod, bool, error) {
+	reply, err := b.first("SENTINEL", "MASTER", name)
+	if isNoSuchMaster(err) {
+		return RedisPod{}, false, nil
+	}
+	if err != nil {
+		return RedisPod{}, false, err
+	}
+	pod, err := ParseMaster(reply)
+	return pod, err == nil, err
+}
+
+func (b *ProxyBackend) ListMasters() ([]RedisPod, error) {
+	reply, err := b.first("SENTINEL", "MASTERS")
+	if err != nil {
+		return nil, err
+	}
+	list, ok := reply.([]interface{})
+	if !ok {
+		return nil, resp.UnexpectedReply
+	}
+	pods := make([]RedisPod, 0, len(list))
+	for _, entry := range list {
+		pod, err := ParseMaster(entry)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func (b *ProxyBackend) Replicas(name string) ([]string, error) {
+	list, err := b.instances("REPLICAS", name)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []string
+	for _, fields := range list {
+		replicas = append(replicas, net.JoinHostPort(fieldString(fields, "ip"), fieldString(fields, "port")))
+	}
+	return replicas, nil
+}
+
+func (b *ProxyBackend) Sentinels(name string) ([]KnownSentinel, error) {
+	list, err := b.instances("SENTINELS", name)
+	if err != nil {
+		return nil, err
+	}
+	var sentinels []KnownSentinel
+	for _, fields := range list {
+		sentinels = append(sentinels, KnownSentinel{
+			IP:    fieldString(fields, "ip"),
+			Port:  fieldString(fields, "port"),
+			RunID: fieldString(fields, "runid"),
+		})
+	}
+	return sentinels, nil
+}
+
+func (b *ProxyBackend) instances(subcommand, name string) ([]map[string]interface{}, error) {
+	reply, err := b.first("SENTINEL", subcommand, name)
+	if isNoSuchMaster(err) {
+		return nil, NoSuchPod
+	}
+	if err != nil {
+		return nil, err
+	}
+	list, ok := reply.([]interface{})
+	if !ok {
+		return nil, resp.UnexpectedReply
+	}
+	var out []map[string]interface{}
+	for _, entry := range list {
+		fields, err := resp.Map(entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fields)
+	}
+	return out, nil
+}
+
+func (b *ProxyBackend) Monitor(o Origin, pod RedisPod) error {
+	return b.all("SENTINEL", "MONITOR", pod.Name, pod.IP, pod.Port, pod.Quorum)
+}
+
+func (b *ProxyBackend) Set(o Origin, name, setting, value string) error {
+	return b.all("SENTINEL", "SET", name, setting, value)
+}
+
+func (b *ProxyBackend) Remove(o Origin, name string) error {
+	return b.all("SENTINEL", "REMOVE", name)
+}
+
+// Subscribe listens to the event channels of every managing sentinel known
+// when it is called. The same event is usually published by several
+// sentinels, so repeats seen within ProxyEventDedupeFor are only delivered
+// once.
+func (b *ProxyBackend) Subscribe(l EventListener) func() {
+	done := make(chan struct{})
+	var once sync.Once
+	seen := &recentEvents{recent: make(map[string]time.Time)}
+	for _, sa := range b.SentinelAddrs() {
+		go subscribeEvents(sa, l, seen, done)
+	}
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func subscribeEvents(addr string, l EventListener, seen *recentEvents, done chan struct{}) {
+	for {
+		conn, err := resp.Dial(addr, ProxyTimeout)
+		if err == nil {
+			finished := make(chan struct{})
+			go func() {
+				select {
+				case <-done:
+					conn.Close()
+				case <-finished:
+				}
+			}()
+			if err = conn.Send("PSUBSCRIBE", "*"); err == nil {
+				conn.SetReadDeadline(time.Time{})
+				err = receiveEvents(conn, l, seen)
+			}
+			close(finished)
+			conn.Close()
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(ProxyResubscribe):
+		}
+		log.Printf("[%s] event subscription lost: %v", addr, err)
+	}
+}
+
+func receiveEvents(conn *resp.Conn, l EventListener, seen *recentEvents) error {
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		msg, err := resp.Strings(reply)
+		if err != nil || len(msg) != 4 || msg[0] != "pmessage" {
+			continue
+		}
+		channel, payload := msg[2], msg[3]
+		if seen.check(channel + " " + payload) {
+			continue
+		}
+		l(podFromEvent(channel, payload), channel, payload)
+	}
+}
+
+// recentEvents remembers the events one subscription delivered lately.
+type recentEvents struct {
+	sync.Mutex
+	recent map[string]time.Time
+}
+
+// check reports whether key was seen within ProxyEventDedupeFor, recording
+// it if not.
+func (r *recentEvents) check(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	for k, t := range r.recent {
+		if now.Sub(t) > ProxyEventDedupeFor {
+			delete(r.recent, k)
+		}
+	}
+	if _, seen := r.recent[key]; seen {
+		return true
+	}
+	r.recent[key] = now
+	return false
+}
+
+// podFromEvent works out which pod a sentinel event is about. Events about
+// masters read "master <name> <ip> <port>", events about other instances
+// end with "@ <master name> <ip> <port>" and +switch-master starts with the
+// master's name followed by its old and new address.
+func podFromEvent(channel, payload string) RedisPod {
+	f := strings.Fields(payload)
+	if channel == "+switch-master" && len(f) == 5 {
+		return RedisPod{Name: f[0], IP: f[3], Port: f[4]}
+	}
+	for i, word := range f {
+		if word == "@" && i+3 < len(f) {
+			return RedisPod{Name: f[i+1], IP: f[i+2], Port: f[i+3]}
+		}
+	}
+	if len(f) >= 4 && f[0] == "master" {
+		return RedisPod{Name: f[1], IP: f[2], Port: f[3]}
+	}
+	return RedisPod{}
+}
+
+func fieldString(fields map[string]interface{}, key string) string {
+	s, _ := resp.String(fields[key])
+	return s
+}
+
+func fieldInt(fields map[string]interface{}, key string) int64 {
+	n, _ := resp.Int(fields[key])
+	return n
+}
+
+// ParseMaster builds a pod from a SENTINEL MASTER reply.
+func ParseMaster(reply interface{}) (RedisPod, error) {
+	fields, err := resp.Map(reply)
+	if err != nil {
+		return RedisPod{}, err
+	}
+	return RedisPod{
+		Name:                  fieldString(fields, "name"),
+		IP:                    fieldString(fields, "ip"),
+		Port:                  fieldString(fields, "port"),
+		Quorum:                fieldString(fields, "quorum"),
+		ParallelSyncs:         fieldInt(fields, "parallel-syncs"),
+		DownAfterMilliseconds: fieldInt(fields, "down-after-milliseconds"),
+		FailoverTimeout:       fieldInt(fields, "failover-timeout"),
+		ConfigEpoch:           fieldInt(fields, "config-epoch"),
+	}, nil
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"strconv"
 	"strings"
+
+	"github.com/therealbill/palisade/sentinel"
 )
 
 var (
@@ -16,8 +18,14 @@ func init() {
 	sentinelSubcommands = make(map[string]CommandHandler)
 	sentinelSubcommands["MONITOR"] = sentinelMonitor
 	sentinelSubcommands["SET"] = sentinelSet
+	sentinelSubcommands["REMOVE"] = sentinelRemove
+	sentinelSubcommands["FLUSHCONFIG"] = sentinelFlushConfig
 	sentinelSubcommands["MASTER"] = sentinelGetMasterByName
 	sentinelSubcommands["GET-MASTER-ADDR-BY-NAME"] = sentinelGetMasterAddressByName
+	sentinelSubcommands["MASTERS"] = sentinelMasters
+	sentinelSubcommands["REPLICAS"] = sentinelReplicas
+	sentinelSubcommands["SLAVES"] = sentinelReplicas
+	sentinelSubcommands["SENTINELS"] = sentinelSentinels
 }
 
 func Sentinel(c *Command, w *bufio.Writer) error {
@@ -33,52 +41,94 @@ func Sentinel(c *Command, w *bufio.Writer) error {
 
 func sentinelSet(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	pod, exists := pods[name]
-	if !exists {
-		return SendError(w, "NOSUCHPOD Pod doesn't exist")
-	}
 	setting := string(c.Get(3))
 	value := string(c.Get(4))
 	switch strings.ToUpper(setting) {
-	case "AUTH-PASS":
-		pod.AuthPass = value
-		pods[name] = pod
-		return SendOk(w)
 	case "PARALLEL-SYNCS":
-		nval, err := strconv.ParseInt(value, 10, 32)
-		if err != nil {
+		if _, err := strconv.ParseInt(value, 10, 32); err != nil {
 			log.Printf("conversion error: '%s' doesn't become an int", value)
-			return SendError(w, "INVALIDVALUE value given for parallel-syncs must be an integer")
 		}
-		pod.ParallelSyncs = nval
-		pods[name] = pod
-		return SendOk(w)
+	case "NOTIFICATION-SCRIPT", "CLIENT-RECONFIG-SCRIPT":
+		if value != "" && !checkScript(value) {
+			return SendError(w, fmt.Sprintf("INVALIDVALUE %s is not an executable file", value))
+		}
+	}
+	if err := backend.Set(originOf(c), name, setting, value); err != nil {
+		return SendError(w, err.Error())
 	}
-	return SendError(w, fmt.Sprintf("%s is not a valid pod setting", setting))
+	return SendOk(w)
+}
+
+func sentinelRemove(c *Command, w *bufio.Writer) error {
+	name := string(c.Get(2))
+	if err := backend.Remove(originOf(c), name); err != nil {
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
 }
 
 func sentinelGetMasterAddressByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	pod, exists := pods[name]
+	pod, exists, err := backend.LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
 	if !exists {
 		return SendBulk(w, nil)
 	}
-	minfo := []string{pod.Name, pod.Port}
+	minfo := []string{pod.IP, pod.Port}
 	return SendBulkStrings(w, minfo)
 }
 
 func sentinelGetMasterByName(c *Command, w *bufio.Writer) error {
 	name := string(c.Get(2))
-	pod, exists := pods[name]
+	pod, exists, err := backend.LookupMaster(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
 	if !exists {
 		return SendBulk(w, nil)
 	}
-	minfo := []string{"name", pod.Name,
-		"port", pod.Port,
-		"auth-pass", pod.AuthPass,
-		"parallel-syncs", fmt.Sprintf("%d", pod.ParallelSyncs),
+	return SendBulkStrings(w, sentinel.PodInfo(pod))
+}
+
+func sentinelMasters(c *Command, w *bufio.Writer) error {
+	pods, err := backend.ListMasters()
+	if err != nil {
+		return SendError(w, err.Error())
 	}
-	return SendBulkStrings(w, minfo)
+	infos := make([][]string, 0, len(pods))
+	for _, pod := range pods {
+		infos = append(infos, sentinel.PodInfo(pod))
+	}
+	return SendBulkStringArrays(w, infos)
+}
+
+func sentinelReplicas(c *Command, w *bufio.Writer) error {
+	name := string(c.Get(2))
+	replicas, err := backend.Replicas(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	infos := make([][]string, 0, len(replicas))
+	for _, addr := range replicas {
+		ip, port := replicaHostPort(addr)
+		infos = append(infos, []string{"name", addr, "ip", ip, "port", port, "flags", "slave"})
+	}
+	return SendBulkStringArrays(w, infos)
+}
+
+func sentinelSentinels(c *Command, w *bufio.Writer) error {
+	name := string(c.Get(2))
+	sentinels, err := backend.Sentinels(name)
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	infos := make([][]string, 0, len(sentinels))
+	for _, s := range sentinels {
+		infos = append(infos, []string{"name", s.RunID, "ip", s.IP, "port", s.Port, "runid", s.RunID, "flags", "sentinel"})
+	}
+	return SendBulkStringArrays(w, infos)
 }
 
 func sentinelMonitor(c *Command, w *bufio.Writer) error {
@@ -88,6 +138,23 @@ func sentinelMonitor(c *Command, w *bufio.Writer) error {
 	quorum := string(c.Get(5))
 	pod := RedisPod{Name: name, IP: ip, Port: port, Quorum: quorum}
 	log.Printf("Need to add pod '%s' at '%s:%s' with quorum=%s", name, ip, port, quorum)
-	pods[name] = pod
+	if err := backend.Monitor(originOf(c), pod); err != nil {
+		return SendError(w, err.Error())
+	}
+	return SendOk(w)
+}
+
+func sentinelFlushConfig(c *Command, w *bufio.Writer) error {
+	if sentinelConf == nil {
+		return SendError(w, "ERR palisade was not started with a sentinel config file")
+	}
+	pods, err := backend.ListMasters()
+	if err != nil {
+		return SendError(w, err.Error())
+	}
+	if err := sentinelConf.Flush(pods); err != nil {
+		log.Printf("unable to rewrite %s: %v", sentinelConf.Path, err)
+		return SendError(w, fmt.Sprintf("ERR unable to rewrite config: %v", err))
+	}
 	return SendOk(w)
 }
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var sentinelConf *SentinelConf
+
+// SentinelConf is a stock Redis Sentinel configuration file. Parsing it
+// yields the pods it monitors; Flush writes palisade's pods back in the same
+// format, keeping every line that isn't a sentinel directive as it was.
+type SentinelConf struct {
+	Path         string
+	MyID         string
+	CurrentEpoch int64
+	// Pods in the order their monitor lines appeared.
+	Pods []RedisPod
+	// Other holds the non-sentinel lines (port, dir, comments and so on)
+	// and global sentinel directives palisade doesn't model, verbatim.
+	Other []string
+	// PodOther holds the per-master directives palisade doesn't model,
+	// such as rename-command, verbatim and by pod name. They are written
+	// after their pod's monitor line and go when the pod does.
+	PodOther map[string][]string
+
+	// flushLock serializes Flush, which rewrites PodOther and the file.
+	flushLock sync.Mutex
+}
+
+// ConfError reports a problem with a specific line of a config file.
+type ConfError struct {
+	Line int
+	Text string
+	Msg  string
+}
+
+func (e *ConfError) Error() string {
+	return fmt.Sprintf("config error at line %d >>> '%s': %s", e.Line, e.Text, e.Msg)
+}
+
+// LoadSentinelConf reads and parses the sentinel.conf at path.
+func LoadSentinelConf(path string) (*SentinelConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf, err := ParseSentinelConf(f)
+	if err != nil {
+		return nil, err
+	}
+	conf.Path = path
+	return conf, nil
+}
+
+func ParseSentinelConf(r io.Reader) (*SentinelConf, error) {
+	conf := &SentinelConf{PodOther: make(map[string][]string)}
+	pods := make(map[string]*RedisPod)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			conf.Other = append(conf.Other, line)
+			continue
+		}
+		argv, err := splitConfArgs(trimmed)
+		if err != nil {
+			return nil, &ConfError{lineno, line, err.Error()}
+		}
+		if strings.ToLower(argv[0]) != "sentinel" || len(argv) < 2 {
+			conf.Other = append(conf.Other, line)
+			continue
+		}
+		if err := conf.parseDirective(argv[1:], pods); err != nil {
+			return nil, &ConfError{lineno, line, err.Error()}
+		}
+		if isModelledDirective(argv[1]) {
+			continue
+		}
+		if name, ok := otherPodDirective(argv[1:], pods); ok {
+			conf.PodOther[name] = append(conf.PodOther[name], line)
+		} else {
+			conf.Other = append(conf.Other, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range conf.Pods {
+		conf.Pods[i] = *pods[conf.Pods[i].Name]
+	}
+	return conf, nil
+}
+
+// directiveArgs is the number of arguments, after the directive name, each
+// per-pod directive takes. The pod name is the first of them.
+var directiveArgs = map[string]int{
+	"monitor":                 4,
+	"known-replica":           3,
+	"known-slave":             3,
+	"known-sentinel":          4,
+	"config-epoch":            2,
+	"leader-epoch":            2,
+	"auth-pass":               2,
+	"auth-user":               2,
+	"down-after-milliseconds": 2,
+	"failover-timeout":        2,
+	"parallel-syncs":          2,
+	"notification-script":     2,
+	"client-reconfig-script":  2,
+}
+
+func isModelledDirective(name string) bool {
+	name = strings.ToLower(name)
+	_, perPod := directiveArgs[name]
+	return perPod || name == "myid" || name == "current-epoch"
+}
+
+// otherPodDirectives are the per-master directives Sentinel writes that
+// palisade keeps without modelling.
+var otherPodDirectives = map[string]bool{
+	"rename-command":                  true,
+	"master-reboot-down-after-period": true,
+}
+
+// otherPodDirective reports which pod an unmodelled directive belongs to:
+// one of otherPodDirectives, or any directive whose first argument names a
+// pod monitored earlier in the file.
+func otherPodDirective(argv []string, pods map[string]*RedisPod) (string, bool) {
+	if len(argv) < 2 {
+		return "", false
+	}
+	_, known := pods[argv[1]]
+	return argv[1], known || otherPodDirectives[strings.ToLower(argv[0])]
+}
+
+func (conf *SentinelConf) parseDirective(argv []string, pods map[string]*RedisPod) error {
+	directive := strings.ToLower(argv[0])
+	args := argv[1:]
+	switch directive {
+	case "myid":
+		if len(args) != 1 || len(args[0]) != 40 {
+			return fmt.Errorf("myid must be 40 characters")
+		}
+		conf.MyID = args[0]
+		return nil
+	case "current-epoch":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments")
+		}
+		epoch, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid epoch '%s'", args[0])
+		}
+		conf.CurrentEpoch = epoch
+		return nil
+	}
+	want, perPod := directiveArgs[directive]
+	if !perPod {
+		// Directives such as deny-scripts-reconfig or announce-ip are
+		// kept as they are but have no meaning to palisade.
+		return nil
+	}
+	if len(args) != want {
+		return fmt.Errorf("wrong number of arguments for '%s'", directive)
+	}
+	name := args[0]
+	if directive == "monitor" {
+		if _, exists := pods[name]; exists {
+			return fmt.Errorf("duplicated master name")
+		}
+		if err := checkConfPort(args[2]); err != nil {
+			return err
+		}
+		if q, err := strconv.Atoi(args[3]); err != nil || q <= 0 {
+			return fmt.Errorf("quorum must be 1 or greater")
+		}
+		pods[name] = &RedisPod{Name: name, IP: args[1], Port: args[2], Quorum: args[3]}
+		conf.Pods = append(conf.Pods, RedisPod{Name: name})
+		return nil
+	}
+	pod, exists := pods[name]
+	if !exists {
+		return fmt.Errorf("no such master with specified name")
+	}
+	switch directive {
+	case "known-replica", "known-slave":
+		if err := checkConfPort(args[2]); err != nil {
+			return err
+		}
+		pod.Replicas = append(pod.Replicas, net.JoinHostPort(args[1], args[2]))
+	case "known-sentinel":
+		if err := checkConfPort(args[2]); err != nil {
+			return err
+		}
+		pod.Sentinels = append(pod.Sentinels, KnownSentinel{IP: args[1], Port: args[2], RunID: args[3]})
+	case "config-epoch", "leader-epoch":
+		epoch, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid epoch '%s'", args[1])
+		}
+		if directive == "config-epoch" {
+			pod.ConfigEpoch = epoch
+		} else {
+			pod.LeaderEpoch = epoch
+		}
+	default:
+		// The remaining directives are the ones SENTINEL SET accepts.
+		if err := applySetting(pod, directive, args[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkConfPort(port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+	return nil
+}
+
+// Write renders the config with the given pods in sentinel.conf format. Pods
+// are written in name order so the output is stable.
+func (conf *SentinelConf) Write(w io.Writer, pods []RedisPod) error {
+	bw := bufio.NewWriter(w)
+	for _, line := range conf.Other {
+		fmt.Fprintln(bw, line)
+	}
+	if conf.MyID != "" {
+		fmt.Fprintf(bw, "sentinel myid %s\n", conf.MyID)
+	}
+	sorted := make([]RedisPod, len(pods))
+	copy(sorted, pods)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, pod := range sorted {
+		writePodDirectives(bw, pod)
+		for _, line := range conf.PodOther[pod.Name] {
+			fmt.Fprintln(bw, line)
+		}
+	}
+	fmt.Fprintf(bw, "sentinel current-epoch %d\n", conf.CurrentEpoch)
+	return bw.Flush()
+}
+
+func writePodDirectives(w io.Writer, pod RedisPod) {
+	name := quoteConfArg(pod.Name)
+	fmt.Fprintf(w, "sentinel monitor %s %s %s %s\n", name, pod.IP, pod.Port, pod.Quorum)
+	if pod.DownAfterMilliseconds > 0 {
+		fmt.Fprintf(w, "sentinel down-after-milliseconds %s %d\n", name, pod.DownAfterMilliseconds)
+	}
+	if pod.FailoverTimeout > 0 {
+		fmt.Fprintf(w, "sentinel failover-timeout %s %d\n", name, pod.FailoverTimeout)
+	}
+	if pod.ParallelSyncs > 0 {
+		fmt.Fprintf(w, "sentinel parallel-syncs %s %d\n", name, pod.ParallelSyncs)
+	}
+	if pod.NotificationScript != "" {
+		fmt.Fprintf(w, "sentinel notification-script %s %s\n", name, quoteConfArg(pod.NotificationScript))
+	}
+	if pod.ClientReconfigScript != "" {
+		fmt.Fprintf(w, "sentinel client-reconfig-script %s %s\n", name, quoteConfArg(pod.ClientReconfigScript))
+	}
+	if pod.AuthPass != "" {
+		fmt.Fprintf(w, "sentinel auth-pass %s %s\n", name, quoteConfArg(pod.AuthPass))
+	}
+	if pod.AuthUser != "" {
+		fmt.Fprintf(w, "sentinel auth-user %s %s\n", name, quoteConfArg(pod.AuthUser))
+	}
+	fmt.Fprintf(w, "sentinel config-epoch %s %d\n", name, pod.ConfigEpoch)
+	fmt.Fprintf(w, "sentinel leader-epoch %s %d\n", name, pod.LeaderEpoch)
+	for _, r := range pod.Replicas {
+		host, port, err := net.SplitHostPort(r)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "sentinel known-replica %s %s %s\n", name, host, port)
+	}
+	for _, s := range pod.Sentinels {
+		fmt.Fprintf(w, "sentinel known-sentinel %s %s %s %s\n", name, s.IP, s.Port, s.RunID)
+	}
+}
+
+// Flush rewrites the config file with the given pods. The new contents are
+// written to a temporary file which then replaces the original, so a crash
+// never leaves a truncated config behind. Concurrent flushes run one at a
+// time.
+func (conf *SentinelConf) Flush(pods []RedisPod) error {
+	conf.flushLock.Lock()
+	defer conf.flushLock.Unlock()
+	var buf bytes.Buffer
+	if err := conf.Write(&buf, pods); err != nil {
+		return err
+	}
+	// Directives of removed pods must not come back with a new pod of the
+	// same name.
+	kept := make(map[string][]string)
+	for _, pod := range pods {
+		if lines, ok := conf.PodOther[pod.Name]; ok {
+			kept[pod.Name] = lines
+		}
+	}
+	conf.PodOther = kept
+	tmp, err := ioutil.TempFile(filepath.Dir(conf.Path), ".palisade-conf-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(conf.Path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), conf.Path)
+}
+
+// splitConfArgs splits a config line into arguments the way Redis does,
+// honouring double quotes with backslash escapes and single quotes.
+func splitConfArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var cur []byte
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					case 'x':
+						if i+2 < len(line) {
+							if v, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+								c = byte(v)
+								i += 2
+								break
+							}
+						}
+						c = 'x'
+					default:
+						c = line[i]
+					}
+				}
+				cur = append(cur, c)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, fmt.Errorf("unbalanced quotes")
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				cur = append(cur, c)
+				i++
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				cur = append(cur, line[i])
+				i++
+			}
+			args = append(args, string(cur))
+			continue
+		}
+		// A closing quote must be followed by a space or the end of line.
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, fmt.Errorf("closing quote must be followed by a space")
+		}
+		args = append(args, string(cur))
+	}
+}
+
+// quoteConfArg returns s quoted and escaped when it can't be written bare.
+func quoteConfArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\") && strconv.CanBackquote(s) {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c == '\r':
+			b.WriteString("\\r")
+		case c == '\t':
+			b.WriteString("\\t")
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
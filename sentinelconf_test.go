@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testSentinelConf = `port 26379
+sentinel monitor cache 10.0.0.1 6379 2
+sentinel rename-command cache CONFIG GUESSME
+sentinel deny-scripts-reconfig yes
+sentinel monitor queue 10.0.0.2 6379 2
+sentinel master-reboot-down-after-period queue 0
+`
+
+func TestSentinelConfKeepsPodDirectivesWithTheirPod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sentinel.conf")
+	if err := ioutil.WriteFile(path, []byte(testSentinelConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadSentinelConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conf.Flush(conf.Pods); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	out := string(data)
+	for _, pair := range [][2]string{
+		{"sentinel monitor cache ", "sentinel rename-command cache CONFIG GUESSME"},
+		{"sentinel monitor queue ", "sentinel master-reboot-down-after-period queue 0"},
+	} {
+		monitor, directive := strings.Index(out, pair[0]), strings.Index(out, pair[1])
+		if monitor < 0 || directive < monitor {
+			t.Errorf("%q is not written after %q:\n%s", pair[1], pair[0], out)
+		}
+	}
+	if !strings.Contains(out, "sentinel deny-scripts-reconfig yes") {
+		t.Errorf("global directive was lost:\n%s", out)
+	}
+
+	// Remove cache, then monitor a new pod with the same name.
+	if err := conf.Flush(conf.Pods[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Flush(conf.Pods); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if strings.Contains(string(data), "rename-command") {
+		t.Errorf("directive of a removed pod came back:\n%s", data)
+	}
+}
+
+func TestSentinelConfConcurrentFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sentinel.conf")
+	if err := ioutil.WriteFile(path, []byte(testSentinelConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadSentinelConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := conf.Flush(conf.Pods[i%2:]); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := LoadSentinelConf(path); err != nil {
+		t.Errorf("concurrent flushes left an unreadable config: %v", err)
+	}
+}
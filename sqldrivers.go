@@ -0,0 +1,8 @@
+package main
+
+// Drivers available to --sql-driver.
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
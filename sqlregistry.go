@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SQLReadOnly = errors.New("READONLY pods are managed in the inventory database")
+
+	DefaultSQLPodQuery     = "SELECT ip, port, auth_pass FROM pods WHERE name = ?"
+	DefaultSQLReplicaQuery = "SELECT ip, port FROM replicas WHERE pod = ?"
+	DefaultSQLCacheTTL     = 5 * time.Second
+
+	// SQLCacheSize bounds the pods cached, and SQLMissingCacheSize the
+	// "no such pod" answers, so lookups of made up names can't grow the
+	// cache without limit or push out real pods.
+	SQLCacheSize        = 10000
+	SQLMissingCacheSize = 1000
+)
+
+// SQLConfig describes the inventory database and how to query it.
+type SQLConfig struct {
+	// Driver and DSN are passed to sql.Open.
+	Driver string
+	DSN    string
+	// PodQuery takes the pod name and returns a single row of ip, port and
+	// auth password. Queries use ? for the pod name; for postgres it is
+	// rewritten to $1 unless the query already uses $1.
+	PodQuery string
+	// ReplicaQuery takes the pod name and returns one ip, port row per
+	// replica. Replicas are not looked up when it is empty.
+	ReplicaQuery string
+	// CacheTTL is how long answers, including "no such pod", are reused.
+	CacheTTL time.Duration
+}
+
+type sqlCacheEntry struct {
+	pod     RedisPod
+	expires time.Time
+}
+
+// SQLRegistry answers pod lookups from a database of Redis instances that
+// Sentinel doesn't manage, through a short lived read-through cache. Pods
+// are administered in the database, so pod mutations are refused.
+type SQLRegistry struct {
+	Config SQLConfig
+	db     *sql.DB
+	store  *PodStore
+
+	sync.Mutex
+	cache   map[string]sqlCacheEntry
+	missing map[string]time.Time
+}
+
+func NewSQLRegistry(cfg SQLConfig, store *PodStore) (*SQLRegistry, error) {
+	if cfg.PodQuery == "" {
+		cfg.PodQuery = DefaultSQLPodQuery
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DefaultSQLCacheTTL
+	}
+	cfg.PodQuery = sqlPlaceholders(cfg.Driver, cfg.PodQuery)
+	cfg.ReplicaQuery = sqlPlaceholders(cfg.Driver, cfg.ReplicaQuery)
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLRegistry{
+		Config:  cfg,
+		db:      db,
+		store:   store,
+		cache:   make(map[string]sqlCacheEntry),
+		missing: make(map[string]time.Time),
+	}, nil
+}
+
+// sqlPlaceholders rewrites the ? placeholder to the driver's own syntax.
+func sqlPlaceholders(driver, query string) string {
+	if driver == "postgres" && !strings.Contains(query, "$1") {
+		return strings.Replace(query, "?", "$1", -1)
+	}
+	return query
+}
+
+func (r *SQLRegistry) Apply(m Mutation) error {
+	switch m.Op {
+	case OpMonitor, OpSet, OpRemove, OpRestore:
+		return SQLReadOnly
+	}
+	return r.store.Apply(m)
+}
+
+func (r *SQLRegistry) ReadBarrier() error {
+	return nil
+}
+
+// Lookup returns the named pod from the cache, querying the database when
+// the cached answer is missing or stale.
+func (r *SQLRegistry) Lookup(name string) (RedisPod, bool, error) {
+	now := time.Now()
+	r.Lock()
+	entry, cached := r.cache[name]
+	missingUntil, missing := r.missing[name]
+	r.Unlock()
+	if cached && now.Before(entry.expires) {
+		return entry.pod, true, nil
+	}
+	if missing && now.Before(missingUntil) {
+		return RedisPod{}, false, nil
+	}
+	pod, exists, err := r.query(name)
+	if err != nil {
+		log.Printf("inventory lookup for '%s' failed: %v", name, err)
+		return pod, false, err
+	}
+	expires := time.Now().Add(r.Config.CacheTTL)
+	r.Lock()
+	if exists {
+		delete(r.missing, name)
+		if _, ok := r.cache[name]; !ok && len(r.cache) >= SQLCacheSize {
+			r.evict()
+		}
+		r.cache[name] = sqlCacheEntry{pod: pod, expires: expires}
+	} else {
+		delete(r.cache, name)
+		if _, ok := r.missing[name]; !ok && len(r.missing) >= SQLMissingCacheSize {
+			r.evictMissing()
+		}
+		r.missing[name] = expires
+	}
+	r.Unlock()
+	return pod, exists, nil
+}
+
+// evict makes room in the full pod cache by dropping expired answers, or an
+// arbitrary one when none have expired. The lock must be held.
+func (r *SQLRegistry) evict() {
+	now := time.Now()
+	for name, entry := range r.cache {
+		if now.After(entry.expires) {
+			delete(r.cache, name)
+		}
+	}
+	for name := range r.cache {
+		if len(r.cache) < SQLCacheSize {
+			return
+		}
+		delete(r.cache, name)
+	}
+}
+
+// evictMissing does the same as evict for "no such pod" answers.
+func (r *SQLRegistry) evictMissing() {
+	now := time.Now()
+	for name, expires := range r.missing {
+		if now.After(expires) {
+			delete(r.missing, name)
+		}
+	}
+	for name := range r.missing {
+		if len(r.missing) < SQLMissingCacheSize {
+			return
+		}
+		delete(r.missing, name)
+	}
+}
+
+func (r *SQLRegistry) query(name string) (RedisPod, bool, error) {
+	pod := RedisPod{Name: name}
+	var port int
+	var authPass sql.NullString
+	err := r.db.QueryRow(r.Config.PodQuery, name).Scan(&pod.IP, &port, &authPass)
+	if err == sql.ErrNoRows {
+		return pod, false, nil
+	}
+	if err != nil {
+		return pod, false, err
+	}
+	pod.Port = strconv.Itoa(port)
+	pod.AuthPass = authPass.String
+	if r.Config.ReplicaQuery == "" {
+		return pod, true, nil
+	}
+	rows, err := r.db.Query(r.Config.ReplicaQuery, name)
+	if err != nil {
+		return pod, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		var rport int
+		if err := rows.Scan(&ip, &rport); err != nil {
+			return pod, false, err
+		}
+		pod.Replicas = append(pod.Replicas, net.JoinHostPort(ip, strconv.Itoa(rport)))
+	}
+	return pod, true, rows.Err()
+}
+
+// Close releases the database connection pool.
+func (r *SQLRegistry) Close() error {
+	return r.db.Close()
+}
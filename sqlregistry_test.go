@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLRegistrySQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "inventory.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE pods (name TEXT PRIMARY KEY, ip TEXT, port INTEGER, auth_pass TEXT)",
+		"CREATE TABLE replicas (pod TEXT, ip TEXT, port INTEGER)",
+		"INSERT INTO pods VALUES ('cache', '10.0.0.1', 6379, 'secret')",
+		"INSERT INTO pods VALUES ('queue', '10.0.0.5', 6380, NULL)",
+		"INSERT INTO replicas VALUES ('cache', '10.0.0.2', 6379)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := SQLMissingCacheSize
+	SQLMissingCacheSize = 2
+	defer func() { SQLMissingCacheSize = saved }()
+
+	r, err := NewSQLRegistry(SQLConfig{Driver: "sqlite3", DSN: dsn, PodQuery: DefaultSQLPodQuery, ReplicaQuery: DefaultSQLReplicaQuery, CacheTTL: time.Minute}, NewPodStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	pod, exists, err := r.Lookup("cache")
+	if err != nil || !exists {
+		t.Fatalf("Lookup(cache) = %v, %v", exists, err)
+	}
+	if pod.IP != "10.0.0.1" || pod.Port != "6379" || pod.AuthPass != "secret" || len(pod.Replicas) != 1 || pod.Replicas[0] != "10.0.0.2:6379" {
+		t.Errorf("Lookup(cache) = %+v", pod)
+	}
+	if pod, exists, _ := r.Lookup("queue"); !exists || pod.AuthPass != "" {
+		t.Errorf("Lookup(queue) = %+v, %v", pod, exists)
+	}
+
+	// Answers are served from the cache until they expire.
+	if _, err := db.Exec("UPDATE pods SET ip = '10.0.0.9' WHERE name = 'cache'"); err != nil {
+		t.Fatal(err)
+	}
+	if pod, _, _ := r.Lookup("cache"); pod.IP != "10.0.0.1" {
+		t.Errorf("cached answer not used: %+v", pod)
+	}
+
+	for _, name := range []string{"nope-1", "nope-2", "nope-3", "nope-4"} {
+		if _, exists, err := r.Lookup(name); exists || err != nil {
+			t.Errorf("Lookup(%s) = %v, %v", name, exists, err)
+		}
+	}
+	r.Lock()
+	missing, cached := len(r.missing), len(r.cache)
+	r.Unlock()
+	if missing > SQLMissingCacheSize {
+		t.Errorf("%d unknown names cached, want at most %d", missing, SQLMissingCacheSize)
+	}
+	if cached != 2 {
+		t.Errorf("unknown names pushed out pods: %d cached", cached)
+	}
+
+	if err := r.Apply(Mutation{Op: OpRemove, Name: "cache"}); err != SQLReadOnly {
+		t.Errorf("REMOVE returned %v, want %v", err, SQLReadOnly)
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	for _, tc := range []struct{ driver, query, want string }{
+		{"sqlite3", DefaultSQLPodQuery, DefaultSQLPodQuery},
+		{"mysql", DefaultSQLPodQuery, DefaultSQLPodQuery},
+		{"postgres", DefaultSQLPodQuery, "SELECT ip, port, auth_pass FROM pods WHERE name = $1"},
+		{"postgres", "SELECT ip, port, pass FROM p WHERE n = $1 AND tags ? 'redis'", "SELECT ip, port, pass FROM p WHERE n = $1 AND tags ? 'redis'"},
+	} {
+		if got := sqlPlaceholders(tc.driver, tc.query); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.driver, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/therealbill/palisade/credential"
+	"github.com/therealbill/palisade/sentinel"
+)
+
+var (
+	NoSuchPod      = sentinel.NoSuchPod
+	UnknownOp      = errors.New("UNKNOWNOP Unknown mutation")
+	InvalidSyncVal = errors.New("INVALIDVALUE value given for parallel-syncs must be an integer")
+	InvalidTimeVal = errors.New("INVALIDVALUE value must be a positive number of milliseconds")
+	InvalidQuorum  = errors.New("INVALIDVALUE quorum must be a positive integer")
+)
+
+// Mutation is a single change to palisade's state. Every write goes through
+// one of these so that it can be applied locally or replicated through the
+// cluster log and applied identically on every node.
+type Mutation struct {
+	Op      string
+	Pod     RedisPod `json:",omitempty"`
+	Name    string   `json:",omitempty"`
+	Setting string   `json:",omitempty"`
+	Value   string   `json:",omitempty"`
+	// Pods are the states RESTORE puts pods back to; nil removes a pod.
+	Pods map[string]*RedisPod `json:",omitempty"`
+	// Actor, Command and Time are recorded in the change history.
+	Actor   string    `json:",omitempty"`
+	Command string    `json:",omitempty"`
+	Time    time.Time `json:",omitempty"`
+}
+
+const (
+	OpMonitor  = "MONITOR"
+	OpSet      = "SET"
+	OpRemove   = "REMOVE"
+	OpAddToken = "ADDTOKEN"
+	OpDelToken = "DELTOKEN"
+	OpRestore  = "RESTORE"
+	// OpSetMember records the client address of cluster member Name,
+	// removing it when Value is empty.
+	OpSetMember = "SETMEMBER"
+)
+
+// PodStore holds the pods and auth tokens a palisade instance knows about,
+// and the history of changes made to the pods.
+type PodStore struct {
+	sync.RWMutex
+	pods    map[string]RedisPod
+	tokens  map[string]credential.Credential
+	members map[string]string
+	history *History
+}
+
+func NewPodStore() *PodStore {
+	return &PodStore{pods: make(map[string]RedisPod), tokens: make(map[string]credential.Credential), members: make(map[string]string), history: &History{}}
+}
+
+// History returns the changes made to the store's pods.
+func (s *PodStore) History() *History {
+	return s.history
+}
+
+func (s *PodStore) Get(name string) (RedisPod, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	pod, exists := s.pods[name]
+	return pod, exists
+}
+
+// Tokens returns the credentials of the auth tokens. Only salted hashes of
+// tokens are kept, in the store and in the mutations that add and remove
+// them.
+func (s *PodStore) Tokens() []credential.Credential {
+	s.RLock()
+	defer s.RUnlock()
+	return s.tokenList()
+}
+
+// tokenList lists the tokens' credentials by hash with the lock held.
+func (s *PodStore) tokenList() []credential.Credential {
+	creds := make([]credential.Credential, 0, len(s.tokens))
+	for _, cred := range s.tokens {
+		creds = append(creds, cred)
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Hash < creds[j].Hash })
+	return creds
+}
+
+// ValidToken reports whether token is one of the unexpired tokens added.
+func (s *PodStore) ValidToken(token string) bool {
+	return credential.Check(s.Tokens(), token)
+}
+
+// MemberAddr is the client address cluster member id recorded, empty when
+// it recorded none.
+func (s *PodStore) MemberAddr(id string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.members[id]
+}
+
+// HasTokens reports whether any token was added.
+func (s *PodStore) HasTokens() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.tokens) > 0
+}
+
+// Apply performs a mutation against the store. Errors are formatted for
+// sending straight back to the client.
+func (s *PodStore) Apply(m Mutation) error {
+	s.Lock()
+	changes, err := s.apply(m)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		announce(ch)
+	}
+	return nil
+}
+
+// Check reports the error Apply would return for a mutation without
+// performing it.
+func (s *PodStore) Check(m Mutation) error {
+	s.RLock()
+	defer s.RUnlock()
+	switch m.Op {
+	case OpMonitor, OpDelToken, OpRestore, OpSetMember:
+		return nil
+	case OpAddToken:
+		_, err := credential.Parse(m.Value)
+		return err
+	case OpSet:
+		pod, exists := s.pods[m.Name]
+		if !exists {
+			return NoSuchPod
+		}
+		return applySetting(&pod, m.Setting, m.Value)
+	case OpRemove:
+		if _, exists := s.pods[m.Name]; !exists {
+			return NoSuchPod
+		}
+		return nil
+	}
+	return UnknownOp
+}
+
+// Replay performs a mutation without announcing events, for rebuilding
+// state that was announced before.
+func (s *PodStore) Replay(m Mutation) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.apply(m)
+	return err
+}
+
+// apply does the work of Apply with the lock held, recording the change in
+// the history and returning what the mutation did to the pods it touched so
+// events can be sent once the lock is released. Token mutations touch no
+// pod.
+func (s *PodStore) apply(m Mutation) ([]PodChange, error) {
+	changes, err := s.change(m)
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+	at := m.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	s.history.Record(m.Actor, m.Command, at, changes)
+	return changes, nil
+}
+
+func (s *PodStore) change(m Mutation) ([]PodChange, error) {
+	switch m.Op {
+	case OpMonitor:
+		pod := m.Pod
+		ch := PodChange{Name: pod.Name}
+		if prev, exists := s.pods[pod.Name]; exists {
+			ch.Before = &prev
+			pod = remonitor(prev, pod)
+		}
+		s.pods[pod.Name] = pod
+		ch.After = &pod
+		return []PodChange{ch}, nil
+	case OpSet:
+		pod, exists := s.pods[m.Name]
+		if !exists {
+			return nil, NoSuchPod
+		}
+		before := pod
+		if err := applySetting(&pod, m.Setting, m.Value); err != nil {
+			return nil, err
+		}
+		s.pods[m.Name] = pod
+		return []PodChange{{Name: m.Name, Before: &before, After: &pod}}, nil
+	case OpRemove:
+		pod, exists := s.pods[m.Name]
+		if !exists {
+			return nil, NoSuchPod
+		}
+		delete(s.pods, m.Name)
+		return []PodChange{{Name: m.Name, Before: &pod}}, nil
+	case OpRestore:
+		return s.restore(m.Pods), nil
+	case OpAddToken:
+		// Value is the credential, replacing any with the same hash so
+		// its expiry can be changed. Logs from before tokens were salted
+		// hold SHA-256 hashes, which are still read.
+		cred, err := credential.Parse(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens[cred.Hash] = cred
+		return nil, nil
+	case OpDelToken:
+		// Value is the hash of the credential.
+		delete(s.tokens, m.Value)
+		return nil, nil
+	case OpSetMember:
+		if m.Value == "" {
+			delete(s.members, m.Name)
+		} else {
+			s.members[m.Name] = m.Value
+		}
+		return nil, nil
+	}
+	return nil, UnknownOp
+}
+
+// remonitor is a known pod prev monitored again as pod. That moves its
+// master, as a failover would; its settings and scripts stay.
+func remonitor(prev, pod RedisPod) RedisPod {
+	prev.IP, prev.Port, prev.Quorum = pod.IP, pod.Port, pod.Quorum
+	return prev
+}
+
+// restore puts each named pod into the given state, all at once.
+func (s *PodStore) restore(states map[string]*RedisPod) []PodChange {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var changes []PodChange
+	for _, name := range names {
+		ch := PodChange{Name: name}
+		if prev, exists := s.pods[name]; exists {
+			ch.Before = &prev
+		}
+		if target := states[name]; target != nil {
+			pod := *target
+			pod.Name = name
+			ch.After = &pod
+			s.pods[name] = pod
+		} else {
+			delete(s.pods, name)
+		}
+		if ch.Before == nil && ch.After == nil || ch.Before != nil && ch.After != nil && reflect.DeepEqual(*ch.Before, *ch.After) {
+			continue
+		}
+		changes = append(changes, ch)
+	}
+	return changes
+}
+
+// announce sends the events for a change to a pod: +monitor for a new pod,
+// -monitor for a removed one and +switch-master when its master moved.
+func announce(ch PodChange) {
+	switch {
+	case ch.Before == nil && ch.After != nil:
+		sentinelEvent(*ch.After, "+monitor", "quorum "+ch.After.Quorum)
+	case ch.Before != nil && ch.After == nil:
+		sentinelEvent(*ch.Before, "-monitor", "")
+	case ch.Before != nil && (ch.Before.IP != ch.After.IP || ch.Before.Port != ch.After.Port):
+		switchMaster(*ch.Before, *ch.After)
+	}
+}
+
+func applySetting(pod *RedisPod, setting, value string) error {
+	switch strings.ToUpper(setting) {
+	case "AUTH-PASS":
+		pod.AuthPass = value
+	case "AUTH-USER":
+		pod.AuthUser = value
+	case "QUORUM":
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return InvalidQuorum
+		}
+		pod.Quorum = value
+	case "DOWN-AFTER-MILLISECONDS", "FAILOVER-TIMEOUT":
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms <= 0 {
+			return InvalidTimeVal
+		}
+		if strings.ToUpper(setting) == "FAILOVER-TIMEOUT" {
+			pod.FailoverTimeout = ms
+		} else {
+			pod.DownAfterMilliseconds = ms
+		}
+	case "PARALLEL-SYNCS":
+		nval, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return InvalidSyncVal
+		}
+		pod.ParallelSyncs = nval
+	case "NOTIFICATION-SCRIPT":
+		pod.NotificationScript = value
+	case "CLIENT-RECONFIG-SCRIPT":
+		pod.ClientReconfigScript = value
+	default:
+		return fmt.Errorf("%s is not a valid pod setting", setting)
+	}
+	return nil
+}
+
+// List returns a copy of every known pod.
+func (s *PodStore) List() []RedisPod {
+	s.RLock()
+	defer s.RUnlock()
+	list := make([]RedisPod, 0, len(s.pods))
+	for _, pod := range s.pods {
+		list = append(list, pod)
+	}
+	return list
+}
+
+// Load replaces the set of pods wholesale, as registries that keep pods
+// outside palisade do when their source changes. Differences from the
+// previous set are recorded in the history as made by o and announced as
+// +monitor, -monitor and +switch-master events.
+func (s *PodStore) Load(o Origin, pods map[string]RedisPod) {
+	s.Lock()
+	old := s.pods
+	s.pods = pods
+	var changes []PodChange
+	for name, pod := range pods {
+		pod := pod
+		ch := PodChange{Name: name, After: &pod}
+		if prev, exists := old[name]; exists {
+			if reflect.DeepEqual(prev, pod) {
+				continue
+			}
+			ch.Before = &prev
+		}
+		changes = append(changes, ch)
+	}
+	for name, pod := range old {
+		if _, exists := pods[name]; !exists {
+			pod := pod
+			changes = append(changes, PodChange{Name: name, Before: &pod})
+		}
+	}
+	s.record(o, changes)
+	s.Unlock()
+	for _, ch := range changes {
+		announce(ch)
+	}
+}
+
+// Update changes only the given pods, removing those that are nil, and like
+// Load records and announces the ones that differ from what the store held.
+// Pods not given are left alone.
+func (s *PodStore) Update(o Origin, pods map[string]*RedisPod) {
+	s.Lock()
+	var changes []PodChange
+	for name, pod := range pods {
+		prev, exists := s.pods[name]
+		switch {
+		case pod == nil && !exists:
+		case pod == nil:
+			delete(s.pods, name)
+			changes = append(changes, PodChange{Name: name, Before: &prev})
+		case exists && reflect.DeepEqual(prev, *pod):
+		default:
+			after := *pod
+			s.pods[name] = after
+			ch := PodChange{Name: name, After: &after}
+			if exists {
+				ch.Before = &prev
+			}
+			changes = append(changes, ch)
+		}
+	}
+	s.record(o, changes)
+	s.Unlock()
+	for _, ch := range changes {
+		announce(ch)
+	}
+}
+
+// record adds changes made by o to the history. The lock must be held.
+func (s *PodStore) record(o Origin, changes []PodChange) {
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	at := o.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	s.history.Record(o.Actor, o.Command, at, changes)
+}
+
+// Seed replaces the set of pods without announcing them, for a registry's
+// first load of pods that were announced when they were added.
+func (s *PodStore) Seed(pods map[string]RedisPod) {
+	s.Lock()
+	s.pods = pods
+	s.Unlock()
+}
+
+// SeedPods changes only the given pods, removing those that are nil,
+// without recording or announcing them, for registries that drop pods from
+// a bounded cache and take them back later.
+func (s *PodStore) SeedPods(pods map[string]*RedisPod) {
+	s.Lock()
+	for name, pod := range pods {
+		if pod == nil {
+			delete(s.pods, name)
+		} else {
+			s.pods[name] = *pod
+		}
+	}
+	s.Unlock()
+}
+
+type storeState struct {
+	Pods map[string]RedisPod
+	// Tokens are the SHA-256 hashes snapshots from before tokens were
+	// salted hold; they are read as credentials.
+	Tokens      map[string]bool `json:",omitempty"`
+	Credentials []credential.Credential
+	Members     map[string]string
+	History     historyState
+}
+
+// Marshal serializes the full store, history included, for snapshots.
+func (s *PodStore) Marshal() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return json.Marshal(storeState{Pods: s.pods, Credentials: s.tokenList(), Members: s.members, History: s.history.state()})
+}
+
+// Restore replaces the store contents with a previously marshalled state.
+func (s *PodStore) Restore(data []byte) error {
+	var st storeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	if st.Pods == nil {
+		st.Pods = make(map[string]RedisPod)
+	}
+	tokens := make(map[string]credential.Credential)
+	for hash := range st.Tokens {
+		tokens[hash] = credential.Credential{Hash: hash}
+	}
+	for _, cred := range st.Credentials {
+		tokens[cred.Hash] = cred
+	}
+	if st.Members == nil {
+		st.Members = make(map[string]string)
+	}
+	s.Lock()
+	s.pods = st.Pods
+	s.tokens = tokens
+	s.members = st.Members
+	s.history.restore(st.History)
+	s.Unlock()
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/therealbill/palisade/credential"
+)
+
+func TestTokensKeptHashed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := useDurable(t, dir)
+	defer r.Close()
+
+	if reply := run(t, tokenCommand, "TOKEN", "ADD", "s3cret-token"); !strings.HasPrefix(reply, "$8\r\n") {
+		t.Fatalf("TOKEN ADD replied %q", reply)
+	}
+	sum := sha256.Sum256([]byte("s3cret-token"))
+	unsalted := hex.EncodeToString(sum[:])
+	if !store.ValidToken("s3cret-token") || store.ValidToken(unsalted) {
+		t.Error("tokens are not checked against their hash")
+	}
+	if err := r.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	run(t, tokenCommand, "TOKEN", "ADD", "other-token")
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "s3cret-token") || strings.Contains(string(data), "other-token") {
+			t.Errorf("%s holds a token in plaintext", filepath.Base(file))
+		}
+		if strings.Contains(string(data), unsalted) {
+			t.Errorf("%s holds an unsalted hash of a token", filepath.Base(file))
+		}
+	}
+	run(t, tokenCommand, "TOKEN", "DEL", "s3cret-token")
+	if store.ValidToken("s3cret-token") || !store.ValidToken("other-token") {
+		t.Error("TOKEN DEL didn't remove just the token given")
+	}
+	if reply := run(t, tokenCommand, "TOKEN", "DEL", "s3cret-token"); !strings.HasPrefix(reply, "-ERR no such token") {
+		t.Errorf("deleting a deleted token replied %q", reply)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "palisade-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := useDurable(t, dir)
+
+	reply := run(t, tokenCommand, "TOKEN", "ADD", "old-token")
+	id := strings.Split(reply, "\r\n")[1]
+	run(t, tokenCommand, "TOKEN", "ADD", "new-token", "TTL", "3600")
+	if !store.ValidToken("old-token") || !store.ValidToken("new-token") {
+		t.Fatal("tokens added don't work")
+	}
+	if reply := run(t, tokenCommand, "TOKEN", "EXPIRE", id, "0"); reply != "+OK\r\n" {
+		t.Fatalf("TOKEN EXPIRE replied %q", reply)
+	}
+	if store.ValidToken("old-token") || !store.ValidToken("new-token") {
+		t.Error("expiring one token didn't stop just that one")
+	}
+	if list := run(t, tokenCommand, "TOKEN", "LIST"); strings.Count(list, "expired") != 1 {
+		t.Errorf("TOKEN LIST replied %q", list)
+	}
+	r.Close()
+
+	// The expiry survives a restart.
+	r = useDurable(t, dir)
+	defer r.Close()
+	if store.ValidToken("old-token") || !store.ValidToken("new-token") {
+		t.Error("token expiry was lost on restart")
+	}
+}
+
+func TestUnsaltedTokensStillRead(t *testing.T) {
+	sum := sha256.Sum256([]byte("old-token"))
+	unsalted := hex.EncodeToString(sum[:])
+	s := NewPodStore()
+	if err := s.Restore([]byte(`{"Tokens":{"` + unsalted + `":true}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ValidToken("old-token") {
+		t.Error("a token from an older snapshot was lost")
+	}
+	s = NewPodStore()
+	if err := s.Apply(Mutation{Op: OpAddToken, Value: unsalted}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ValidToken("old-token") {
+		t.Error("a token from an older log was lost")
+	}
+	if err := s.Apply(Mutation{Op: OpDelToken, Value: unsalted}); err != nil || s.ValidToken("old-token") {
+		t.Error("a token from an older log can't be removed by its log record")
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	defer func(cred *credential.Credential) { authToken = cred }(authToken)
+	authToken = nil
+	if err := authConnection(&Command{argv: [][]byte{[]byte("AUTH"), []byte("secretpass1")}}, nil); err == nil {
+		t.Error("the old default token is still accepted")
+	}
+	cred, err := credential.New("flag-token", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authToken = &cred
+	if err := authConnection(&Command{argv: [][]byte{[]byte("AUTH"), []byte("flag-token")}}, nil); err != nil {
+		t.Error("--authtoken is not accepted")
+	}
+}